@@ -0,0 +1,231 @@
+package shlev
+
+import (
+	"context"
+	"fmt"
+	"github.com/Senhnn/shlev/internal/socket"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"time"
+)
+
+// 默认的连接超时时间
+const defaultConnectTimeout = 10 * time.Second
+
+// Client 主动发起连接的客户端，有自己的事件循环，发起的连接和服务器接收的连接一样由负载均衡器分配事件循环，
+// 使用同一套EventHandler回调。需要在服务器的事件循环上发起连接时使用Server.Dial
+type Client struct {
+	s *Server
+}
+
+// NewClient 创建客户端并开启事件循环，选项和服务器相同，监听相关的选项不生效，
+// OnBoot传入的Server没有监听器，在它上面调用Dial和Client.Dial一样
+func NewClient(eventHandler EventHandler, opts ...OptionFunc) (*Client, error) {
+	options := loadOptions(opts...)
+	options.ReadBufferCap = MaxTcpBufferCap
+	options.WriteBufferCap = MaxTcpBufferCap
+
+	s, err := serve(eventHandler, nil, options, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{s: s}, nil
+}
+
+// Dial 发起连接，参看Server.Dial
+func (cli *Client) Dial(network, addr string) (*Conn, error) {
+	return cli.s.DialContext(network, addr, nil)
+}
+
+// DialContext 发起连接，ctx作为连接的Context，参看Server.DialContext
+func (cli *Client) DialContext(network, addr string, ctx interface{}) (*Conn, error) {
+	return cli.s.DialContext(network, addr, ctx)
+}
+
+// Shutdown 关闭客户端，和Server.Shutdown一样先排空连接，还没有建立的连接直接关闭
+func (cli *Client) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	return cli.s.Shutdown(ctx)
+}
+
+// Dial 在服务器的事件循环上发起连接，network为tcp、tcp4、tcp6或者unix。
+// 连接是非阻塞的，返回时连接还没有建立，结果通过ConnectHandler.OnConnect通知，成功之后调用OnOpen。
+// 返回的连接可以立即调用AsyncWrite、Close，写入的数据在连接建立之后发送。
+// addr是域名时会阻塞地解析，在事件循环中调用时要使用IP地址
+func (s *Server) Dial(network, addr string) (*Conn, error) {
+	return s.DialContext(network, addr, nil)
+}
+
+// DialContext 和Dial一样，ctx作为连接的Context，在OnConnect之前设置。
+// codec、resp和websocket的适配器在OnOpen中把它移到自己的连接状态里，之后要用它们提供的Context读取；
+// http.Server用连接的Context保存解析状态，会丢弃ctx
+func (s *Server) DialContext(network, addr string, ctx interface{}) (*Conn, error) {
+	return s.dial(network, addr, ctx, nil, nil)
+}
+
+// 发起连接，el为nil时由负载均衡器选择事件循环，pc不为nil时连接属于连接池
+func (s *Server) dial(network, addr string, ctx interface{}, el *EventLoop, pc *pooledConn) (*Conn, error) {
+	select {
+	case <-s.shutdown:
+		return nil, shleverror.ErrServerInShutdown
+	default:
+	}
+
+	var (
+		fd         int
+		sa         unix.Sockaddr
+		remoteAddr net.Addr
+		err        error
+	)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		fd, sa, remoteAddr, err = socket.TCPConnectSocket(network, addr, s.dialSocketOptions()...)
+	case "unix":
+		fd, sa, remoteAddr, err = socket.UnixConnectSocket(addr)
+	default:
+		return nil, shleverror.ErrUnsupportedProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.TCPKeepAlive > 0 && network != "unix" {
+		if err = socket.SetKeepAlivePeriod(fd, int(s.opts.TCPKeepAlive/time.Second)); err != nil {
+			logger.Error("set keep-alive error:", err)
+		}
+	}
+
+	if el == nil {
+		el = s.nextLoop(remoteAddr)
+	}
+	c := newClientConn(fd, el, sa, remoteAddr)
+	c.context = ctx
+	c.pooled = pc
+	// 和之后的AsyncWrite、Close使用同一个任务队列，保证先注册
+	if err = c.dispatch(el.dial, c); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return c, nil
+}
+
+// 主动发起的连接使用的套接字选项
+func (s *Server) dialSocketOptions() []socket.SocketOption {
+	var sockOpts []socket.SocketOption
+	if s.opts.TCPNoDelay {
+		sockOpts = append(sockOpts, socket.SocketOption{SetSockOpt: socket.SetNoDelay, Opt: 1})
+	}
+	if s.opts.SocketRecvBuffer > 0 {
+		sockOpts = append(sockOpts, socket.SocketOption{SetSockOpt: socket.SetRecvBuffer, Opt: s.opts.SocketRecvBuffer})
+	}
+	if s.opts.SocketSendBuffer > 0 {
+		sockOpts = append(sockOpts, socket.SocketOption{SetSockOpt: socket.SetSendBuffer, Opt: s.opts.SocketSendBuffer})
+	}
+	return sockOpts
+}
+
+// 在事件循环中注册正在连接的套接字，监听写事件等待连接完成
+func (e *EventLoop) dial(itf interface{}) error {
+	c := itf.(*Conn)
+	if e.draining {
+		e.abortDial(c, shleverror.ErrServerInShutdown)
+		return nil
+	}
+	if err := e.netpoll.AddReadWrite(c.fd); err != nil {
+		e.abortDial(c, err)
+		return nil
+	}
+	e.tcpConnectionMap[c.fd] = c
+	c.opened = true
+	e.addConn(1)
+
+	timeout := e.server.opts.ConnectTimeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+	c.AfterFunc(timeout, func(c *Conn) HandleResult {
+		if c.connecting {
+			logger.Warn(fmt.Sprintf("connect timeout, fd:%d remote:%v", c.fd, c.remoteAddr))
+			_ = c.loop.connectFailed(c, shleverror.ErrConnectTimeout)
+		}
+		return None
+	})
+	return nil
+}
+
+// 套接字可写，非阻塞connect已经有了结果，成功时调用OnConnect和OnOpen
+func (e *EventLoop) connect(c *Conn) error {
+	errno, err := unix.GetsockoptInt(c.fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && errno != 0 {
+		err = unix.Errno(errno)
+	}
+	if err != nil {
+		return e.connectFailed(c, os.NewSyscallError("connect", err))
+	}
+
+	c.connecting = false
+	if c.pooled != nil {
+		c.pooled.connected(nil)
+	}
+	if sa, err := unix.Getsockname(c.fd); err == nil {
+		if _, ok := c.remoteAddr.(*net.UnixAddr); ok {
+			c.localAddr = socket.SockaddrToUnixAddr(sa)
+		} else {
+			c.localAddr = socket.SockaddrToTCPAddr(sa)
+		}
+	}
+	// 连接建立之前写入的数据还在发送缓冲区中，继续监听写事件
+	if c.outboundBuffer.IsEmpty() {
+		if err = e.netpoll.ModRead(c.fd); err != nil {
+			return err
+		}
+	}
+	e.notifyConnect(c, nil)
+	return e.establish(c)
+}
+
+// 连接失败，通知ConnectHandler之后关闭套接字，连接建立之前写入的数据丢弃
+func (e *EventLoop) connectFailed(c *Conn, err error) error {
+	c.connecting = false
+	c.outboundBuffer.Reset()
+	if c.pooled != nil {
+		c.pooled.connected(err)
+	}
+	e.notifyConnect(c, err)
+	return e.closeConnection(c)
+}
+
+// 还没有注册到事件循环的连接失败，关闭套接字
+func (e *EventLoop) abortDial(c *Conn, err error) {
+	_ = unix.Close(c.fd)
+	c.connecting = false
+	if c.pooled != nil {
+		c.pooled.connected(err)
+		c.pooled.release(c)
+	}
+	e.notifyConnect(c, err)
+}
+
+// 调用ConnectHandler.OnConnect
+func (e *EventLoop) notifyConnect(c *Conn, err error) {
+	h, ok := e.eventHandler.(ConnectHandler)
+	if !ok {
+		return
+	}
+	start := e.busyStart()
+	h.OnConnect(c, err)
+	e.addBusy(start)
+}
+
+// 创建主动发起的连接，不属于任何监听器
+func newClientConn(fd int, e *EventLoop, sa unix.Sockaddr, remoteAddr net.Addr) *Conn {
+	return &Conn{
+		fd:         fd,
+		lnIndex:    -1,
+		remotePeer: sa,
+		remoteAddr: remoteAddr,
+		loop:       e,
+		connecting: true,
+	}
+}
@@ -0,0 +1,162 @@
+package codec
+
+import (
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+)
+
+// Codec 编解码器，在事件循环中调用，不需要考虑并发
+type Codec interface {
+	// Decode 从连接的接收缓冲区中解出一个完整的帧并移动读位置，数据不够时返回shleverror.ErrIncompletePacket，
+	// 不移动读位置。返回的切片只在本次OnTraffic中有效
+	Decode(c *shlev.Conn) ([]byte, error)
+
+	// Encode 把消息编码成帧，返回的切片可以直接写给连接
+	Encode(c *shlev.Conn, msg []byte) ([]byte, error)
+}
+
+// ResumableCodec 可选实现，数据不完整时返回已经查找过的位置，收到更多数据之后从这里继续查找，不用每次从头查找，
+// 比如分隔符编解码器。编解码器本身不保存连接的状态，查找位置由调用者保存，Handler保存在连接的上下文中
+type ResumableCodec interface {
+	Codec
+
+	// DecodeFrom 和Decode相同，scanned是上一次返回的查找位置，第一次调用或者读位置被其他地方移动之后为0。
+	// 返回shleverror.ErrIncompletePacket时next是新的查找位置，其他情况为0
+	DecodeFrom(c *shlev.Conn, scanned int) (msg []byte, next int, err error)
+}
+
+// MessageHandler 按帧处理数据的事件回调，OnMessage替代OnTraffic，每个完整的帧调用一次
+type MessageHandler interface {
+	// OnBoot 当服务器开启时触发
+	OnBoot(*shlev.Server) error
+
+	// OnShutdown 服务器关闭时调用
+	OnShutdown(*shlev.Server)
+
+	// OnConnectionClose 在连接关闭时触发
+	OnConnectionClose(*shlev.Conn, error)
+
+	// OnOpen 连接打开时触发
+	OnOpen(*shlev.Conn, error) ([]byte, shlev.HandleResult)
+
+	// OnMessage 收到一个完整的帧时触发，msg只在本次调用中有效，需要保存时要拷贝
+	OnMessage(c *shlev.Conn, msg []byte) shlev.HandleResult
+}
+
+// Handler 把MessageHandler适配成shlev.EventHandler，OnTraffic中循环解码，每个完整的帧调用一次OnMessage，
+// 解码出错时关闭连接。Handler用连接的Context保存解码状态，MessageHandler要用codec.Context和codec.SetContext
+// 保存自己的上下文，OnOpen之前连接上已有的Context（比如shlev.Server.DialContext传入的）也用codec.Context读取
+type Handler struct {
+	codec   Codec
+	handler MessageHandler
+}
+
+// NewHandler 创建适配器，handler实现了shlev.TickHandler或者shlev.DrainHandler时，返回的EventHandler也会实现并转发
+func NewHandler(codec Codec, handler MessageHandler) shlev.EventHandler {
+	h := &Handler{codec: codec, handler: handler}
+	tick, isTick := handler.(shlev.TickHandler)
+	drain, isDrain := handler.(shlev.DrainHandler)
+	switch {
+	case isTick && isDrain:
+		return &tickDrainHandler{Handler: h, TickHandler: tick, DrainHandler: drain}
+	case isTick:
+		return &tickHandler{Handler: h, TickHandler: tick}
+	case isDrain:
+		return &drainHandler{Handler: h, DrainHandler: drain}
+	}
+	return h
+}
+
+// Codec 返回使用的编解码器，发送消息时用它编码
+func (h *Handler) Codec() Codec {
+	return h.codec
+}
+
+func (h *Handler) OnBoot(s *shlev.Server) error {
+	return h.handler.OnBoot(s)
+}
+
+func (h *Handler) OnShutdown(s *shlev.Server) {
+	h.handler.OnShutdown(s)
+}
+
+func (h *Handler) OnConnectionClose(c *shlev.Conn, err error) {
+	h.handler.OnConnectionClose(c, err)
+}
+
+func (h *Handler) OnOpen(c *shlev.Conn, err error) ([]byte, shlev.HandleResult) {
+	c.SetContext(&connState{context: c.Context()})
+	return h.handler.OnOpen(c, err)
+}
+
+// OnTraffic 解出所有完整的帧，剩下不完整的数据留在接收缓冲区，等下一次收到数据再解码
+func (h *Handler) OnTraffic(c *shlev.Conn) shlev.HandleResult {
+	rc, resumable := h.codec.(ResumableCodec)
+	st, ok := c.Context().(*connState)
+	for {
+		var msg []byte
+		var err error
+		if resumable && ok {
+			msg, st.scanned, err = rc.DecodeFrom(c, st.scanned)
+		} else {
+			msg, err = h.codec.Decode(c)
+		}
+		if err == shleverror.ErrIncompletePacket {
+			return shlev.None
+		}
+		if err != nil {
+			logger.Warn("codec decode error:", err, "remote:", c.RemoteAddr())
+			return shlev.Close
+		}
+		if res := h.handler.OnMessage(c, msg); res != shlev.None {
+			return res
+		}
+	}
+}
+
+// 连接的解码状态，保存在连接的Context中，连接关闭时和连接一起释放
+type connState struct {
+	scanned int         // ResumableCodec上一次返回的查找位置
+	context interface{} // MessageHandler的上下文
+}
+
+// Context 使用Handler的连接上MessageHandler保存的上下文
+func Context(c *shlev.Conn) interface{} {
+	if st, ok := c.Context().(*connState); ok {
+		return st.context
+	}
+	return c.Context()
+}
+
+// SetContext 设置使用Handler的连接上MessageHandler的上下文，不会覆盖Handler的解码状态
+func SetContext(c *shlev.Conn, ctx interface{}) {
+	if st, ok := c.Context().(*connState); ok {
+		st.context = ctx
+		return
+	}
+	c.SetContext(ctx)
+}
+
+type tickHandler struct {
+	*Handler
+	shlev.TickHandler
+}
+
+type drainHandler struct {
+	*Handler
+	shlev.DrainHandler
+}
+
+type tickDrainHandler struct {
+	*Handler
+	shlev.TickHandler
+	shlev.DrainHandler
+}
+
+var (
+	_ shlev.TickHandler  = (*tickHandler)(nil)
+	_ shlev.DrainHandler = (*drainHandler)(nil)
+	_ shlev.TickHandler  = (*tickDrainHandler)(nil)
+	_ shlev.DrainHandler = (*tickDrainHandler)(nil)
+)
@@ -0,0 +1,364 @@
+package codec_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/codec"
+	"github.com/Senhnn/shlev/tools/logger"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type messageServer struct {
+	codec    codec.Codec
+	messages chan []byte
+}
+
+func (s *messageServer) OnBoot(*shlev.Server) error           { return nil }
+func (s *messageServer) OnShutdown(*shlev.Server)             {}
+func (s *messageServer) OnConnectionClose(*shlev.Conn, error) {}
+func (s *messageServer) OnOpen(*shlev.Conn, error) ([]byte, shlev.HandleResult) {
+	return nil, shlev.None
+}
+
+// 记录收到的消息，再编码之后发回去
+func (s *messageServer) OnMessage(c *shlev.Conn, msg []byte) shlev.HandleResult {
+	s.messages <- append([]byte(nil), msg...)
+	frame, err := s.codec.Encode(c, msg)
+	if err != nil {
+		return shlev.Close
+	}
+	_, _ = c.Write(frame)
+	return shlev.None
+}
+
+type drainMessageServer struct {
+	messageServer
+}
+
+func (s *drainMessageServer) OnDrain(*shlev.Conn) {}
+
+func startServer(t *testing.T, cd codec.Codec, h codec.MessageHandler) *shlev.Server {
+	s, err := shlev.Start(codec.NewHandler(cd, h), "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = s.Shutdown(context.Background()) })
+	return s
+}
+
+func dial(t *testing.T, s *shlev.Server) net.Conn {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+// 日志写到临时目录，运行测试不会在包目录下留下shlev_net.log
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "shlev-log")
+	if err != nil {
+		panic(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "shlev_net.log"))
+	if err != nil {
+		panic(err)
+	}
+	logger.SetOutput(f)
+	code := m.Run()
+	_ = f.Close()
+	if code == 0 {
+		_ = os.RemoveAll(dir)
+	} else {
+		fmt.Println("log:", f.Name())
+	}
+	os.Exit(code)
+}
+
+func TestNewHandler(t *testing.T) {
+	cd := codec.NewLengthFieldCodec(4)
+	if _, ok := codec.NewHandler(cd, &messageServer{}).(shlev.DrainHandler); ok {
+		t.Fatal("handler without OnDrain should not implement DrainHandler")
+	}
+	if _, ok := codec.NewHandler(cd, &drainMessageServer{}).(shlev.DrainHandler); !ok {
+		t.Fatal("OnDrain is not forwarded")
+	}
+}
+
+func TestLengthFieldCodec(t *testing.T) {
+	// 长度字段的值包括帧头，前面有一个字节的类型
+	withHeader := &codec.LengthFieldCodec{
+		ByteOrder:         binary.LittleEndian,
+		LengthFieldOffset: 1,
+		LengthFieldLength: 2,
+		LengthAdjustment:  -3,
+	}
+	cases := []struct {
+		name   string
+		codec  *codec.LengthFieldCodec
+		frames [][]byte
+		want   [][]byte
+	}{
+		{
+			name:   "uint8",
+			codec:  codec.NewLengthFieldCodec(1),
+			frames: [][]byte{{3, 'a', 'b', 'c'}, {0}, {1, 'd'}},
+			want:   [][]byte{[]byte("abc"), {}, []byte("d")},
+		},
+		{
+			name:   "uint32",
+			codec:  codec.NewLengthFieldCodec(4),
+			frames: [][]byte{{0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}, {0, 0, 0, 2, 'h', 'i'}},
+			want:   [][]byte{[]byte("hello"), []byte("hi")},
+		},
+		{
+			name:   "uint64",
+			codec:  codec.NewLengthFieldCodec(8),
+			frames: [][]byte{{0, 0, 0, 0, 0, 0, 0, 3, 'f', 'o', 'o'}},
+			want:   [][]byte{[]byte("foo")},
+		},
+		{
+			name:   "offset",
+			codec:  withHeader,
+			frames: [][]byte{{7, 5, 0, 'h', 'i'}, {8, 3, 0}},
+			want:   [][]byte{{7, 5, 0, 'h', 'i'}, {8, 3, 0}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &messageServer{codec: tc.codec, messages: make(chan []byte, len(tc.want))}
+			s := startServer(t, tc.codec, h)
+			conn := dial(t, s)
+
+			// 所有帧一起发送，再一个字节一个字节地发送，每个完整的帧都只回调一次
+			stream := bytes.Join(tc.frames, nil)
+			_, _ = conn.Write(stream)
+			for i := range stream {
+				_, _ = conn.Write(stream[i : i+1])
+				time.Sleep(time.Millisecond)
+			}
+			for round := 0; round < 2; round++ {
+				for _, want := range tc.want {
+					select {
+					case msg := <-h.messages:
+						if !bytes.Equal(msg, want) {
+							t.Fatalf("got message %v, want %v", msg, want)
+						}
+					case <-time.After(2 * time.Second):
+						t.Fatal("message is not received")
+					}
+				}
+			}
+
+			// Encode得到的帧和发过去的一样
+			echo := make([]byte, 2*len(stream))
+			if _, err := io.ReadFull(conn, echo); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(echo, append(stream, stream...)) {
+				t.Fatalf("got echo %v, want %v", echo, stream)
+			}
+		})
+	}
+}
+
+func TestLengthFieldCodecTooLarge(t *testing.T) {
+	cd := codec.NewLengthFieldCodec(2)
+	cd.MaxFrameLength = 8
+	if _, err := cd.Encode(nil, make([]byte, 7)); err == nil {
+		t.Fatal("encode should fail when the frame is too large")
+	}
+	h := &messageServer{codec: cd, messages: make(chan []byte, 1)}
+	s := startServer(t, cd, h)
+	conn := dial(t, s)
+
+	// 帧太大时关闭连接
+	_, _ = conn.Write([]byte{0, 100})
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection should be closed")
+	}
+}
+
+func TestDelimiterCodecs(t *testing.T) {
+	cases := []struct {
+		name   string
+		codec  codec.Codec
+		stream string
+		want   []string
+		echo   string
+	}{
+		{
+			name:   "line",
+			codec:  codec.NewLineBasedCodec(16, false),
+			stream: "HELO example.com\r\nNOOP\n\r\nQUIT\r\n",
+			want:   []string{"HELO example.com", "NOOP", "", "QUIT"},
+			echo:   "HELO example.com\nNOOP\n\nQUIT\n",
+		},
+		{
+			name:   "crlf",
+			codec:  codec.NewLineBasedCodec(0, true),
+			stream: "a\nb\r\n",
+			want:   []string{"a", "b"},
+			echo:   "a\r\nb\r\n",
+		},
+		{
+			name:   "delimiter",
+			codec:  codec.NewDelimiterCodec([]byte("$$"), 8),
+			stream: "foo$$$bar$$$$",
+			want:   []string{"foo", "$bar", ""},
+			echo:   "foo$$$bar$$$$",
+		},
+		{
+			// 从上一次查找到的位置继续查找时，分隔符的前半部分已经查找过
+			name:   "resume",
+			codec:  codec.NewDelimiterCodec([]byte("\r\n\r\n"), 0),
+			stream: "a\r\n\rb\r\n\r\n\r\n\r\nc\r\n\r\n",
+			want:   []string{"a\r\n\rb", "", "c"},
+			echo:   "a\r\n\rb\r\n\r\n\r\n\r\nc\r\n\r\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &messageServer{codec: tc.codec, messages: make(chan []byte, len(tc.want))}
+			s := startServer(t, tc.codec, h)
+			conn := dial(t, s)
+
+			// 一个字节一个字节地发送，分隔符被拆开也能正确解码
+			for i := range tc.stream {
+				_, _ = conn.Write([]byte(tc.stream[i : i+1]))
+				time.Sleep(time.Millisecond)
+			}
+			for _, want := range tc.want {
+				select {
+				case msg := <-h.messages:
+					if string(msg) != want {
+						t.Fatalf("got message %q, want %q", msg, want)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("message is not received")
+				}
+			}
+			echo := make([]byte, len(tc.echo))
+			if _, err := io.ReadFull(conn, echo); err != nil {
+				t.Fatal(err)
+			}
+			if string(echo) != tc.echo {
+				t.Fatalf("got echo %q, want %q", echo, tc.echo)
+			}
+		})
+	}
+}
+
+func TestLineTooLong(t *testing.T) {
+	cd := codec.NewLineBasedCodec(4, false)
+	h := &messageServer{codec: cd, messages: make(chan []byte, 1)}
+	s := startServer(t, cd, h)
+
+	// 刚好是最大长度的行可以解码
+	conn := dial(t, s)
+	_, _ = conn.Write([]byte("abcd\r\n"))
+	if msg := <-h.messages; string(msg) != "abcd" {
+		t.Fatalf("got message %q", msg)
+	}
+
+	// 没有换行符的数据超过最大长度时关闭连接
+	conn = dial(t, s)
+	_, _ = conn.Write([]byte("abcdefg"))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection should be closed")
+	}
+}
+
+// 在OnOpen中保存上下文，每条消息之后累加
+type contextServer struct {
+	messageServer
+}
+
+func (s *contextServer) OnOpen(c *shlev.Conn, _ error) ([]byte, shlev.HandleResult) {
+	codec.SetContext(c, 0)
+	return nil, shlev.None
+}
+
+func (s *contextServer) OnMessage(c *shlev.Conn, msg []byte) shlev.HandleResult {
+	n := codec.Context(c).(int) + 1
+	codec.SetContext(c, n)
+	s.messages <- []byte(string(msg) + string(rune('0'+n)))
+	return shlev.None
+}
+
+func TestHandlerContext(t *testing.T) {
+	var _ codec.ResumableCodec = codec.NewLineBasedCodec(0, false)
+	var _ codec.ResumableCodec = codec.NewDelimiterCodec([]byte("$"), 0)
+
+	cd := codec.NewLineBasedCodec(0, false)
+	h := &contextServer{messageServer{codec: cd, messages: make(chan []byte, 2)}}
+	s := startServer(t, cd, h)
+	conn := dial(t, s)
+
+	// MessageHandler的上下文不会覆盖Handler保存的查找位置
+	for _, b := range "ab\ncd\n" {
+		_, _ = conn.Write([]byte{byte(b)})
+		time.Sleep(time.Millisecond)
+	}
+	for _, want := range []string{"ab1", "cd2"} {
+		select {
+		case msg := <-h.messages:
+			if string(msg) != want {
+				t.Fatalf("got message %q, want %q", msg, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message is not received")
+		}
+	}
+}
+
+// 主动发起的连接，OnOpen时发一行，收到的每个回复都带上DialContext传入的上下文
+type dialMessageClient struct {
+	messageServer
+}
+
+func (s *dialMessageClient) OnOpen(c *shlev.Conn, _ error) ([]byte, shlev.HandleResult) {
+	return []byte(fmt.Sprintf("open %v\n", codec.Context(c))), shlev.None
+}
+
+func (s *dialMessageClient) OnMessage(c *shlev.Conn, msg []byte) shlev.HandleResult {
+	s.messages <- []byte(fmt.Sprintf("%s %v", msg, codec.Context(c)))
+	return shlev.None
+}
+
+func TestDialContext(t *testing.T) {
+	cd := codec.NewLineBasedCodec(0, false)
+	s := startServer(t, cd, &messageServer{codec: cd, messages: make(chan []byte, 1)})
+
+	h := &dialMessageClient{messageServer{codec: cd, messages: make(chan []byte, 1)}}
+	cli, err := shlev.NewClient(codec.NewHandler(cd, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	t.Cleanup(func() { _, _ = cli.Shutdown(closed) })
+
+	// Handler在OnOpen中把DialContext传入的上下文移到自己的连接状态里，用codec.Context读取
+	if _, err = cli.DialContext("tcp", s.Addr().String(), "upstream"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-h.messages:
+		if want := "open upstream upstream"; string(msg) != want {
+			t.Fatalf("got message %q, want %q", msg, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message is not received")
+	}
+}
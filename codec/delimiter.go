@@ -0,0 +1,150 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/tools/shleverror"
+)
+
+// DelimiterCodec 以分隔符结尾的帧，分隔符可以是多个字节，解码得到的消息不包括分隔符
+type DelimiterCodec struct {
+	// Delimiter 帧的分隔符
+	Delimiter []byte
+
+	// MaxLength 消息的最大长度，不包括分隔符，超过时返回shleverror.ErrFrameTooLarge，0表示DefaultMaxFrameLength
+	MaxLength int
+}
+
+// NewDelimiterCodec 创建分隔符编解码器，maxLength为0表示DefaultMaxFrameLength
+func NewDelimiterCodec(delimiter []byte, maxLength int) *DelimiterCodec {
+	return &DelimiterCodec{Delimiter: delimiter, MaxLength: maxLength}
+}
+
+// Decode 解出分隔符之前的消息，并丢弃分隔符
+func (cd *DelimiterCodec) Decode(c *shlev.Conn) ([]byte, error) {
+	msg, _, err := cd.DecodeFrom(c, 0)
+	return msg, err
+}
+
+// DecodeFrom 和Decode相同，从上一次查找到的位置继续查找分隔符，参看ResumableCodec
+func (cd *DelimiterCodec) DecodeFrom(c *shlev.Conn, scanned int) ([]byte, int, error) {
+	if len(cd.Delimiter) == 0 {
+		return nil, 0, shleverror.ErrEmptyDelimiter
+	}
+	return scanDelimiter(c, scanned, cd.Delimiter, maxLength(cd.MaxLength))
+}
+
+// Encode 在消息后面加上分隔符，消息中不能包含分隔符
+func (cd *DelimiterCodec) Encode(_ *shlev.Conn, msg []byte) ([]byte, error) {
+	if len(cd.Delimiter) == 0 {
+		return nil, shleverror.ErrEmptyDelimiter
+	}
+	if len(msg) > maxLength(cd.MaxLength) {
+		return nil, shleverror.ErrFrameTooLarge
+	}
+	frame := make([]byte, 0, len(msg)+len(cd.Delimiter))
+	frame = append(frame, msg...)
+	return append(frame, cd.Delimiter...), nil
+}
+
+// LineBasedCodec 按行分帧，行以\n或者\r\n结尾，解码得到的消息不包括行尾
+type LineBasedCodec struct {
+	// MaxLength 一行的最大长度，不包括行尾，超过时返回shleverror.ErrFrameTooLarge，0表示DefaultMaxFrameLength
+	MaxLength int
+
+	// CRLF 编码时用\r\n结尾，否则用\n
+	CRLF bool
+}
+
+// NewLineBasedCodec 创建按行分帧的编解码器，maxLength为0表示DefaultMaxFrameLength
+func NewLineBasedCodec(maxLength int, crlf bool) *LineBasedCodec {
+	return &LineBasedCodec{MaxLength: maxLength, CRLF: crlf}
+}
+
+var (
+	lf   = []byte("\n")
+	crlf = []byte("\r\n")
+)
+
+// Decode 解出一行，去掉行尾的\n或者\r\n
+func (cd *LineBasedCodec) Decode(c *shlev.Conn) ([]byte, error) {
+	line, _, err := cd.DecodeFrom(c, 0)
+	return line, err
+}
+
+// DecodeFrom 和Decode相同，从上一次查找到的位置继续查找行尾，参看ResumableCodec
+func (cd *LineBasedCodec) DecodeFrom(c *shlev.Conn, scanned int) ([]byte, int, error) {
+	// 多留一个字节给\r
+	line, next, err := scanDelimiter(c, scanned, lf, maxLength(cd.MaxLength)+1)
+	if err != nil {
+		return nil, next, err
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	if len(line) > maxLength(cd.MaxLength) {
+		return nil, 0, shleverror.ErrFrameTooLarge
+	}
+	return line, 0, nil
+}
+
+// Encode 在消息后面加上行尾，消息中不能包含\n
+func (cd *LineBasedCodec) Encode(_ *shlev.Conn, msg []byte) ([]byte, error) {
+	if len(msg) > maxLength(cd.MaxLength) {
+		return nil, shleverror.ErrFrameTooLarge
+	}
+	eol := lf
+	if cd.CRLF {
+		eol = crlf
+	}
+	frame := make([]byte, 0, len(msg)+len(eol))
+	frame = append(frame, msg...)
+	return append(frame, eol...), nil
+}
+
+func maxLength(n int) int {
+	if n <= 0 {
+		return DefaultMaxFrameLength
+	}
+	return n
+}
+
+// 在接收缓冲区中查找分隔符，只查找前maxLen+len(delimiter)个字节，找到之后移动读位置到分隔符之后，
+// 返回分隔符之前的数据。scanned是上一次没有找到分隔符时已经查找过的字节数，从这里继续查找，
+// 没有找到时返回新的查找位置
+func scanDelimiter(c *shlev.Conn, scanned int, delimiter []byte, maxLen int) ([]byte, int, error) {
+	limit := maxLen + len(delimiter)
+	buffered := c.InboundBuffered()
+	if buffered < limit {
+		limit = buffered
+	}
+	if limit == 0 {
+		return nil, 0, shleverror.ErrIncompletePacket
+	}
+	// 分隔符可能跨越上一次的末尾，所以往回退len(delimiter)-1个字节
+	from := 0
+	if scanned <= limit {
+		from = scanned - len(delimiter) + 1
+		if from < 0 {
+			from = 0
+		}
+	}
+	buf, err := c.PeekAt(from, limit-from)
+	if err != nil {
+		return nil, 0, err
+	}
+	i := bytes.Index(buf, delimiter)
+	if i < 0 {
+		// 已经收到了足够多的数据，还是没有找到分隔符
+		if limit == maxLen+len(delimiter) {
+			return nil, 0, shleverror.ErrFrameTooLarge
+		}
+		return nil, limit, shleverror.ErrIncompletePacket
+	}
+	i += from
+	frame, err := c.Next(i + len(delimiter))
+	if err != nil {
+		return nil, 0, err
+	}
+	return frame[:i], 0, nil
+}
@@ -0,0 +1,165 @@
+package codec
+
+import (
+	"encoding/binary"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"math"
+)
+
+// DefaultMaxFrameLength 默认的最大帧长度，包括帧头
+const DefaultMaxFrameLength = 4 * 1024 * 1024 // 4MB
+
+// LengthFieldCodec 基于长度字段的编解码器，帧的格式为：
+//
+//	| 前置字段（LengthFieldOffset个字节）| 长度字段（LengthFieldLength个字节）| 后续数据 |
+//
+// 后续数据的长度等于长度字段的值加上LengthAdjustment，比如长度字段的值包括了帧头时，LengthAdjustment为帧头长度的相反数
+type LengthFieldCodec struct {
+	// ByteOrder 长度字段的字节序，nil表示大端
+	ByteOrder binary.ByteOrder
+
+	// LengthFieldOffset 长度字段在帧中的偏移
+	LengthFieldOffset int
+
+	// LengthFieldLength 长度字段的字节数，只支持1、2、4、8
+	LengthFieldLength int
+
+	// LengthAdjustment 长度字段的值加上它等于长度字段之后的数据长度
+	LengthAdjustment int
+
+	// InitialBytesToStrip 解码之后去掉帧开头的字节数，等于LengthFieldOffset+LengthFieldLength时只返回后续数据
+	InitialBytesToStrip int
+
+	// MaxFrameLength 最大帧长度，包括帧头，超过时返回shleverror.ErrFrameTooLarge，0表示DefaultMaxFrameLength
+	MaxFrameLength int
+}
+
+// NewLengthFieldCodec 创建大端、长度字段在开头、长度字段的值等于消息长度的编解码器，解码时只返回消息
+func NewLengthFieldCodec(lengthFieldLength int) *LengthFieldCodec {
+	return &LengthFieldCodec{
+		ByteOrder:           binary.BigEndian,
+		LengthFieldLength:   lengthFieldLength,
+		InitialBytesToStrip: lengthFieldLength,
+	}
+}
+
+func (cd *LengthFieldCodec) byteOrder() binary.ByteOrder {
+	if cd.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return cd.ByteOrder
+}
+
+func (cd *LengthFieldCodec) maxFrameLength() int {
+	return maxLength(cd.MaxFrameLength)
+}
+
+// 读出长度字段的值
+func (cd *LengthFieldCodec) readLength(b []byte) (uint64, error) {
+	order := cd.byteOrder()
+	switch cd.LengthFieldLength {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(order.Uint16(b)), nil
+	case 4:
+		return uint64(order.Uint32(b)), nil
+	case 8:
+		return order.Uint64(b), nil
+	}
+	return 0, shleverror.ErrUnsupportedLengthField
+}
+
+// 写入长度字段，值超过长度字段能表示的范围时返回shleverror.ErrFrameTooLarge
+func (cd *LengthFieldCodec) putLength(b []byte, n uint64) error {
+	order := cd.byteOrder()
+	switch cd.LengthFieldLength {
+	case 1:
+		if n > math.MaxUint8 {
+			return shleverror.ErrFrameTooLarge
+		}
+		b[0] = byte(n)
+	case 2:
+		if n > math.MaxUint16 {
+			return shleverror.ErrFrameTooLarge
+		}
+		order.PutUint16(b, uint16(n))
+	case 4:
+		if n > math.MaxUint32 {
+			return shleverror.ErrFrameTooLarge
+		}
+		order.PutUint32(b, uint32(n))
+	case 8:
+		order.PutUint64(b, n)
+	default:
+		return shleverror.ErrUnsupportedLengthField
+	}
+	return nil
+}
+
+// Decode 解出一个完整的帧，去掉开头的InitialBytesToStrip个字节
+func (cd *LengthFieldCodec) Decode(c *shlev.Conn) ([]byte, error) {
+	headerLen := cd.LengthFieldOffset + cd.LengthFieldLength
+	header, err := c.Peek(headerLen)
+	if err != nil {
+		return nil, shleverror.ErrIncompletePacket
+	}
+	n, err := cd.readLength(header[cd.LengthFieldOffset:])
+	if err != nil {
+		return nil, err
+	}
+
+	maxLen := cd.maxFrameLength()
+	if n > uint64(maxLen) {
+		return nil, shleverror.ErrFrameTooLarge
+	}
+	frameLen := headerLen + int(n) + cd.LengthAdjustment
+	if frameLen < headerLen || frameLen < cd.InitialBytesToStrip {
+		return nil, shleverror.ErrInvalidFrameLength
+	}
+	if frameLen > maxLen {
+		return nil, shleverror.ErrFrameTooLarge
+	}
+	if c.InboundBuffered() < frameLen {
+		return nil, shleverror.ErrIncompletePacket
+	}
+
+	frame, err := c.Next(frameLen)
+	if err != nil {
+		return nil, err
+	}
+	return frame[cd.InitialBytesToStrip:], nil
+}
+
+// Encode 是Decode的逆过程，msg是解码得到的消息：InitialBytesToStrip为0时msg是包括帧头的完整帧，只填写其中的长度字段；
+// InitialBytesToStrip等于帧头长度时在msg前面加上帧头，长度字段之前的字节填0；其他情况不支持编码
+func (cd *LengthFieldCodec) Encode(_ *shlev.Conn, msg []byte) ([]byte, error) {
+	headerLen := cd.LengthFieldOffset + cd.LengthFieldLength
+	var frame []byte
+	switch cd.InitialBytesToStrip {
+	case 0:
+		if len(msg) < headerLen {
+			return nil, shleverror.ErrInvalidFrameLength
+		}
+		frame = make([]byte, len(msg))
+		copy(frame, msg)
+	case headerLen:
+		frame = make([]byte, headerLen+len(msg))
+		copy(frame[headerLen:], msg)
+	default:
+		return nil, shleverror.ErrUnsupportedEncode
+	}
+	if len(frame) > cd.maxFrameLength() {
+		return nil, shleverror.ErrFrameTooLarge
+	}
+
+	n := len(frame) - headerLen - cd.LengthAdjustment
+	if n < 0 {
+		return nil, shleverror.ErrInvalidFrameLength
+	}
+	if err := cd.putLength(frame[cd.LengthFieldOffset:], uint64(n)); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
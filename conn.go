@@ -2,23 +2,43 @@ package shlev
 
 import (
 	"bytes"
+	gio "github.com/Senhnn/shlev/internal/io"
 	"github.com/Senhnn/shlev/internal/netpoll"
+	"github.com/Senhnn/shlev/tools/linkedbuffer"
+	"github.com/Senhnn/shlev/tools/ringbuffer"
+	"github.com/Senhnn/shlev/tools/shleverror"
 	"golang.org/x/sys/unix"
+	"io"
 	"net"
+	"os"
+	"sync"
 )
 
 // Conn 封装套接字，抽象连接
 type Conn struct {
-	fd         int           // 文件描述符
-	lnIndex    int           // 监听器的索引
-	context    interface{}   // 用户定义的上下文
-	remotePeer unix.Sockaddr // 远端套接字地址
-	localAddr  net.Addr      // 本地地址
-	remoteAddr net.Addr      // 远端地址
-	loop       *EventLoop    // 所属的事件循环
-	recvBuffer *bytes.Buffer // 对端发送过来，未处理的数据
-	sendBuffer *bytes.Buffer // 需要发送给对端的数据
-	opened     bool          // 连接是否打开
+	fd             int                           // 文件描述符
+	lnIndex        int                           // 监听器的索引，主动发起的连接为-1
+	context        interface{}                   // 用户定义的上下文
+	remotePeer     unix.Sockaddr                 // 远端套接字地址
+	localAddr      net.Addr                      // 本地地址
+	remoteAddr     net.Addr                      // 远端地址
+	loop           *EventLoop                    // 所属的事件循环，迁移时在mu的保护下修改
+	buffer         []byte                        // 本次从套接字读到的数据，指向事件循环的读缓冲区，只在OnTraffic中有效
+	inboundBuffer  ringbuffer.ElasticRingBuffer  // 对端发送过来，上一次OnTraffic没有处理完的数据
+	scratch        []byte                        // Peek拷贝不连续的数据时使用，OnTraffic返回之后重用
+	outboundBuffer linkedbuffer.LinkedListBuffer // 需要发送给对端的数据
+	opened         bool                          // 连接是否打开
+	closing        bool                          // 调用了Close，发送缓冲区的数据发送完之后关闭
+	isDatagram     bool                          // 是否是UDP连接，UDP连接只代表一个数据报的对端
+	mu             sync.Mutex                    // 保护loop、migrating和pending，异步任务根据loop选择事件循环
+	migrating      bool                          // 正在迁移到其他事件循环
+	pending        []connTask                    // 迁移期间暂存的异步任务
+	awaitingProxy  bool                          // 还没有收到PROXY协议头，收到之前不调用OnOpen
+	proxyTLVs      []ProxyTLV                    // PROXY协议v2头部中的扩展字段
+	tls            *tlsTransport                 // TLS传输层，没有开启TLS时为nil
+	notified       bool                          // 已经调用了OnOpen，关闭时才调用OnConnectionClose
+	connecting     bool                          // 主动发起的连接还没有建立，写入的数据先存入发送缓冲区
+	pooled         *pooledConn                   // 连接池中的连接，不属于连接池时为nil
 }
 
 func (c *Conn) Context() interface{}       { return c.context }
@@ -26,82 +46,375 @@ func (c *Conn) SetContext(ctx interface{}) { c.context = ctx }
 func (c *Conn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *Conn) RemoteAddr() net.Addr       { return c.remoteAddr }
 
+// EventLoop 连接当前所属的事件循环，可以在任意goroutine中调用
+func (c *Conn) EventLoop() *EventLoop {
+	return c.currentLoop()
+}
+
 // 释放tcp连接
 func (c *Conn) releaseTCP() {
 	c.opened = false
+	c.closing = false
+	c.connecting = false
 	c.remotePeer = nil
 	c.context = nil
 	c.localAddr = nil
 	c.remoteAddr = nil
-	c.recvBuffer = nil
-	c.sendBuffer = nil
+	c.proxyTLVs = nil
+	c.buffer = nil
+	c.scratch = nil
+	c.inboundBuffer.Done()
+	c.outboundBuffer.Reset()
 }
 
 // 连接打开时，发送buf给对端
 func (c *Conn) open(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if c.tls != nil {
+		_, err := c.tls.write(buf)
+		return err
+	}
+	// 主动发起的连接在建立之前写入的数据排在前面
+	if !c.outboundBuffer.IsEmpty() {
+		c.outboundBuffer.PushBack(buf)
+		return nil
+	}
 	n, err := unix.Write(c.fd, buf)
+	if n > 0 {
+		c.loop.addBytesOut(n)
+	}
 	// 非阻塞套接字发送缓冲区满时，返回EAGAIN错误，此时将需要发送的信息存入buffer中
 	if err == unix.EAGAIN {
-		c.sendBuffer.Write(buf)
+		c.outboundBuffer.PushBack(buf)
 		return nil
 	}
 
 	if err == nil && n < len(buf) {
-		c.sendBuffer.Write(buf[n:])
+		c.outboundBuffer.PushBack(buf[n:])
 	}
 	return err
 }
 
-// 读数据
+// OnTraffic处理完之后，把没有处理的数据存入接收缓冲区，并归还空的缓冲区
+func (c *Conn) saveInbound() {
+	if len(c.buffer) > 0 {
+		_, _ = c.inboundBuffer.Write(c.buffer)
+	}
+	c.buffer = nil
+	c.scratch = c.scratch[:0]
+	c.inboundBuffer.Release()
+}
+
+// Read 读数据，会移动读位置
 func (c *Conn) Read(p []byte) (n int, err error) {
-	return c.recvBuffer.Read(p)
+	if c.InboundBuffered() == 0 {
+		return 0, io.EOF
+	}
+	if !c.inboundBuffer.IsEmpty() {
+		n, _ = c.inboundBuffer.Read(p)
+	}
+	m := copy(p[n:], c.buffer)
+	c.buffer = c.buffer[m:]
+	return n + m, nil
+}
+
+// Peek 返回接收到的前n个字节，但不移动读位置，n<0表示全部数据，n为0时返回空切片，数据不足n个字节时返回io.ErrShortBuffer。
+// 数据是连续的时候不拷贝，否则拷贝到连接自己的临时缓冲区中。返回的切片在本次OnTraffic返回之前有效，
+// 之后的Peek、Next不会覆盖，不能在其他goroutine中使用
+func (c *Conn) Peek(n int) ([]byte, error) {
+	return c.PeekAt(0, n)
 }
 
-// 写数据
+// PeekAt 跳过前off个字节，返回之后的n个字节，不移动读位置，n<0表示off之后的全部数据，数据不足off+n个字节时返回io.ErrShortBuffer。
+// 只拷贝[off, off+n)这一段，在已经检查过的数据之后继续查找时使用。返回的切片和Peek一样在本次OnTraffic返回之前有效
+func (c *Conn) PeekAt(off, n int) ([]byte, error) {
+	buffered := c.InboundBuffered()
+	if off < 0 || off > buffered {
+		return nil, io.ErrShortBuffer
+	}
+	if n < 0 {
+		n = buffered - off
+	} else if n > buffered-off {
+		return nil, io.ErrShortBuffer
+	}
+	if n == 0 {
+		return []byte{}, nil
+	}
+
+	// 数据分成三段：环形缓冲区的head、tail和本次读到的数据
+	head, tail := c.inboundBuffer.Peek(-1)
+	segs := [3][]byte{head, tail, c.buffer}
+	// 跨越多段时拷贝到连续的内存中。临时缓冲区只追加，容量不够时重新分配，之前返回的切片仍然指向原来的内存
+	start := len(c.scratch)
+	for _, seg := range segs {
+		if off >= len(seg) {
+			off -= len(seg)
+			continue
+		}
+		seg = seg[off:]
+		off = 0
+		if len(c.scratch) == start && len(seg) >= n {
+			return seg[:n:n], nil
+		}
+		if m := n - (len(c.scratch) - start); len(seg) > m {
+			seg = seg[:m]
+		}
+		c.scratch = append(c.scratch, seg...)
+		if len(c.scratch)-start == n {
+			break
+		}
+	}
+	return c.scratch[start:len(c.scratch):len(c.scratch)], nil
+}
+
+// Next 返回接收到的前n个字节，并移动读位置，n<0表示全部数据，n为0时返回空切片并且不移动读位置，
+// 数据不足n个字节时返回io.ErrShortBuffer。返回的切片和Peek一样在本次OnTraffic返回之前有效
+func (c *Conn) Next(n int) ([]byte, error) {
+	buf, err := c.Peek(n)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.Discard(len(buf))
+	return buf, err
+}
+
+// Discard 丢弃接收到的前n个字节，n<0表示全部丢弃，n为0时什么也不做，返回实际丢弃的字节数
+func (c *Conn) Discard(n int) (int, error) {
+	buffered := c.InboundBuffered()
+	if n < 0 || n > buffered {
+		n = buffered
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	m := c.inboundBuffer.Buffered()
+	if n <= m {
+		return c.inboundBuffer.Discard(n)
+	}
+	_, _ = c.inboundBuffer.Discard(m)
+	c.buffer = c.buffer[n-m:]
+	return n, nil
+}
+
+// InboundBuffered 接收到但还没有处理的字节数
+func (c *Conn) InboundBuffered() int {
+	return c.inboundBuffer.Buffered() + len(c.buffer)
+}
+
+// OutboundBuffered 等待发送给对端的字节数
+func (c *Conn) OutboundBuffered() int {
+	return c.outboundBuffer.Buffered()
+}
+
+// Write 写数据，TLS连接写入的是明文，加密之后发送
 func (c *Conn) Write(data []byte) (n int, err error) {
+	if c.isDatagram {
+		return c.sendTo(data)
+	}
+	if c.tls != nil {
+		return c.tls.write(data)
+	}
+	return c.write(data)
+}
+
+// 把数据写给套接字，写不完的部分存入发送缓冲区
+func (c *Conn) write(data []byte) (n int, err error) {
 	n = len(data)
 
 	// 连接发送缓冲区不为0时，说明此时套接字的发送缓冲区已经满了，没有必要向套接字写。
-	if c.sendBuffer.Len() != 0 {
-		c.sendBuffer.Write(data)
+	// 连接还没有建立时，等建立之后再发送
+	if !c.outboundBuffer.IsEmpty() || c.connecting {
+		c.outboundBuffer.PushBack(data)
 		return n, nil
 	}
 
 	var send int
 	if send, err = unix.Write(c.fd, data); err != nil {
-		// 写入错误，释放内存，关闭连接
-		return -1, c.loop.closeConnection(c)
+		if err != unix.EAGAIN {
+			// 写入错误，释放内存，关闭连接
+			_ = c.loop.closeConnection(c)
+			return -1, os.NewSyscallError("write", err)
+		}
+		// 套接字发送缓冲区已满，全部写入连接的发送缓冲区
+		send, err = 0, nil
 	}
+	c.loop.addBytesOut(send)
 
 	// 当套接字写缓冲区写满时，写入连接的发送缓冲区
 	if send < n {
-		c.sendBuffer.Write(data[send:])
+		c.outboundBuffer.PushBack(data[send:])
 		// 监听写事件
 		err = c.loop.netpoll.ModReadWrite(c.fd)
 	}
 	return n, err
 }
 
-// TODO AsyncWrite
+// Writev 一次writev系统调用写入多段数据，没有写完的部分拷贝到发送缓冲区，
+// 适合发送头部+负载这样的分段数据，避免拼接拷贝和多次系统调用
+func (c *Conn) Writev(bs [][]byte) (n int, err error) {
+	if c.isDatagram {
+		return c.sendTo(bytes.Join(bs, nil))
+	}
+	if c.tls != nil {
+		return c.tls.write(bytes.Join(bs, nil))
+	}
+	for _, b := range bs {
+		n += len(b)
+	}
+
+	// 发送缓冲区不为空或者连接还没有建立时，数据只能排在后面
+	if !c.outboundBuffer.IsEmpty() || c.connecting {
+		for _, b := range bs {
+			c.outboundBuffer.PushBack(b)
+		}
+		return n, nil
+	}
+
+	remaining := bs
+	for len(remaining) > 0 {
+		var sent int
+		if sent, err = gio.Writev(c.fd, remaining); err != nil {
+			if err != unix.EAGAIN {
+				_ = c.loop.closeConnection(c)
+				return -1, os.NewSyscallError("writev", err)
+			}
+			sent, err = 0, nil
+		}
+		c.loop.addBytesOut(sent)
+		// 跳过已经写完的切片
+		iovCount := len(remaining)
+		if iovCount > gio.IovMax {
+			iovCount = gio.IovMax
+		}
+		for sent > 0 && sent >= len(remaining[0]) {
+			sent -= len(remaining[0])
+			remaining = remaining[1:]
+			iovCount--
+		}
+		// 一次没有写完，套接字发送缓冲区已满
+		if iovCount > 0 {
+			for i, b := range remaining {
+				if i == 0 {
+					b = b[sent:]
+				}
+				c.outboundBuffer.PushBack(b)
+			}
+			if !c.outboundBuffer.IsEmpty() {
+				err = c.loop.netpoll.ModReadWrite(c.fd)
+			}
+			break
+		}
+	}
+	return n, err
+}
+
+// AsyncCallback 异步写完成之后在事件循环中执行的回调，err不为nil表示写入失败
+type AsyncCallback func(c *Conn, err error) error
+
+// 异步写任务的参数
+type asyncWriteHook struct {
+	callback AsyncCallback
+	data     [][]byte
+}
+
+// AsyncWrite 可以在其他goroutine中调用，数据会放到所属的事件循环中写入，同一个连接的异步写按调用顺序执行。
+// 写入完成之前不要修改buf，callback可以为nil
+func (c *Conn) AsyncWrite(buf []byte, callback AsyncCallback) error {
+	return c.dispatch(c.asyncWrite, &asyncWriteHook{callback: callback, data: [][]byte{buf}})
+}
+
+// AsyncWritev 和AsyncWrite一样，按顺序写入多段数据
+func (c *Conn) AsyncWritev(bs [][]byte, callback AsyncCallback) error {
+	return c.dispatch(c.asyncWrite, &asyncWriteHook{callback: callback, data: bs})
+}
+
+// 在事件循环中执行异步写
+func (c *Conn) asyncWrite(itf interface{}) (err error) {
+	hook := itf.(*asyncWriteHook)
+	// 连接已经关闭，fd可能已经被新连接复用，不能再写；UDP连接不需要检查
+	if !c.isDatagram && !c.loop.ownsConn(c) {
+		if hook.callback != nil {
+			return hook.callback(c, shleverror.ErrConnectionClosed)
+		}
+		return nil
+	}
+
+	if len(hook.data) == 1 {
+		_, err = c.Write(hook.data[0])
+	} else {
+		_, err = c.Writev(hook.data)
+	}
+	if hook.callback != nil {
+		return hook.callback(c, err)
+	}
+	return nil
+}
+
+// Close 关闭连接，可以在其他goroutine中调用，在所属的事件循环中执行，之前的异步写会先执行，
+// 发送缓冲区还有数据时等数据发送完再关闭，UDP连接不需要关闭
+func (c *Conn) Close() error {
+	if c.isDatagram {
+		return nil
+	}
+	return c.dispatch(c.asyncClose, nil)
+}
+
+// 在事件循环中关闭连接
+func (c *Conn) asyncClose(_ interface{}) error {
+	if !c.loop.ownsConn(c) {
+		return nil
+	}
+	if !c.outboundBuffer.IsEmpty() {
+		c.closing = true
+		return nil
+	}
+	return c.loop.closeConnection(c)
+}
 
 // 创建新的tcp连接
-func newTCPConn(fd int, e *EventLoop, sa unix.Sockaddr, localAddr, remoteAddr net.Addr) (c *Conn) {
+func newTCPConn(fd int, e *EventLoop, ln *Listener, sa unix.Sockaddr, remoteAddr net.Addr) (c *Conn) {
 	c = &Conn{
 		fd:         fd,
-		lnIndex:    0,
+		lnIndex:    ln.index,
 		context:    nil,
 		remotePeer: sa,
-		localAddr:  localAddr,
+		localAddr:  ln.Addr,
 		remoteAddr: remoteAddr,
 		loop:       e,
-		recvBuffer: bytes.NewBuffer(make([]byte, e.server.opts.SocketRecvBuffer)),
-		sendBuffer: bytes.NewBuffer(make([]byte, e.server.opts.SocketSendBuffer)),
 		opened:     false,
 	}
-	c.sendBuffer = bytes.NewBuffer(make([]byte, 0))
+	c.awaitingProxy = e.proxyProtocol(ln)
+	if config := e.tlsConfig(ln); config != nil {
+		c.tls = newTLSTransport(c, config)
+	}
 	return
 }
 
+// 创建UDP连接，fd为监听套接字
+func newUDPConn(e *EventLoop, ln *Listener, sa unix.Sockaddr, remoteAddr net.Addr) *Conn {
+	return &Conn{
+		fd:         ln.Fd,
+		lnIndex:    ln.index,
+		remotePeer: sa,
+		localAddr:  ln.Addr,
+		remoteAddr: remoteAddr,
+		loop:       e,
+		opened:     true,
+		isDatagram: true,
+	}
+}
+
+// 给UDP对端发送一个数据报
+func (c *Conn) sendTo(data []byte) (int, error) {
+	if err := unix.Sendto(c.fd, data, 0, c.remotePeer); err != nil {
+		return -1, os.NewSyscallError("sendto", err)
+	}
+	c.loop.addBytesOut(len(data))
+	return len(data), nil
+}
+
 func (c *Conn) handleEvents(_ int, ev uint32) error {
 	// Don't change the ordering of processing EPOLLOUT | EPOLLRDHUP / EPOLLIN unless you're 100%
 	// sure what you're doing!
@@ -114,7 +427,7 @@ func (c *Conn) handleEvents(_ int, ev uint32) error {
 	// In either case write() should take care of it properly:
 	// 1) writing data back,
 	// 2) closing the connection.
-	if ev&netpoll.OutEvents != 0 && !(c.sendBuffer.Len() == 0) {
+	if ev&netpoll.OutEvents != 0 && !c.outboundBuffer.IsEmpty() {
 		if err := c.loop.write(c); err != nil {
 			return err
 		}
@@ -1,31 +1,74 @@
 package shlev
 
 import (
-	"bytes"
-	"context"
 	"errors"
 	"fmt"
+	gio "github.com/Senhnn/shlev/internal/io"
 	"github.com/Senhnn/shlev/internal/netpoll"
 	"github.com/Senhnn/shlev/internal/socket"
 	"github.com/Senhnn/shlev/tools/logger"
 	"github.com/Senhnn/shlev/tools/shleverror"
+	"github.com/Senhnn/shlev/tools/timewheel"
 	"golang.org/x/sys/unix"
 	"os"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type EventLoop struct {
-	ln               *Listener // 监听的套接字
-	index            int       // 该指针[]*EventLoop中的索引，事件循环列表中的索引
-	cache            bytes.Buffer
-	server           *Server           // 所属的server
-	buffer           []byte            // 缓冲区
-	tcpConnectionMap map[int]*Conn     // key：fd， value：Conn
-	connCount        int32             // 活跃连接数，连接需要时打开状态（opened=true）
-	netpoll          netpoll.Netpoller // 轮询（epoll）
-	eventHandler     EventHandler      // 用户定义的事件、连接钩子回调
+	bytesIn          uint64                 // 读到的字节数，放在开头保证64位对齐
+	bytesOut         uint64                 // 写出的字节数
+	busyNanos        uint64                 // 执行回调花费的时间
+	trackBusy        bool                   // 是否统计回调花费的时间，参看Options.BusyTimeStats
+	listeners        map[int]*Listener      // 监听的套接字，key：监听套接字fd，从reactor为空
+	index            int                    // 该指针[]*EventLoop中的索引，事件循环列表中的索引
+	server           *Server                // 所属的server
+	buffer           []byte                 // 缓冲区
+	tcpConnectionMap map[int]*Conn          // key：fd， value：Conn
+	connCount        int32                  // 活跃连接数，连接需要时打开状态（opened=true）
+	netpoll          netpoll.Netpoller      // 轮询（epoll）
+	eventHandler     EventHandler           // 用户定义的事件、连接钩子回调
+	timers           *timewheel.TimingWheel // 定时器，只在事件循环中访问
+	draining         bool                   // 服务器正在排空连接，不再接收新连接
+	exiting          bool                   // 事件循环正在退出，关闭剩下的连接时不再发起新连接
+	pools            map[poolKey]*poolShard // 连接池在这个事件循环上的分片，只在事件循环中访问
+	window           loadWindow             // 负载统计的滑动窗口
+	incomingMu       sync.Mutex             // 保护incoming和stopped，其他事件循环交接连接时使用
+	incoming         map[*Conn]struct{}     // 其他事件循环交过来、还没有接管的连接
+	stopped          bool                   // 事件循环已经退出，不再接收交过来的连接
+}
+
+// Index 事件循环在负载均衡器中的索引，主响应器为-1
+func (e *EventLoop) Index() int {
+	return e.index
+}
+
+// ConnCount 当前打开的连接数，可以在其他goroutine中调用
+func (e *EventLoop) ConnCount() int32 {
+	return e.loadConn()
+}
+
+// PendingTasks 任务队列中还没有执行的任务数量，比如没有执行的异步写，可以在其他goroutine中调用
+func (e *EventLoop) PendingTasks() int {
+	return e.netpoll.PendingTasks()
+}
+
+// BytesIn 累计从套接字读到的字节数，可以在其他goroutine中调用
+func (e *EventLoop) BytesIn() uint64 {
+	return atomic.LoadUint64(&e.bytesIn)
+}
+
+// BytesOut 累计写到套接字的字节数，可以在其他goroutine中调用
+func (e *EventLoop) BytesOut() uint64 {
+	return atomic.LoadUint64(&e.bytesOut)
+}
+
+func (e *EventLoop) addBytesOut(n int) {
+	if n > 0 {
+		atomic.AddUint64(&e.bytesOut, uint64(n))
+	}
 }
 
 func (e *EventLoop) addConn(delta int32) {
@@ -36,7 +79,11 @@ func (e *EventLoop) loadConn() int32 {
 	return atomic.LoadInt32(&e.connCount)
 }
 
+// 关闭所有连接，事件循环退出时还没关闭的连接都算作强制关闭
 func (e *EventLoop) closeAllConnections() {
+	e.exiting = true
+	e.adoptIncoming()
+	atomic.AddInt32(&e.server.forceClosed, int32(len(e.tcpConnectionMap)))
 	for _, c := range e.tcpConnectionMap {
 		_ = e.closeConnection(c)
 	}
@@ -48,13 +95,17 @@ func (e *EventLoop) closeConnection(c *Conn) (err error) {
 		return
 	}
 
-	// 如果发送缓冲不为空，说明还有数据要发送，需要先发送完数据再关闭连接
-	if c.sendBuffer.Len() != 0 {
-		n, err := unix.Write(c.fd, c.sendBuffer.Bytes())
-		if err != nil {
+	// TLS连接先发送close_notify
+	if c.tls != nil {
+		c.tls.close()
+	}
+
+	// 如果发送缓冲不为空，说明还有数据要发送，需要先发送完数据再关闭连接，连接还没有建立时不能发送
+	if !c.outboundBuffer.IsEmpty() && !c.connecting {
+		if n, err := gio.Writev(c.fd, c.outboundBuffer.Peek(gio.IovMax)); err != nil {
 			logger.Error(fmt.Sprintf("closeConnection fd:%d error:%v", c.fd, err))
 		} else {
-			c.sendBuffer.Truncate(n)
+			e.addBytesOut(n)
 		}
 	}
 
@@ -78,7 +129,22 @@ func (e *EventLoop) closeConnection(c *Conn) (err error) {
 
 	delete(e.tcpConnectionMap, c.fd)
 	e.addConn(-1)
-	e.eventHandler.OnConnectionClose(c, err)
+	// 排空期间关闭的连接，包括排空开始之后才注册的连接，退出时强制关闭的不算
+	if e.draining && !e.exiting {
+		atomic.AddInt32(&e.server.drained, 1)
+	}
+	// 没有收到PROXY协议头或者没有完成TLS握手的连接没有调用过OnOpen
+	if c.notified {
+		start := e.busyStart()
+		e.eventHandler.OnConnectionClose(c, err)
+		e.addBusy(start)
+	} else if c.connecting {
+		// 主动发起的连接在建立之前被关闭
+		e.notifyConnect(c, shleverror.ErrConnectionClosed)
+	}
+	if c.pooled != nil {
+		c.pooled.release(c)
+	}
 	c.releaseTCP()
 	return err
 }
@@ -97,19 +163,35 @@ func (e *EventLoop) Register(c *Conn) error {
 func (e *EventLoop) open(c *Conn) error {
 	c.opened = true
 	e.addConn(1)
+	if c.awaitingProxy {
+		e.awaitProxyHeader(c)
+		return nil
+	}
+	return e.establish(c)
+}
 
+// 调用OnOpen，发送OnOpen返回的数据
+func (e *EventLoop) notifyOpen(c *Conn) error {
+	c.notified = true
+	start := e.busyStart()
 	buf, result := e.eventHandler.OnOpen(c, nil)
+	e.addBusy(start)
 
 	if err := c.open(buf); err != nil {
 		return err
 	}
 
-	if c.sendBuffer.Len() != 0 {
-		if err := e.netpoll.AddWrite(c.fd); err != nil {
+	if !c.outboundBuffer.IsEmpty() {
+		if err := e.netpoll.ModReadWrite(c.fd); err != nil {
 			return err
 		}
 	}
 
+	// 排空开始之后才注册的连接也要通知
+	if e.draining {
+		e.drainConn(c)
+	}
+
 	return e.handleResult(c, result)
 }
 
@@ -127,8 +209,32 @@ func (e *EventLoop) read(c *Conn) error {
 		return e.closeConnection(c)
 	}
 
-	c.recvBuffer.Write(e.buffer[:n])
+	atomic.AddUint64(&e.bytesIn, uint64(n))
+	c.buffer = e.buffer[:n]
+	if c.awaitingProxy {
+		if ok, err := e.readProxyHeader(c); !ok {
+			return err
+		}
+		// 头部之后没有数据时等下一次可读
+		if c.InboundBuffered() == 0 {
+			c.saveInbound()
+			return nil
+		}
+	}
+	if c.tls != nil {
+		// 密文交给TLS传输层，握手期间由握手goroutine读取，握手完成之后在这里解密并调用OnTraffic
+		c.tls.feed(c.buffer)
+		c.buffer = nil
+		if !c.tls.handshake {
+			return nil
+		}
+		return e.tlsRead(c)
+	}
+	start := e.busyStart()
 	result := e.eventHandler.OnTraffic(c)
+	e.addBusy(start)
+	// 没有处理完的数据存入接收缓冲区，下一次OnTraffic继续处理
+	c.saveInbound()
 	switch result {
 	case None:
 	case Close:
@@ -141,59 +247,75 @@ func (e *EventLoop) read(c *Conn) error {
 }
 
 func (e *EventLoop) write(c *Conn) error {
-	msg := c.sendBuffer.Bytes()
-	n, err := unix.Write(c.fd, msg)
+	// 一次writev把发送缓冲区中的切片都写出去
+	n, err := gio.Writev(c.fd, c.outboundBuffer.Peek(gio.IovMax))
 	if err != nil {
 		if err == unix.EAGAIN {
 			return nil
-		} else {
-			logger.Error(fmt.Sprintf("EventLoop event_loop idx:%d read err:%v", c.fd, os.NewSyscallError("write", err)))
-			return e.closeConnection(c)
 		}
+		logger.Error(fmt.Sprintf("EventLoop event_loop idx:%d write err:%v", c.fd, os.NewSyscallError("writev", err)))
+		return e.closeConnection(c)
 	}
+	e.addBytesOut(n)
+	c.outboundBuffer.Discard(n)
 
-	if n > 0 {
-		c.sendBuffer.Truncate(n)
-	}
 	// 当所有数据都发送出去时，此时没有必要继续监听写事件了
-	if c.sendBuffer.Len() == 0 {
-		e.netpoll.ModRead(c.fd)
+	if c.outboundBuffer.IsEmpty() {
+		if c.closing {
+			return e.closeConnection(c)
+		}
+		return e.netpoll.ModRead(c.fd)
 	}
 
 	return nil
 }
 
+// 开始排空连接：关闭监听器不再接收新连接，然后通知每个连接，只在事件循环中执行
+func (e *EventLoop) drain(_ interface{}) error {
+	e.draining = true
+	for fd, ln := range e.listeners {
+		_ = e.netpoll.Delete(fd)
+		ln.Close()
+	}
+	for _, c := range e.tcpConnectionMap {
+		e.drainConn(c)
+	}
+	return nil
+}
+
+// 通知连接服务器正在排空，还没有调用OnOpen的连接直接关闭
+func (e *EventLoop) drainConn(c *Conn) {
+	// 连接池中空闲的连接不需要通知
+	if !c.notified || (c.pooled != nil && c.pooled.idle) {
+		_ = e.closeConnection(c)
+		return
+	}
+	if h, ok := e.eventHandler.(DrainHandler); ok {
+		h.OnDrain(c)
+	}
+}
+
+// 连接是否仍然由当前事件循环管理，连接关闭之后fd可能被新连接复用，所以要比较指针
+func (e *EventLoop) ownsConn(c *Conn) bool {
+	conn, ok := e.tcpConnectionMap[c.fd]
+	return ok && conn == c
+}
+
 // 唤醒连接
 func (e *EventLoop) wake(c *Conn) error {
-	if conn, ok := e.tcpConnectionMap[c.fd]; !ok || conn != c {
+	if !e.ownsConn(c) || !c.notified {
 		// 忽略未更新的连接
 		return nil
 	}
 
+	start := e.busyStart()
 	res := e.eventHandler.OnTraffic(c)
+	e.addBusy(start)
+	c.saveInbound()
 
 	return e.handleResult(c, res)
 }
 
-// todo 暂时未加入定时器功能
-func (e *EventLoop) ticker(ctx context.Context) {
-	if e == nil {
-		return
-	}
-
-	var timer *time.Ticker
-	defer func() {
-		if timer != nil {
-			timer.Stop()
-		}
-	}()
-
-	//for {
-	//	delay, action := e.eventCallback.OnTick()
-	//
-	//}
-}
-
 func (e *EventLoop) handleResult(c *Conn, res HandleResult) error {
 	switch res {
 	case None:
@@ -205,12 +327,19 @@ func (e *EventLoop) handleResult(c *Conn, res HandleResult) error {
 	default:
 		return nil
 	}
-	return nil
+}
+
+// 监听套接字可读，tcp和unix接收新连接，udp读取数据报
+func (e *EventLoop) onListener(ln *Listener) error {
+	if ln.Network == "udp" {
+		return e.readUDP(ln)
+	}
+	return e.accept(ln)
 }
 
 // 添加新连接
-func (e *EventLoop) accept(fd int, _ uint32) error {
-	connFd, sa, err := unix.Accept(fd)
+func (e *EventLoop) accept(ln *Listener) error {
+	connFd, sa, err := unix.Accept(ln.Fd)
 	if err != nil {
 		if err == unix.EAGAIN {
 			return nil
@@ -224,13 +353,14 @@ func (e *EventLoop) accept(fd int, _ uint32) error {
 		return err
 	}
 
-	remoteAddr := socket.SockaddrToTCPAddr(sa)
-	if e.server.opts.TCPKeepAlive > 0 {
-		err = socket.SetKeepAlivePeriod(connFd, int(e.server.opts.TCPKeepAlive/time.Second))
-		logger.Error(err)
+	remoteAddr := ln.sockaddrToAddr(sa)
+	if e.server.opts.TCPKeepAlive > 0 && ln.Network == "tcp" {
+		if err = socket.SetKeepAlivePeriod(connFd, int(e.server.opts.TCPKeepAlive/time.Second)); err != nil {
+			logger.Error("set keep-alive error:", err)
+		}
 	}
 
-	c := newTCPConn(connFd, e, sa, e.ln.Addr, remoteAddr)
+	c := newTCPConn(connFd, e, ln, sa, remoteAddr)
 	if err = e.netpoll.AddRead(c.fd); err != nil {
 		return err
 	}
@@ -238,6 +368,30 @@ func (e *EventLoop) accept(fd int, _ uint32) error {
 	return e.open(c)
 }
 
+// 读取一个UDP数据报，每个数据报都用一个新的Conn交给OnTraffic处理
+func (e *EventLoop) readUDP(ln *Listener) error {
+	n, sa, err := unix.Recvfrom(ln.Fd, e.buffer, 0)
+	if err != nil {
+		if err == unix.EAGAIN {
+			return nil
+		}
+		logger.Error(fmt.Sprintf("EventLoop readUDP fd:%d recvfrom err:%v", ln.Fd, os.NewSyscallError("recvfrom", err)))
+		return nil
+	}
+
+	atomic.AddUint64(&e.bytesIn, uint64(n))
+	c := newUDPConn(e, ln, sa, socket.SockaddrToUDPAddr(sa))
+	c.buffer = e.buffer[:n]
+	start := e.busyStart()
+	result := e.eventHandler.OnTraffic(c)
+	e.addBusy(start)
+	c.buffer = nil
+	if result == Shutdown {
+		return shleverror.ErrServerShutdown
+	}
+	return nil
+}
+
 // 开启当前事件循环
 func (e *EventLoop) run(lockOSThread bool) {
 	if lockOSThread {
@@ -247,20 +401,30 @@ func (e *EventLoop) run(lockOSThread bool) {
 
 	defer func() {
 		e.closeAllConnections()
-		e.ln.Close()
+		for _, ln := range e.listeners {
+			ln.Close()
+		}
 		e.server.signalShutdown()
 	}()
 
 	// 即负责io也负责accept
 	err := e.netpoll.Polling(func(fd int, ev uint32) error {
 		if c, ok := e.tcpConnectionMap[fd]; ok {
+			// 主动发起的连接可写或者出错，说明连接有了结果
+			if c.connecting {
+				return e.connect(c)
+			}
 			// 如果对方挂断，在write函数中会处理rdhup和hup事件
 			// 无论是否有错误，都要把发送缓冲区的数据发送完毕之后才关闭连接
 			// 发生错误时，write要保证两点：1、发送完待发送数据；2、关闭连接
-			if (ev&netpoll.OutEvents) != 0 && !(c.sendBuffer.Len() == 0) {
+			if (ev&netpoll.OutEvents) != 0 && !c.outboundBuffer.IsEmpty() {
 				if err := e.write(c); err != nil {
 					return err
 				}
+				// 写失败时连接已经关闭
+				if !c.opened {
+					return nil
+				}
 			}
 			// 当套接字有 unix.EPOLLIN 事件，且读到的数据长度为0时，说明对方已经关闭连接。
 			if (ev & netpoll.InEvents) != 0 {
@@ -268,7 +432,10 @@ func (e *EventLoop) run(lockOSThread bool) {
 			}
 			return nil
 		}
-		return e.accept(fd, ev)
+		if ln, ok := e.listeners[fd]; ok {
+			return e.onListener(ln)
+		}
+		return nil
 	})
 
 	if err != nil {
@@ -290,13 +457,21 @@ func (e *EventLoop) activateSubReactor(lockOSThread bool) {
 	// 从reactor只需要处理i/o
 	err := e.netpoll.Polling(func(fd int, ev uint32) error {
 		if c, ok := e.tcpConnectionMap[fd]; ok {
+			// 主动发起的连接可写或者出错，说明连接有了结果
+			if c.connecting {
+				return e.connect(c)
+			}
 			// 如果对方挂断，在write函数中会处理rdhup和hup事件
 			// 无论是否有错误，都要把发送缓冲区的数据发送完毕之后才关闭连接
 			// 发生错误时，write要保证两点：1、发送完待发送数据；2、关闭连接
-			if (ev&netpoll.OutEvents) != 0 && !(c.sendBuffer.Len() == 0) {
+			if (ev&netpoll.OutEvents) != 0 && !c.outboundBuffer.IsEmpty() {
 				if err := e.write(c); err != nil {
 					return err
 				}
+				// 写失败时连接已经关闭
+				if !c.opened {
+					return nil
+				}
 			}
 			if (ev & netpoll.InEvents) != 0 {
 				return e.read(c)
@@ -319,7 +494,12 @@ func (e *EventLoop) activateMainReactor(lockOSThread bool) {
 	defer e.server.signalShutdown()
 
 	// 主reactor只负责accept
-	err := e.netpoll.Polling(func(fd int, ev uint32) error { return e.server.accept(fd, ev) })
+	err := e.netpoll.Polling(func(fd int, _ uint32) error {
+		if ln, ok := e.listeners[fd]; ok {
+			return e.server.accept(ln)
+		}
+		return nil
+	})
 	if err == shleverror.ErrServerShutdown {
 		logger.Error("main reactor is exiting in terms of the demand from user, error:", err)
 	} else if err != nil {
@@ -0,0 +1,289 @@
+package shlev
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Senhnn/shlev/internal/socket"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// EnvListenerFds 交接监听套接字时传给子进程的环境变量，值为JSON对象，key为监听地址，value为fd列表，
+	// 端口复用时列表中依次是每个事件循环的监听套接字
+	EnvListenerFds = "SHLEV_LISTENER_FDS"
+
+	// EnvReadyFd 子进程启动完成之后向这个fd写一个字节通知父进程
+	EnvReadyFd = "SHLEV_READY_FD"
+)
+
+// Handoff 把监听套接字交给新进程，用于不拒绝连接的重启。
+// 监听套接字通过继承fd传给cmd，cmd为nil时用同样的参数重新执行当前程序，子进程需要使用WithInheritedListeners启动；
+// 端口复用时每个事件循环的监听套接字都会交给子进程，子进程优先使用它们，避免关闭时重置在上面排队的连接。
+// 子进程启动完成之后当前服务器停止接收新连接并排空连接，参看Shutdown。子进程没有启动成功或者ctx到期时，
+// 会杀掉子进程并返回错误，当前服务器继续运行。目前只支持继承fd，不支持通过unix域套接字的SCM_RIGHTS传递
+func (s *Server) Handoff(ctx context.Context, cmd *exec.Cmd) (ShutdownReport, error) {
+	if cmd == nil {
+		exe, err := os.Executable()
+		if err != nil {
+			return ShutdownReport{}, err
+		}
+		cmd = exec.Command(exe, os.Args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+
+	// 子进程中ExtraFiles的第i个文件的fd为3+i
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	addFile := func(f *os.File) int {
+		files = append(files, f)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		return 2 + len(cmd.ExtraFiles)
+	}
+
+	fds := make(map[string][]int, len(s.lns))
+	for key, lns := range s.handoffListeners() {
+		for _, ln := range lns {
+			// 复制的fd设置FD_CLOEXEC，只有cmd通过ExtraFiles继承，同时启动的其他进程不会继承
+			fd, err := unix.FcntlInt(uintptr(ln.Fd), unix.F_DUPFD_CLOEXEC, 0)
+			if err != nil {
+				return ShutdownReport{}, os.NewSyscallError("fcntl dupfd", err)
+			}
+			fds[key] = append(fds[key], addFile(os.NewFile(uintptr(fd), key)))
+		}
+	}
+	b, err := json.Marshal(fds)
+	if err != nil {
+		return ShutdownReport{}, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return ShutdownReport{}, err
+	}
+	defer r.Close()
+	cmd.Env = append(cmd.Env, EnvListenerFds+"="+string(b), EnvReadyFd+"="+strconv.Itoa(addFile(w)))
+
+	if err = cmd.Start(); err != nil {
+		return ShutdownReport{}, err
+	}
+	// 关闭父进程中复制的监听套接字和管道写端，子进程退出时读端会读到EOF
+	for _, f := range files {
+		_ = f.Close()
+	}
+	files = nil
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if n, err := r.Read(buf); n != 1 {
+			ready <- fmt.Errorf("%w: %v", shleverror.ErrHandoffFailed, err)
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		logger.Error("handoff error:", err)
+		return ShutdownReport{}, err
+	}
+
+	// 子进程还在使用unix域套接字文件，关闭时不能删除
+	for _, ln := range s.lns {
+		atomic.StoreInt32(&ln.handedOff, 1)
+	}
+	return s.Shutdown(ctx)
+}
+
+// 要交接的监听套接字，key为监听地址，包括端口复用时其他事件循环的监听套接字，
+// 以及从父进程继承、分给事件循环的其他监听套接字
+func (s *Server) handoffListeners() map[string][]*Listener {
+	m := make(map[string][]*Listener, len(s.lns))
+	add := func(l *Listener) {
+		ln := s.lns[l.index]
+		key := ln.network + "://" + ln.Address
+		m[key] = append(m[key], l)
+	}
+	for _, ln := range s.lns {
+		add(ln)
+	}
+	// 事件循环的监听器只在启动时修改，这里只读
+	loops := make([]*EventLoop, 0, s.lb.Len()+1)
+	s.lb.Iterate(func(_ int, e *EventLoop) bool {
+		loops = append(loops, e)
+		return true
+	})
+	if s.mainLoop != nil {
+		loops = append(loops, s.mainLoop)
+	}
+	for _, e := range loops {
+		for _, l := range e.listeners {
+			if l != s.lns[l.index] {
+				add(l)
+			}
+		}
+	}
+	return m
+}
+
+var (
+	inheritedOnce sync.Once
+	inheritedMu   sync.Mutex
+	inheritedFds  map[string][]int // 父进程交接的监听套接字，使用之后删除
+)
+
+// 解析父进程交接的监听套接字
+func loadInheritedFds() {
+	inheritedOnce.Do(func() {
+		inheritedFds = make(map[string][]int)
+		if v := os.Getenv(EnvListenerFds); v != "" {
+			if err := json.Unmarshal([]byte(v), &inheritedFds); err != nil {
+				logger.Error("invalid "+EnvListenerFds+":", err)
+			}
+		}
+	})
+}
+
+// 如果父进程交接了这个地址的监听套接字，直接使用它，每个fd只能使用一次。
+// 父进程端口复用时其他的监听套接字保存在Listener中，创建事件循环时分配
+func inheritListener(network, address string, options *Options, lnOpts ListenerOptions) (*Listener, bool, error) {
+	if !options.InheritedListeners {
+		return nil, false, nil
+	}
+	loadInheritedFds()
+	key := network + "://" + address
+	inheritedMu.Lock()
+	fds := inheritedFds[key]
+	delete(inheritedFds, key)
+	inheritedMu.Unlock()
+	if len(fds) == 0 {
+		return nil, false, nil
+	}
+
+	l, err := listenerFromFd(fds[0], network, address, lnOpts)
+	if err != nil {
+		for _, fd := range fds {
+			_ = unix.Close(fd)
+		}
+		return nil, true, err
+	}
+	l.inherited = fds[1:]
+	logger.Info(fmt.Sprintf("inherit listener %s fds:%v", key, fds))
+	return l, true, nil
+}
+
+// 用父进程交接的fd创建监听器
+func listenerFromFd(fd int, network, address string, lnOpts ListenerOptions) (*Listener, error) {
+	l := &Listener{
+		Fd:      fd,
+		Address: address,
+		Network: network,
+		network: network,
+		lnOpts:  lnOpts,
+	}
+	if strings.HasPrefix(network, "tcp") {
+		l.Network = "tcp"
+	} else if strings.HasPrefix(network, "udp") {
+		l.Network = "udp"
+	}
+	if err := os.NewSyscallError("fcntl nonblock", unix.SetNonblock(fd, true)); err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(fd)
+
+	if l.Network == "unix" {
+		l.Addr = &net.UnixAddr{Name: address, Net: "unix"}
+	} else {
+		sa, err := unix.Getsockname(fd)
+		if err != nil {
+			return nil, os.NewSyscallError("getsockname", err)
+		}
+		if l.Network == "udp" {
+			l.Addr = socket.SockaddrToUDPAddr(sa)
+		} else {
+			l.Addr = socket.SockaddrToTCPAddr(sa)
+		}
+	}
+	return l, nil
+}
+
+// 取出一个父进程端口复用时交接的监听套接字，没有时返回nil
+func (l *Listener) nextInherited() (*Listener, error) {
+	if len(l.inherited) == 0 {
+		return nil, nil
+	}
+	fd := l.inherited[0]
+	l.inherited = l.inherited[1:]
+	nl, err := listenerFromFd(fd, l.network, l.Address, l.lnOpts)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	nl.index = l.index
+	return nl, nil
+}
+
+// 取出所有还没有分配给事件循环的交接监听套接字。关闭它们会重置在上面排队的连接，所以继续接收连接
+func (l *Listener) restInherited() ([]*Listener, error) {
+	var lns []*Listener
+	for len(l.inherited) > 0 {
+		nl, err := l.nextInherited()
+		if err != nil {
+			return lns, err
+		}
+		lns = append(lns, nl)
+	}
+	return lns, nil
+}
+
+// 子进程启动完成之后通知父进程，并关闭没有用到的监听套接字
+func notifyHandoffReady() {
+	loadInheritedFds()
+	inheritedMu.Lock()
+	for key, fds := range inheritedFds {
+		logger.Info("close unused inherited listener:", key)
+		for _, fd := range fds {
+			_ = unix.Close(fd)
+		}
+		delete(inheritedFds, key)
+	}
+	inheritedMu.Unlock()
+
+	v := os.Getenv(EnvReadyFd)
+	if v == "" {
+		return
+	}
+	_ = os.Unsetenv(EnvReadyFd)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Error("invalid "+EnvReadyFd+":", v)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "handoff-ready")
+	if _, err = f.Write([]byte{1}); err != nil {
+		logger.Error("notify handoff ready error:", err)
+	}
+	_ = f.Close()
+}
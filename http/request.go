@@ -0,0 +1,417 @@
+package http
+
+import (
+	"bytes"
+	"github.com/Senhnn/shlev"
+	"net"
+	nethttp "net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Header 请求和响应的头部，和net/http的Header相同
+type Header = nethttp.Header
+
+// Request 解析完的请求，请求体已经全部读到Body中
+type Request struct {
+	Method     string
+	RequestURI string // 请求行中的原始URI
+	URL        *url.URL
+	Proto      string // 比如HTTP/1.1
+	ProtoMajor int
+	ProtoMinor int
+	Header     Header
+	Host       string
+
+	// ContentLength 请求体的长度，chunked编码时为-1
+	ContentLength int64
+
+	// TransferEncoding 请求的传输编码，只支持chunked
+	TransferEncoding []string
+
+	// Close 处理完这个请求之后是否关闭连接
+	Close bool
+
+	// Body 请求体，chunked编码的请求体已经解码
+	Body []byte
+
+	// Trailer chunked编码的请求体之后的头部
+	Trailer Header
+
+	RemoteAddr net.Addr
+
+	// Conn 请求所在的连接，服务器用连接的Context保存解析状态，不要修改它
+	Conn *shlev.Conn
+}
+
+// 解析的阶段
+const (
+	stageHeader    = iota // 等待完整的请求头
+	stageBody             // 按Content-Length读取请求体
+	stageChunkSize        // 读取chunk的长度行
+	stageChunkData        // 读取chunk的数据
+	stageTrailer          // 读取chunked请求体之后的头部
+)
+
+// chunk长度行的最大长度，包括chunk扩展
+const maxChunkLineLength = 4096
+
+var crlf = []byte("\r\n")
+
+// 连接的解析状态，保存在Conn的Context中，请求可以分多次OnTraffic到达
+type connState struct {
+	stage     int
+	scanned   int      // 已经查找过请求头结束标记或者行尾的字节数，避免每次从头查找和拷贝
+	req       *Request // 请求头已经解析完，正在读取请求体的请求
+	remaining int64    // stageBody：剩余的请求体长度；stageChunkData：当前chunk剩余的长度
+	trailer   int      // 已经读到的trailer的字节数
+	closed    bool     // 已经决定关闭连接，之后的数据全部丢弃
+	draining  bool     // 服务器正在关闭，响应之后关闭连接
+}
+
+// 解析失败时返回给客户端的状态码
+type requestError struct {
+	code int
+	msg  string
+}
+
+func (e *requestError) Error() string {
+	return strconv.Itoa(e.code) + " " + e.msg
+}
+
+func badRequest(msg string) *requestError {
+	return &requestError{code: nethttp.StatusBadRequest, msg: msg}
+}
+
+// 从接收缓冲区中解析下一个完整的请求，数据不够时返回nil，已经解析的部分保存在connState中
+func (st *connState) next(c *shlev.Conn, s *Server) (*Request, *requestError) {
+	for {
+		switch st.stage {
+		case stageHeader:
+			req, err := st.readHeader(c, s)
+			if req == nil || err != nil {
+				return nil, err
+			}
+			st.req = req
+			if err = s.expectContinue(c, req); err != nil {
+				return nil, err
+			}
+			switch {
+			case req.ContentLength < 0:
+				st.stage = stageChunkSize
+			case req.ContentLength > 0:
+				st.stage, st.remaining = stageBody, req.ContentLength
+			default:
+				return st.done(), nil
+			}
+
+		case stageBody:
+			if !st.readData(c) {
+				return nil, nil
+			}
+			return st.done(), nil
+
+		case stageChunkSize:
+			line, err := st.readLine(c, maxChunkLineLength)
+			if line == nil || err != nil {
+				return nil, err
+			}
+			size, err := parseChunkSize(line)
+			if err != nil {
+				return nil, err
+			}
+			if size > s.maxBodyBytes()-int64(len(st.req.Body)) {
+				return nil, &requestError{code: nethttp.StatusRequestEntityTooLarge, msg: "request body too large"}
+			}
+			if size == 0 {
+				st.stage = stageTrailer
+			} else {
+				st.stage, st.remaining = stageChunkData, size
+			}
+
+		case stageChunkData:
+			if !st.readData(c) {
+				return nil, nil
+			}
+			// chunk数据之后是\r\n
+			if c.InboundBuffered() < len(crlf) {
+				return nil, nil
+			}
+			if end, _ := c.Next(len(crlf)); !bytes.Equal(end, crlf) {
+				return nil, badRequest("malformed chunked encoding")
+			}
+			st.stage = stageChunkSize
+
+		case stageTrailer:
+			// 每一行的\r\n也计入长度，包括结束的空行，剩下的长度放不下\r\n时不会再有完整的一行
+			budget := s.maxHeaderBytes() - st.trailer - len(crlf)
+			if budget < 0 {
+				return nil, &requestError{code: nethttp.StatusRequestHeaderFieldsTooLarge, msg: "trailer too large"}
+			}
+			line, err := st.readLine(c, budget)
+			if err != nil {
+				return nil, &requestError{code: nethttp.StatusRequestHeaderFieldsTooLarge, msg: "trailer too large"}
+			}
+			if line == nil {
+				return nil, nil
+			}
+			if len(line) == 0 {
+				return st.done(), nil
+			}
+			st.trailer += len(line) + len(crlf)
+			key, value, ok := parseHeaderLine(line)
+			if !ok {
+				return nil, badRequest("malformed trailer")
+			}
+			if st.req.Trailer == nil {
+				st.req.Trailer = make(Header)
+			}
+			st.req.Trailer[key] = append(st.req.Trailer[key], value)
+		}
+	}
+}
+
+// 把接收缓冲区中的数据追加到请求体，返回remaining是否已经读完
+func (st *connState) readData(c *shlev.Conn) bool {
+	n := int64(c.InboundBuffered())
+	if n > st.remaining {
+		n = st.remaining
+	}
+	if n > 0 {
+		b, _ := c.Next(int(n))
+		st.req.Body = append(st.req.Body, b...)
+		st.remaining -= n
+	}
+	return st.remaining == 0
+}
+
+// 一个请求解析完成，重置状态准备解析下一个请求
+func (st *connState) done() *Request {
+	req := st.req
+	st.stage, st.scanned, st.req, st.remaining, st.trailer = stageHeader, 0, nil, 0, 0
+	return req
+}
+
+// 读取完整的请求头，没有收到完整的请求头时返回nil
+func (st *connState) readHeader(c *shlev.Conn, s *Server) (*Request, *requestError) {
+	// 请求行之前的空行忽略掉
+	for st.scanned == 0 && c.InboundBuffered() >= len(crlf) {
+		if b, _ := c.Peek(len(crlf)); !bytes.Equal(b, crlf) {
+			break
+		}
+		_, _ = c.Discard(len(crlf))
+	}
+
+	limit := c.InboundBuffered()
+	if max := s.maxHeaderBytes(); limit > max {
+		limit = max
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	// 只拷贝还没有查找过的部分，结束标记可能跨越上一次的结尾
+	start := st.scanned - 3
+	if start < 0 {
+		start = 0
+	}
+	buf, _ := c.PeekAt(start, limit-start)
+	i := bytes.Index(buf, []byte("\r\n\r\n"))
+	if i < 0 {
+		if limit == s.maxHeaderBytes() {
+			return nil, &requestError{code: nethttp.StatusRequestHeaderFieldsTooLarge, msg: "request header too large"}
+		}
+		st.scanned = limit
+		return nil, nil
+	}
+	end := start + i + 4
+	st.scanned = 0
+	head, _ := c.Peek(end - 4)
+	req, err := parseRequestHeader(head, s)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = c.Discard(end)
+	req.RemoteAddr = c.RemoteAddr()
+	req.Conn = c
+	return req, nil
+}
+
+// 解析请求行和头部，b不包括结尾的空行
+func parseRequestHeader(b []byte, s *Server) (*Request, *requestError) {
+	lines := bytes.Split(b, crlf)
+	parts := strings.SplitN(string(lines[0]), " ", 3)
+	if len(parts) != 3 || !validToken(parts[0]) || parts[1] == "" {
+		return nil, badRequest("malformed request line")
+	}
+	req := &Request{Method: parts[0], RequestURI: parts[1], Proto: parts[2], Header: make(Header)}
+
+	var ok bool
+	if req.ProtoMajor, req.ProtoMinor, ok = nethttp.ParseHTTPVersion(req.Proto); !ok {
+		return nil, badRequest("malformed HTTP version")
+	}
+	if req.ProtoMajor != 1 {
+		return nil, &requestError{code: nethttp.StatusHTTPVersionNotSupported, msg: "unsupported HTTP version"}
+	}
+	var err error
+	if req.URL, err = url.ParseRequestURI(req.RequestURI); err != nil {
+		return nil, badRequest("malformed request URI")
+	}
+
+	for _, line := range lines[1:] {
+		// 不支持已经废弃的多行头部
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			return nil, badRequest("obsolete line folding")
+		}
+		key, value, ok := parseHeaderLine(line)
+		if !ok {
+			return nil, badRequest("malformed header")
+		}
+		req.Header[key] = append(req.Header[key], value)
+	}
+
+	// HTTP/1.1要求有且只有一个Host
+	hosts := req.Header["Host"]
+	if len(hosts) > 1 || (len(hosts) == 0 && req.ProtoMinor >= 1) {
+		return nil, badRequest("missing or duplicate Host header")
+	}
+	req.Host = req.Header.Get("Host")
+	if req.URL.Host != "" {
+		req.Host = req.URL.Host
+	}
+
+	if rerr := req.parseBodyLength(s); rerr != nil {
+		return nil, rerr
+	}
+	req.Close = shouldClose(req.ProtoMinor, req.Header)
+	return req, nil
+}
+
+// 根据Transfer-Encoding和Content-Length确定请求体的长度
+func (req *Request) parseBodyLength(s *Server) *requestError {
+	te := req.Header["Transfer-Encoding"]
+	cl := req.Header["Content-Length"]
+	if len(te) > 0 {
+		// 同时有两个头部可能是请求走私，直接拒绝
+		if len(cl) > 0 {
+			return badRequest("both Transfer-Encoding and Content-Length are set")
+		}
+		if len(te) != 1 || !strings.EqualFold(strings.TrimSpace(te[0]), "chunked") {
+			return &requestError{code: nethttp.StatusNotImplemented, msg: "unsupported transfer encoding"}
+		}
+		req.TransferEncoding = []string{"chunked"}
+		req.ContentLength = -1
+		return nil
+	}
+	if len(cl) == 0 {
+		return nil
+	}
+	for _, v := range cl[1:] {
+		if v != cl[0] {
+			return badRequest("conflicting Content-Length")
+		}
+	}
+	n, err := strconv.ParseInt(cl[0], 10, 64)
+	if err != nil || n < 0 {
+		return badRequest("malformed Content-Length")
+	}
+	if n > s.maxBodyBytes() {
+		return &requestError{code: nethttp.StatusRequestEntityTooLarge, msg: "request body too large"}
+	}
+	req.ContentLength = n
+	return nil
+}
+
+// HTTP/1.1默认保持连接，HTTP/1.0默认关闭
+func shouldClose(minor int, h Header) bool {
+	conn := strings.ToLower(strings.Join(h["Connection"], ","))
+	if minor == 0 {
+		return !hasToken(conn, "keep-alive")
+	}
+	return hasToken(conn, "close")
+}
+
+func hasToken(list, token string) bool {
+	for _, v := range strings.Split(list, ",") {
+		if strings.TrimSpace(v) == token {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析Name: value格式的头部
+func parseHeaderLine(line []byte) (key, value string, ok bool) {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 || !validToken(string(line[:i])) {
+		return "", "", false
+	}
+	key = textproto.CanonicalMIMEHeaderKey(string(line[:i]))
+	value = strings.Trim(string(line[i+1:]), " \t")
+	return key, value, true
+}
+
+// 方法名和头部名只能包含token字符
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 解析chunk长度行，忽略chunk扩展。长度只能是十六进制数字，
+// 空白和正负号之类宽松的写法在代理之后可能被解析成不同的长度，导致请求走私，直接拒绝
+func parseChunkSize(line []byte) (int64, *requestError) {
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	if len(line) == 0 {
+		return 0, badRequest("malformed chunk size")
+	}
+	for _, b := range line {
+		if !('0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F') {
+			return 0, badRequest("malformed chunk size")
+		}
+	}
+	size, err := strconv.ParseInt(string(line), 16, 64)
+	if err != nil {
+		return 0, badRequest("malformed chunk size")
+	}
+	return size, nil
+}
+
+// 读取以\r\n结尾的一行，不包括\r\n，没有读到完整的一行时返回nil，超过max时返回错误。
+// 和请求头一样只拷贝还没有查找过的部分
+func (st *connState) readLine(c *shlev.Conn, max int) ([]byte, *requestError) {
+	limit := c.InboundBuffered()
+	if limit > max+len(crlf) {
+		limit = max + len(crlf)
+	}
+	if limit < len(crlf) {
+		return nil, nil
+	}
+	start := st.scanned - 1
+	if start < 0 {
+		start = 0
+	}
+	buf, _ := c.PeekAt(start, limit-start)
+	i := bytes.Index(buf, crlf)
+	if i < 0 {
+		if limit == max+len(crlf) {
+			return nil, badRequest("line too long")
+		}
+		st.scanned = limit
+		return nil, nil
+	}
+	st.scanned = 0
+	end := start + i
+	line, _ := c.Next(end + len(crlf))
+	return line[:end:end], nil
+}
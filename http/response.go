@@ -0,0 +1,189 @@
+package http
+
+import (
+	"github.com/Senhnn/shlev"
+	nethttp "net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResponseWriter 构造响应，和net/http的ResponseWriter用法相同。
+// 写入的数据先缓存起来，处理函数返回之后和响应头一起发送，需要边处理边发送时使用Flusher
+type ResponseWriter interface {
+	// Header 响应头，WriteHeader或者第一次Flush之后修改不再生效
+	Header() Header
+
+	// Write 写入响应体，没有调用WriteHeader时状态码为200
+	Write([]byte) (int, error)
+
+	// WriteHeader 设置状态码，只有第一次调用生效
+	WriteHeader(statusCode int)
+}
+
+// Flusher ResponseWriter实现了这个接口，Flush把已经写入的数据先发送出去，
+// 第一次Flush时用chunked编码发送响应头；HTTP/1.0的请求不支持chunked编码，Flush不做任何事情
+type Flusher interface {
+	Flush()
+}
+
+type response struct {
+	conn        *shlev.Conn
+	req         *Request
+	header      Header
+	status      int
+	body        []byte
+	chunked     bool // 已经用chunked编码发送了响应头
+	closeAfter  bool // 发送完响应之后关闭连接
+	wroteHeader bool
+}
+
+func newResponse(c *shlev.Conn, req *Request) *response {
+	return &response{conn: c, req: req, header: make(Header), closeAfter: req.Close}
+}
+
+func (w *response) Header() Header {
+	return w.header
+}
+
+func (w *response) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+}
+
+func (w *response) Write(p []byte) (int, error) {
+	w.WriteHeader(nethttp.StatusOK)
+	if !w.bodyAllowed() {
+		return 0, nethttp.ErrBodyNotAllowed
+	}
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
+
+func (w *response) Flush() {
+	if w.req.ProtoMinor == 0 {
+		return
+	}
+	w.WriteHeader(nethttp.StatusOK)
+	if !w.bodyAllowed() {
+		return
+	}
+	var bs [][]byte
+	if !w.chunked {
+		w.chunked = true
+		w.header.Del("Content-Length")
+		w.header.Set("Transfer-Encoding", "chunked")
+		bs = append(bs, w.head())
+	}
+	if !w.isHead() {
+		bs = appendChunk(bs, w.body)
+	}
+	w.body = w.body[:0]
+	if len(bs) > 0 {
+		_, _ = w.conn.Writev(bs)
+	}
+}
+
+// 1xx、204、304的响应没有响应体
+func (w *response) bodyAllowed() bool {
+	return w.status >= 200 && w.status != nethttp.StatusNoContent && w.status != nethttp.StatusNotModified
+}
+
+// HEAD请求的响应头和GET一样，但是不发送响应体
+func (w *response) isHead() bool {
+	return w.req.Method == nethttp.MethodHead
+}
+
+// 处理函数返回之后发送响应
+func (w *response) finish() {
+	w.WriteHeader(nethttp.StatusOK)
+	if !w.chunked && w.req.ProtoMinor >= 1 && w.bodyAllowed() &&
+		strings.EqualFold(w.header.Get("Transfer-Encoding"), "chunked") {
+		w.chunked = true
+		w.header.Del("Content-Length")
+		bs := [][]byte{w.head()}
+		if !w.isHead() {
+			bs = append(appendChunk(bs, w.body), []byte("0\r\n\r\n"))
+		}
+		_, _ = w.conn.Writev(bs)
+		return
+	}
+	if w.chunked {
+		if !w.isHead() {
+			_, _ = w.conn.Writev(append(appendChunk(nil, w.body), []byte("0\r\n\r\n")))
+		}
+		return
+	}
+
+	w.header.Del("Transfer-Encoding")
+	body := w.body
+	if w.bodyAllowed() {
+		// HEAD请求的处理函数可以自己设置Content-Length
+		if !w.isHead() || w.header.Get("Content-Length") == "" {
+			w.header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		if len(body) > 0 && w.header.Get("Content-Type") == "" {
+			w.header.Set("Content-Type", nethttp.DetectContentType(body))
+		}
+	}
+	if w.isHead() {
+		body = nil
+	}
+	_, _ = w.conn.Writev([][]byte{w.head(), body})
+}
+
+var headerNewlineToSpace = strings.NewReplacer("\r", " ", "\n", " ")
+
+// 状态行和响应头
+func (w *response) head() []byte {
+	if hasToken(strings.ToLower(strings.Join(w.header["Connection"], ",")), "close") {
+		w.closeAfter = true
+	}
+	if w.closeAfter {
+		w.header.Set("Connection", "close")
+	} else if w.req.ProtoMinor == 0 {
+		w.header.Set("Connection", "keep-alive")
+	}
+	if w.header.Get("Date") == "" {
+		w.header.Set("Date", time.Now().UTC().Format(nethttp.TimeFormat))
+	}
+
+	b := make([]byte, 0, 256)
+	b = append(b, "HTTP/1.1 "...)
+	b = strconv.AppendInt(b, int64(w.status), 10)
+	b = append(b, ' ')
+	b = append(b, nethttp.StatusText(w.status)...)
+	b = append(b, crlf...)
+
+	keys := make([]string, 0, len(w.header))
+	for k := range w.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// 和net/http一样，跳过不合法的头部名，值中的\r\n换成空格，避免处理函数写入用户输入时拆分响应
+		if !validToken(k) {
+			continue
+		}
+		for _, v := range w.header[k] {
+			b = append(b, k...)
+			b = append(b, ": "...)
+			b = append(b, headerNewlineToSpace.Replace(v)...)
+			b = append(b, crlf...)
+		}
+	}
+	return append(b, crlf...)
+}
+
+// 把data编码成一个chunk追加到bs，data为空时不追加，避免被当作结束标记
+func appendChunk(bs [][]byte, data []byte) [][]byte {
+	if len(data) == 0 {
+		return bs
+	}
+	size := strconv.AppendInt(nil, int64(len(data)), 16)
+	return append(bs, append(size, crlf...), data, crlf)
+}
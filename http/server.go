@@ -0,0 +1,169 @@
+package http
+
+import (
+	"fmt"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/tools/logger"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultMaxHeaderBytes 默认的请求头最大长度，包括请求行
+	DefaultMaxHeaderBytes = 1 << 20 // 1MB
+	// DefaultMaxBodyBytes 默认的请求体最大长度
+	DefaultMaxBodyBytes = 4 << 20 // 4MB
+)
+
+// Handler 处理请求，在事件循环中调用，不能阻塞，耗时的操作放到其他goroutine中，然后用Conn.AsyncWrite发送
+type Handler interface {
+	ServeHTTP(ResponseWriter, *Request)
+}
+
+// HandlerFunc 把函数适配成Handler
+type HandlerFunc func(ResponseWriter, *Request)
+
+func (f HandlerFunc) ServeHTTP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// Server 运行在事件循环上的HTTP/1.1服务器，实现了shlev.EventHandler。
+// 请求在OnTraffic中增量解析，支持keep-alive和pipelining，同一个连接上的请求按顺序处理和响应，不会为请求创建goroutine。
+// 连接的Context用来保存解析状态，OnOpen会替换连接上已有的Context，包括shlev.Server.DialContext传入的
+type Server struct {
+	// Handler 处理请求
+	Handler Handler
+
+	// MaxHeaderBytes 请求头的最大长度，超过时返回431，0表示DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+
+	// MaxBodyBytes 请求体的最大长度，超过时返回413，0表示DefaultMaxBodyBytes
+	MaxBodyBytes int64
+}
+
+var _ shlev.DrainHandler = (*Server)(nil)
+
+// NewServer 使用默认限制创建服务器
+func NewServer(handler Handler) *Server {
+	return &Server{Handler: handler}
+}
+
+// ListenAndServe 在addr上开启HTTP服务器，阻塞直到服务器关闭
+func ListenAndServe(addr string, handler Handler, opts ...shlev.OptionFunc) error {
+	return shlev.Run(NewServer(handler), addr, opts...)
+}
+
+func (s *Server) maxHeaderBytes() int {
+	if s.MaxHeaderBytes <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	return s.MaxHeaderBytes
+}
+
+func (s *Server) maxBodyBytes() int64 {
+	if s.MaxBodyBytes <= 0 {
+		return DefaultMaxBodyBytes
+	}
+	return s.MaxBodyBytes
+}
+
+func (s *Server) OnBoot(*shlev.Server) error { return nil }
+
+func (s *Server) OnShutdown(*shlev.Server) {}
+
+func (s *Server) OnConnectionClose(*shlev.Conn, error) {}
+
+func (s *Server) OnOpen(c *shlev.Conn, _ error) ([]byte, shlev.HandleResult) {
+	c.SetContext(&connState{})
+	return nil, shlev.None
+}
+
+// OnDrain 服务器优雅关闭时，空闲的连接直接关闭，正在接收请求的连接在响应之后关闭
+func (s *Server) OnDrain(c *shlev.Conn) {
+	st, ok := c.Context().(*connState)
+	if !ok {
+		return
+	}
+	st.draining = true
+	if st.stage == stageHeader && st.scanned == 0 && c.InboundBuffered() == 0 {
+		st.closed = true
+		_ = c.Close()
+	}
+}
+
+// OnTraffic 依次处理接收缓冲区中所有完整的请求，不完整的请求留到下一次
+func (s *Server) OnTraffic(c *shlev.Conn) shlev.HandleResult {
+	st, ok := c.Context().(*connState)
+	if !ok {
+		return shlev.Close
+	}
+	for !st.closed {
+		req, err := st.next(c, s)
+		if err != nil {
+			// 请求头已经解析完时st.req是出错的请求，HEAD请求的错误响应不带响应体
+			s.writeError(c, st.req, err)
+			st.closed = true
+			break
+		}
+		if req == nil {
+			return shlev.None
+		}
+		if !s.serve(c, req, st.draining) {
+			st.closed = true
+		}
+	}
+	// 等响应发送完再关闭连接，之后收到的数据都丢弃
+	_, _ = c.Discard(-1)
+	_ = c.Close()
+	return shlev.None
+}
+
+// 处理一个请求，返回是否保持连接，服务器正在关闭时响应之后关闭连接
+func (s *Server) serve(c *shlev.Conn, req *Request, draining bool) (keepAlive bool) {
+	w := newResponse(c, req)
+	w.closeAfter = w.closeAfter || draining
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Error(fmt.Sprintf("http handler panic: %v, %s %s", p, req.Method, req.RequestURI))
+			if !w.chunked {
+				s.writeError(c, req, &requestError{code: nethttp.StatusInternalServerError})
+			}
+			keepAlive = false
+		}
+	}()
+	s.Handler.ServeHTTP(w, req)
+	w.finish()
+	return !w.closeAfter
+}
+
+// 请求有Expect: 100-continue时先让客户端发送请求体
+func (s *Server) expectContinue(c *shlev.Conn, req *Request) *requestError {
+	expect := req.Header.Get("Expect")
+	if expect == "" {
+		return nil
+	}
+	if !strings.EqualFold(expect, "100-continue") {
+		return &requestError{code: nethttp.StatusExpectationFailed, msg: "unsupported expectation"}
+	}
+	if req.ProtoMinor >= 1 && req.ContentLength != 0 && c.InboundBuffered() == 0 {
+		_, _ = c.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	}
+	return nil
+}
+
+// 请求不合法时返回错误响应并关闭连接
+func (s *Server) writeError(c *shlev.Conn, req *Request, err *requestError) {
+	text := nethttp.StatusText(err.code)
+	if err.msg != "" {
+		text += ": " + err.msg
+	}
+	if req != nil && req.Method == nethttp.MethodHead {
+		text = ""
+	}
+	resp := "HTTP/1.1 " + strconv.Itoa(err.code) + " " + nethttp.StatusText(err.code) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Connection: close\r\n" +
+		"Content-Length: " + strconv.Itoa(len(text)) + "\r\n\r\n" + text
+	_, _ = c.Write([]byte(resp))
+}
@@ -0,0 +1,257 @@
+package http_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/http"
+	"github.com/Senhnn/shlev/tools/logger"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, s *http.Server) string {
+	srv, err := shlev.Start(s, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = srv.Shutdown(context.Background()) })
+	return srv.Addr().String()
+}
+
+// 返回请求的方法、路径和请求体
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Method", r.Method)
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = fmt.Fprintf(w, "%s %s %s", r.URL.Path, r.Body, r.Trailer.Get("X-Sum"))
+})
+
+// 记录请求使用的本地地址
+func withConnTrace(ctx context.Context, local *string) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { *local = info.Conn.LocalAddr().String() },
+	})
+}
+
+// 日志写到临时目录，运行测试不会在包目录下留下shlev_net.log
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "shlev-log")
+	if err != nil {
+		panic(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "shlev_net.log"))
+	if err != nil {
+		panic(err)
+	}
+	logger.SetOutput(f)
+	code := m.Run()
+	_ = f.Close()
+	if code == 0 {
+		_ = os.RemoveAll(dir)
+	} else {
+		fmt.Println("log:", f.Name())
+	}
+	os.Exit(code)
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	addr := startServer(t, http.NewServer(echoHandler))
+	client := &nethttp.Client{Timeout: 2 * time.Second}
+
+	var remote string
+	for i := 0; i < 3; i++ {
+		req, _ := nethttp.NewRequest(nethttp.MethodPost, "http://"+addr+"/echo", strings.NewReader(fmt.Sprint(i)))
+		var conn string
+		req = req.WithContext(withConnTrace(req.Context(), &conn))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if want := fmt.Sprintf("/echo %d ", i); string(body) != want || resp.Header.Get("X-Method") != "POST" {
+			t.Fatalf("got %q, want %q", body, want)
+		}
+		// 同一个连接上处理所有请求
+		if remote != "" && conn != remote {
+			t.Fatalf("connection is not reused: %s, %s", remote, conn)
+		}
+		remote = conn
+	}
+}
+
+func TestServerChunked(t *testing.T) {
+	addr := startServer(t, http.NewServer(echoHandler))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	req := "POST /chunked HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 11\r\n\r\n"
+	// 一个字节一个字节地发送
+	for i := range req {
+		_, _ = conn.Write([]byte(req[i : i+1]))
+	}
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "/chunked hello world 11" {
+		t.Fatalf("got %q", body)
+	}
+}
+
+func TestServerPipelining(t *testing.T) {
+	addr := startServer(t, http.NewServer(echoHandler))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// 多个请求一起发送，按顺序响应，最后一个请求之后关闭连接
+	_, _ = conn.Write([]byte("GET /a HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nHost: test\r\nContent-Length: 3\r\n\r\nfoo" +
+		"HEAD /c HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"GET /d HTTP/1.0\r\n\r\n" +
+		"GET /ignored HTTP/1.1\r\nHost: test\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	for _, want := range []struct{ method, body string }{{"GET", "/a  "}, {"POST", "/b foo "}, {"HEAD", ""}, {"GET", "/d  "}} {
+		resp, err := nethttp.ReadResponse(r, &nethttp.Request{Method: want.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != want.body || resp.Header.Get("X-Method") != want.method {
+			t.Fatalf("got %s %q, want %s %q", resp.Header.Get("X-Method"), body, want.method, want.body)
+		}
+	}
+	// HTTP/1.0的请求没有keep-alive，响应之后关闭连接
+	if _, err = r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection should be closed, got %v", err)
+	}
+}
+
+func TestServerFlush(t *testing.T) {
+	addr := startServer(t, http.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, "part%d;", i)
+			w.(http.Flusher).Flush()
+		}
+	})))
+	resp, err := nethttp.Get("http://" + addr + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "part0;part1;part2;" || len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("got %q, %v", body, resp.TransferEncoding)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	addr := startServer(t, &http.Server{Handler: echoHandler, MaxHeaderBytes: 128, MaxBodyBytes: 8})
+	cases := []struct {
+		name string
+		req  string
+		code int
+	}{
+		{"header", "GET / HTTP/1.1\r\nHost: test\r\nX-Long: " + strings.Repeat("a", 200) + "\r\n\r\n", 431},
+		{"body", "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 9\r\n\r\n", 413},
+		{"chunked body", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\n", 413},
+		{"no host", "GET / HTTP/1.1\r\n\r\n", 400},
+		{"smuggling", "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n", 400},
+		{"version", "GET / HTTP/2.0\r\nHost: test\r\n\r\n", 505},
+		// chunk长度只接受十六进制数字
+		{"chunk sign", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n+1\r\na\r\n0\r\n\r\n", 400},
+		{"chunk space", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n 1\r\na\r\n0\r\n\r\n", 400},
+		{"chunk empty", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n;ext\r\na\r\n0\r\n\r\n", 400},
+		// trailer正好用完剩下的长度时，之后的数据不能让请求一直等下去
+		{"trailer", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-T: " +
+			strings.Repeat("a", 123) + "\r\nX-More: b\r\n\r\n", 431},
+		{"trailer with crlf", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-T: " +
+			strings.Repeat("a", 121) + "\r\n" + strings.Repeat("b", 64), 431},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+			_, _ = conn.Write([]byte(tc.req))
+			resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.code || !resp.Close {
+				t.Fatalf("got status %d close %v, want %d", resp.StatusCode, resp.Close, tc.code)
+			}
+		})
+	}
+}
+
+func TestServerHeadError(t *testing.T) {
+	addr := startServer(t, http.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})))
+	// HEAD请求的错误响应不带响应体，Content-Length为0
+	for _, tc := range []struct {
+		req    string
+		status string
+	}{
+		{"HEAD / HTTP/1.1\r\nHost: test\r\n\r\n", "500"},
+		{"HEAD / HTTP/1.1\r\nHost: test\r\nExpect: later\r\n\r\n", "417"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		_, _ = conn.Write([]byte(tc.req))
+		resp, err := io.ReadAll(conn)
+		_ = conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(resp), "HTTP/1.1 "+tc.status+" ") || !strings.HasSuffix(string(resp), "Content-Length: 0\r\n\r\n") {
+			t.Fatalf("got %q", resp)
+		}
+	}
+}
+
+func TestServerHeaderInjection(t *testing.T) {
+	addr := startServer(t, http.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 把用户输入写入响应头
+		w.Header().Set("X-Echo", r.URL.Query().Get("v"))
+		w.Header()["Bad\r\nName"] = []string{"x"}
+	})))
+	resp, err := nethttp.Get("http://" + addr + "/?v=a%0D%0ASet-Cookie:%20evil=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if got := resp.Header.Get("X-Echo"); got != "a  Set-Cookie: evil=1" || resp.Header.Get("Set-Cookie") != "" {
+		t.Fatalf("response was split: X-Echo %q, header %v", got, resp.Header)
+	}
+	for k := range resp.Header {
+		if strings.Contains(k, "Bad") {
+			t.Fatalf("invalid header name %q was sent", k)
+		}
+	}
+}
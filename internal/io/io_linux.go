@@ -2,11 +2,17 @@ package io
 
 import "golang.org/x/sys/unix"
 
-// Writev 封装writev接口
+// IovMax 一次writev/readv最多的iovec数量，linux为1024
+const IovMax = 1024
+
+// Writev 封装writev接口，超过IovMax的部分不写，由调用方下次再写
 func Writev(fd int, iov [][]byte) (int, error) {
 	if len(iov) == 0 {
 		return 0, nil
 	}
+	if len(iov) > IovMax {
+		iov = iov[:IovMax]
+	}
 	return unix.Writev(fd, iov)
 }
 
@@ -15,5 +21,8 @@ func Readv(fd int, iov [][]byte) (int, error) {
 	if len(iov) == 0 {
 		return 0, nil
 	}
+	if len(iov) > IovMax {
+		iov = iov[:IovMax]
+	}
 	return unix.Readv(fd, iov)
 }
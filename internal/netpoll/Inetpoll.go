@@ -1,12 +1,25 @@
 package netpoll
 
-import "github.com/Senhnn/shlev/tools/task_queue"
+import (
+	"github.com/Senhnn/shlev/tools/task_queue"
+	"time"
+)
+
+// PollTimer 轮询器的定时器，Polling根据Next计算epoll_wait的超时时间，每轮处理完事件之后调用Expire
+type PollTimer interface {
+	// Next 距离最近一个定时任务到期的时间，小于0表示当前没有定时任务
+	Next() time.Duration
+	// Expire 执行所有已经到期的定时任务
+	Expire() error
+}
 
 type Netpoller interface {
 	// Delete 删除套接字
 	Delete(fd int) error
 	// AddRead 添加读
 	AddRead(fd int) error
+	// AddReadWrite 添加读写
+	AddReadWrite(fd int) error
 	// AddWrite 添加写
 	AddWrite(fd int) error
 	// ModRead 改为读
@@ -23,4 +36,10 @@ type Netpoller interface {
 	AddUrgentTask(task_queue.TaskFunc, interface{}) error
 	// AddTask 添加普通任务
 	AddTask(task_queue.TaskFunc, interface{}) error
+	// PendingTasks 还没有执行的任务数量，包括紧急任务
+	PendingTasks() int
+	// SetBusyPoll 设置忙轮询窗口，最近一次有事件之后的这段时间内不阻塞等待，0表示不忙轮询
+	SetBusyPoll(time.Duration)
+	// SetTimer 设置定时器，epoll_wait最多阻塞到最近的定时任务到期
+	SetTimer(PollTimer)
 }
@@ -6,8 +6,10 @@ import (
 	"github.com/Senhnn/shlev/tools/shleverror"
 	"github.com/Senhnn/shlev/tools/task_queue"
 	"golang.org/x/sys/unix"
+	"math"
 	"os"
 	"sync/atomic"
+	"time"
 )
 
 // Epoller 需要实现 Netpoller 接口
@@ -18,8 +20,13 @@ type Epoller struct {
 	taskQueue       task_queue.AsyncTaskQueue // 低优先级任务队列
 	urgentTaskQueue task_queue.AsyncTaskQueue // 高优先级任务队列
 	wakeUpCall      int32                     // 0：不被唤醒，1：被唤醒
+	busyPoll        time.Duration             // 忙轮询窗口，从最近一次有事件开始计算
+	timer           PollTimer                 // 定时器，决定epoll_wait的超时时间
 }
 
+// epoll_wait，测试时替换，用于检查每次等待的超时时间
+var epollWait = unix.EpollWait
+
 // NewEpoller 创建新的空 Epoller
 func NewEpoller() *Epoller {
 	return &Epoller{
@@ -73,21 +80,62 @@ func (e *Epoller) Init() (err error) {
 	return nil
 }
 
+// SetBusyPoll 设置忙轮询窗口，最近一次有事件之后的d时间内epoll_wait不阻塞。
+// 窗口从最近一次epoll_wait返回事件的时间开始计算，不是每次阻塞之前都先空转d，一直没有事件时直接阻塞
+func (e *Epoller) SetBusyPoll(d time.Duration) {
+	e.busyPoll = d
+}
+
+// SetTimer 设置定时器
+func (e *Epoller) SetTimer(t PollTimer) {
+	e.timer = t
+}
+
+// pollTimeout 计算epoll_wait的超时时间（毫秒），-1表示一直阻塞直到有事件或者被eventFd唤醒
+func (e *Epoller) pollTimeout(lastActive time.Time) int {
+	// 忙轮询窗口内不阻塞，降低延迟
+	if e.busyPoll > 0 && time.Since(lastActive) < e.busyPoll {
+		return 0
+	}
+	if e.timer == nil {
+		return -1
+	}
+	d := e.timer.Next()
+	if d < 0 {
+		return -1
+	}
+	// 向上取整到毫秒，避免定时任务到期之前提前醒来导致空转
+	msec := (d + time.Millisecond - 1) / time.Millisecond
+	if msec > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(msec)
+}
+
 // Polling 网络IO事件
 func (e *Epoller) Polling(callback func(fd int, ev uint32) error) error {
 	eventsList := newEventsList()
 	// 是否执行任务
 	var isExecTask bool
+	// 最近一次处理事件的时间，用于忙轮询
+	var lastActive time.Time
 
 	for {
-		n, err := unix.EpollWait(e.epfd, eventsList.events, 0 /*非阻塞调用*/)
+		timeout := 0
+		if !isExecTask {
+			timeout = e.pollTimeout(lastActive)
+		}
+		n, err := epollWait(e.epfd, eventsList.events, timeout)
 		// unix.EINTR：这个调用被信号打断
-		if n == 0 || (n < 0 && err == unix.EINTR) {
+		if n < 0 && err == unix.EINTR {
 			continue
 		} else if err != nil {
 			logger.Error(fmt.Sprintf("Poll error occurs in epoll: %s", os.NewSyscallError("epoll_wait", err).Error()))
 			return err
 		}
+		if n > 0 && e.busyPoll > 0 {
+			lastActive = time.Now()
+		}
 
 		// 遍历返回的fd，处理事件
 		for i := 0; i < n; i++ {
@@ -111,6 +159,7 @@ func (e *Epoller) Polling(callback func(fd int, ev uint32) error) error {
 
 		// 处理完所有紧急任务
 		if isExecTask {
+			isExecTask = false
 			task := e.urgentTaskQueue.Dequeue()
 			for task != nil {
 				err = task.Run(task.Arg)
@@ -149,10 +198,24 @@ func (e *Epoller) Polling(callback func(fd int, ev uint32) error) error {
 				switch err {
 				case nil, unix.EAGAIN:
 				default:
+					// 唤醒失败，下一轮不阻塞，直接处理剩余任务
 					isExecTask = true
 				}
 			}
 		}
+
+		// 执行到期的定时任务
+		if e.timer != nil {
+			err = e.timer.Expire()
+			switch err {
+			case nil:
+			case shleverror.ErrServerShutdown:
+				logger.Error("Poll exec timer error:", err)
+				return err
+			default:
+				logger.Warn("Poll timer error:", err)
+			}
+		}
 	}
 }
 
@@ -269,3 +332,8 @@ func (p *Epoller) AddTask(fn task_queue.TaskFunc, arg interface{}) (err error) {
 	}
 	return os.NewSyscallError("write", err)
 }
+
+// PendingTasks 两个任务队列中还没有执行的任务数量
+func (e *Epoller) PendingTasks() int {
+	return e.taskQueue.Len() + e.urgentTaskQueue.Len()
+}
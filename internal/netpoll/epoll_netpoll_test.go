@@ -0,0 +1,218 @@
+package netpoll
+
+import (
+	"fmt"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 一次epoll_wait调用
+type pollWait struct {
+	at      time.Time
+	timeout int
+}
+
+// 替换epollWait，记录每次调用的时间和超时时间
+type waitRecorder struct {
+	mu    sync.Mutex
+	waits []pollWait
+}
+
+func recordWaits(t *testing.T) *waitRecorder {
+	r := &waitRecorder{}
+	epollWait = func(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+		r.mu.Lock()
+		r.waits = append(r.waits, pollWait{at: time.Now(), timeout: msec})
+		r.mu.Unlock()
+		return unix.EpollWait(epfd, events, msec)
+	}
+	t.Cleanup(func() { epollWait = unix.EpollWait })
+	return r
+}
+
+func (r *waitRecorder) snapshot() []pollWait {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]pollWait(nil), r.waits...)
+}
+
+// 在后台运行Polling，测试结束时通过紧急任务让它退出
+func startPolling(t *testing.T, busyPoll time.Duration, timer PollTimer) *Epoller {
+	e := NewEpoller()
+	if err := e.Init(); err != nil {
+		t.Fatal(err)
+	}
+	e.SetBusyPoll(busyPoll)
+	e.SetTimer(timer)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Polling(func(int, uint32) error { return nil })
+	}()
+	t.Cleanup(func() {
+		_ = e.AddUrgentTask(func(interface{}) error { return shleverror.ErrServerShutdown }, nil)
+		if err := <-done; err != shleverror.ErrServerShutdown {
+			t.Errorf("Polling returned %v", err)
+		}
+		_ = e.Close()
+	})
+	return e
+}
+
+// 添加任务，返回任务执行的时间
+func runTask(t *testing.T, e *Epoller) time.Time {
+	ran := make(chan time.Time, 1)
+	if err := e.AddTask(func(interface{}) error {
+		ran <- time.Now()
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case at := <-ran:
+		return at
+	case <-time.After(time.Second):
+		t.Fatal("task is not executed")
+	}
+	return time.Time{}
+}
+
+// 日志写到临时目录，运行测试不会在包目录下留下shlev_net.log
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "shlev-log")
+	if err != nil {
+		panic(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "shlev_net.log"))
+	if err != nil {
+		panic(err)
+	}
+	logger.SetOutput(f)
+	code := m.Run()
+	_ = f.Close()
+	if code == 0 {
+		_ = os.RemoveAll(dir)
+	} else {
+		fmt.Println("log:", f.Name())
+	}
+	os.Exit(code)
+}
+
+func TestPollingBlocksWhenIdle(t *testing.T) {
+	r := recordWaits(t)
+	e := startPolling(t, 0, nil)
+
+	// 没有事件、任务和定时器时一直阻塞，不会反复调用epoll_wait
+	time.Sleep(50 * time.Millisecond)
+	waits := r.snapshot()
+	if len(waits) != 1 || waits[0].timeout != -1 {
+		t.Fatalf("idle poller waits %+v, want a single blocking wait", waits)
+	}
+
+	// eventFd唤醒阻塞的epoll_wait执行任务，之后继续阻塞
+	start := time.Now()
+	if d := runTask(t, e).Sub(start); d > 20*time.Millisecond {
+		t.Fatalf("task is executed %v after it is added", d)
+	}
+	time.Sleep(20 * time.Millisecond)
+	waits = r.snapshot()
+	if len(waits) != 2 || waits[1].timeout != -1 {
+		t.Fatalf("poller waits %+v after the task, want one more blocking wait", waits)
+	}
+}
+
+// 只有一个定时任务的定时器，只在轮询的goroutine中访问
+type onceTimer struct {
+	deadline time.Time
+	fired    chan time.Time
+}
+
+func (tm *onceTimer) Next() time.Duration {
+	if tm.fired == nil {
+		return -1
+	}
+	if d := time.Until(tm.deadline); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (tm *onceTimer) Expire() error {
+	if now := time.Now(); tm.fired != nil && !now.Before(tm.deadline) {
+		tm.fired <- now
+		tm.fired = nil
+	}
+	return nil
+}
+
+func TestPollingWakesForTimer(t *testing.T) {
+	r := recordWaits(t)
+	fired := make(chan time.Time, 1)
+	timer := &onceTimer{deadline: time.Now().Add(30 * time.Millisecond), fired: fired}
+	startPolling(t, 0, timer)
+
+	var at time.Time
+	select {
+	case at = <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer is not expired")
+	}
+	// 定时任务不会提前执行，也不会等到下一次事件才执行
+	if d := at.Sub(timer.deadline); d < 0 || d > 20*time.Millisecond {
+		t.Fatalf("timer is expired %v after its deadline", d)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	waits := r.snapshot()
+	if len(waits) == 0 || waits[0].timeout <= 0 || waits[0].timeout > 30 {
+		t.Fatalf("first wait %+v, want a timeout up to the deadline", waits)
+	}
+	// 定时任务执行完之后没有下一个定时任务，恢复阻塞
+	if last := waits[len(waits)-1]; last.timeout != -1 || len(waits) > 4 {
+		t.Fatalf("poller waits %+v after the timer, want a blocking wait", waits)
+	}
+}
+
+func TestPollingBusyPollWindow(t *testing.T) {
+	const window = 30 * time.Millisecond
+	r := recordWaits(t)
+	e := startPolling(t, window, nil)
+
+	// 还没有任何事件，直接阻塞，不会先空转一个窗口
+	time.Sleep(20 * time.Millisecond)
+	if waits := r.snapshot(); len(waits) != 1 || waits[0].timeout != -1 {
+		t.Fatalf("poller waits %+v before any event, want a single blocking wait", waits)
+	}
+
+	// 第二个事件在窗口内到达，窗口从第二个事件重新开始计算
+	first := runTask(t, e)
+	time.Sleep(window / 3)
+	last := runTask(t, e)
+	time.Sleep(window + 30*time.Millisecond)
+
+	waits := r.snapshot()
+	var spinAfterFirstWindow bool
+	for _, w := range waits {
+		if w.timeout != 0 {
+			continue
+		}
+		// 超时时间为0只能出现在最近一次事件之后的窗口内
+		if w.at.Before(first) || w.at.After(last.Add(window+5*time.Millisecond)) {
+			t.Fatalf("busy wait at %v after the first event, last event at %v", w.at.Sub(first), last.Sub(first))
+		}
+		if w.at.After(first.Add(window)) {
+			spinAfterFirstWindow = true
+		}
+	}
+	if !spinAfterFirstWindow {
+		t.Fatal("busy-poll window is not measured from the last event")
+	}
+	if w := waits[len(waits)-1]; w.timeout != -1 {
+		t.Fatalf("last wait %+v, want blocking after the window", w)
+	}
+}
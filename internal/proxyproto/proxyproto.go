@@ -0,0 +1,241 @@
+// Package proxyproto 解析HAProxy PROXY协议的v1（文本）和v2（二进制）头部，
+// 参看https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"hash/crc32"
+	"net"
+	"strconv"
+)
+
+const (
+	// v1头部的最大长度，包括结尾的CRLF
+	maxV1Length = 107
+	// v2头部固定部分的长度
+	v2HeaderLength = 16
+
+	// TLVTypeCRC32C 头部的CRC32C校验和
+	TLVTypeCRC32C = 0x03
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Header 解析出的PROXY协议头部
+type Header struct {
+	// Version 协议版本，1或者2
+	Version int
+
+	// Local 连接由代理自己发起，比如健康检查，没有客户端地址，对应v2的LOCAL命令、v1的UNKNOWN和v2的UNSPEC地址族
+	Local bool
+
+	// Source 客户端地址，Destination 客户端连接的代理地址，Local为true时为nil
+	Source, Destination net.Addr
+
+	// TLVs v2头部中的扩展字段，Value指向解析的缓冲区
+	TLVs []TLV
+}
+
+// TLV v2头部中的扩展字段
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Parse 从b的开头解析一个头部，返回头部和它的长度。
+// 数据不完整时返回shleverror.ErrIncompletePacket，不是合法的头部时返回shleverror.ErrInvalidProxyHeader
+func Parse(b []byte) (*Header, int, error) {
+	switch {
+	case hasPrefix(b, v2Signature):
+		if len(b) < v2HeaderLength {
+			return nil, 0, shleverror.ErrIncompletePacket
+		}
+		return parseV2(b)
+	case hasPrefix(b, v1Prefix):
+		if len(b) < len(v1Prefix) {
+			return nil, 0, shleverror.ErrIncompletePacket
+		}
+		return parseV1(b)
+	}
+	return nil, 0, shleverror.ErrInvalidProxyHeader
+}
+
+// b是prefix的前缀或者以prefix开头
+func hasPrefix(b, prefix []byte) bool {
+	if len(b) < len(prefix) {
+		return bytes.HasPrefix(prefix, b)
+	}
+	return bytes.HasPrefix(b, prefix)
+}
+
+// 解析v1头部：PROXY TCP4 源地址 目的地址 源端口 目的端口\r\n，或者PROXY UNKNOWN ...\r\n
+func parseV1(b []byte) (*Header, int, error) {
+	limit := len(b)
+	if limit > maxV1Length {
+		limit = maxV1Length
+	}
+	i := bytes.Index(b[:limit], []byte("\r\n"))
+	if i < 0 {
+		if len(b) >= maxV1Length {
+			return nil, 0, shleverror.ErrInvalidProxyHeader
+		}
+		return nil, 0, shleverror.ErrIncompletePacket
+	}
+	fields := bytes.Split(b[len(v1Prefix):i], []byte(" "))
+	h := &Header{Version: 1}
+	if string(fields[0]) == "UNKNOWN" {
+		h.Local = true
+		return h, i + 2, nil
+	}
+	if len(fields) != 5 {
+		return nil, 0, shleverror.ErrInvalidProxyHeader
+	}
+	var ipLen int
+	switch string(fields[0]) {
+	case "TCP4":
+		ipLen = net.IPv4len
+	case "TCP6":
+		ipLen = net.IPv6len
+	default:
+		return nil, 0, shleverror.ErrInvalidProxyHeader
+	}
+	src, srcOK := parseV1Addr(fields[1], fields[3], ipLen)
+	dst, dstOK := parseV1Addr(fields[2], fields[4], ipLen)
+	if !srcOK || !dstOK {
+		return nil, 0, shleverror.ErrInvalidProxyHeader
+	}
+	h.Source, h.Destination = src, dst
+	return h, i + 2, nil
+}
+
+func parseV1Addr(ip, port []byte, ipLen int) (*net.TCPAddr, bool) {
+	addr := net.ParseIP(string(ip))
+	if addr == nil {
+		return nil, false
+	}
+	// TCP4必须是点分十进制，TCP6必须是IPv6的写法
+	if isV4 := bytes.IndexByte(ip, ':') < 0; isV4 != (ipLen == net.IPv4len) {
+		return nil, false
+	}
+	if ipLen == net.IPv4len {
+		addr = addr.To4()
+	}
+	p, err := strconv.Atoi(string(port))
+	if err != nil || p < 0 || p > 65535 || (len(port) > 1 && port[0] == '0') {
+		return nil, false
+	}
+	return &net.TCPAddr{IP: addr, Port: p}, true
+}
+
+// 解析v2头部：12字节签名、版本和命令、地址族和协议、2字节长度，之后是地址和TLV
+func parseV2(b []byte) (*Header, int, error) {
+	verCmd, famProto := b[12], b[13]
+	if verCmd>>4 != 2 {
+		return nil, 0, shleverror.ErrInvalidProxyHeader
+	}
+	total := v2HeaderLength + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < total {
+		return nil, 0, shleverror.ErrIncompletePacket
+	}
+	h := &Header{Version: 2}
+	switch verCmd & 0xf {
+	case 0x0:
+		h.Local = true
+	case 0x1:
+	default:
+		return nil, 0, shleverror.ErrInvalidProxyHeader
+	}
+
+	payload := b[v2HeaderLength:total]
+	var addrLen int
+	switch famProto >> 4 {
+	case 0x0:
+		// UNSPEC，没有地址
+		h.Local = true
+	case 0x1:
+		addrLen = 2*net.IPv4len + 4
+	case 0x2:
+		addrLen = 2*net.IPv6len + 4
+	case 0x3:
+		addrLen = 2 * 108
+	default:
+		return nil, 0, shleverror.ErrInvalidProxyHeader
+	}
+	proto := famProto & 0xf
+	if proto > 0x2 || len(payload) < addrLen {
+		return nil, 0, shleverror.ErrInvalidProxyHeader
+	}
+	if !h.Local {
+		if proto == 0x0 {
+			h.Local = true
+		} else {
+			h.Source, h.Destination = parseV2Addrs(famProto>>4, proto, payload[:addrLen])
+		}
+	}
+
+	for pos := v2HeaderLength + addrLen; pos < total; {
+		if total-pos < 3 {
+			return nil, 0, shleverror.ErrInvalidProxyHeader
+		}
+		n := int(binary.BigEndian.Uint16(b[pos+1:]))
+		if total-pos-3 < n {
+			return nil, 0, shleverror.ErrInvalidProxyHeader
+		}
+		tlv := TLV{Type: b[pos], Value: b[pos+3 : pos+3+n]}
+		if tlv.Type == TLVTypeCRC32C && !checkCRC32C(b[:total], pos+3, n) {
+			return nil, 0, shleverror.ErrInvalidProxyHeader
+		}
+		h.TLVs = append(h.TLVs, tlv)
+		pos += 3 + n
+	}
+	return h, total, nil
+}
+
+// 按地址族和协议解析源地址和目的地址
+func parseV2Addrs(family, proto byte, b []byte) (src, dst net.Addr) {
+	if family == 0x3 {
+		srcAddr := &net.UnixAddr{Name: cString(b[:108]), Net: "unix"}
+		dstAddr := &net.UnixAddr{Name: cString(b[108:]), Net: "unix"}
+		if proto == 0x2 {
+			srcAddr.Net, dstAddr.Net = "unixgram", "unixgram"
+		}
+		return srcAddr, dstAddr
+	}
+	ipLen := net.IPv4len
+	if family == 0x2 {
+		ipLen = net.IPv6len
+	}
+	srcIP := net.IP(append([]byte(nil), b[:ipLen]...))
+	dstIP := net.IP(append([]byte(nil), b[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(b[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(b[2*ipLen+2:]))
+	if proto == 0x2 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// 校验CRC32C，计算时整个头部中校验和字段按0处理，校验和字段从header[offset]开始，长度为n
+func checkCRC32C(header []byte, offset, n int) bool {
+	if n != 4 {
+		return false
+	}
+	want := binary.BigEndian.Uint32(header[offset:])
+	crc := crc32.Update(0, crc32cTable, header[:offset])
+	crc = crc32.Update(crc, crc32cTable, []byte{0, 0, 0, 0})
+	crc = crc32.Update(crc, crc32cTable, header[offset+4:])
+	return crc == want
+}
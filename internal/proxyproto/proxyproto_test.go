@@ -0,0 +1,159 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/Senhnn/shlev/internal/proxyproto"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+)
+
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// 构造v2头部，tlvs直接追加在地址之后
+func v2(verCmd, famProto byte, addr []byte, tlvs ...[]byte) []byte {
+	payload := append([]byte(nil), addr...)
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv...)
+	}
+	b := append([]byte(nil), signature...)
+	b = append(b, verCmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func tlv(typ byte, value []byte) []byte {
+	b := []byte{typ, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(value)))
+	return append(b, value...)
+}
+
+// 源地址10.0.0.1:1234，目的地址10.0.0.2:443
+var inet4 = []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x04, 0xd2, 0x01, 0xbb}
+
+// 在头部的最后加上CRC32C
+func withCRC(b []byte) []byte {
+	b = append(b, tlv(proxyproto.TLVTypeCRC32C, make([]byte, 4))...)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+	binary.BigEndian.PutUint32(b[len(b)-4:], crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+	return b
+}
+
+func TestParse(t *testing.T) {
+	ipv6 := make([]byte, 36)
+	ipv6[15], ipv6[31], ipv6[33], ipv6[35] = 1, 2, 80, 81
+	unix := make([]byte, 216)
+	copy(unix, "/tmp/src.sock")
+	copy(unix[108:], "/tmp/dst.sock")
+
+	cases := []struct {
+		name  string
+		data  []byte
+		n     int    // 头部的长度
+		local bool   // 是否是LOCAL
+		src   string // 源地址
+		tlvs  int    // TLV的个数
+	}{
+		{name: "v1 tcp4", data: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1234 443\r\nGET"), n: 39, src: "10.0.0.1:1234"},
+		{name: "v1 tcp6", data: []byte("PROXY TCP6 ::1 ::2 1234 443\r\n"), n: 29, src: "[::1]:1234"},
+		{name: "v1 unknown", data: []byte("PROXY UNKNOWN ::1 ::2 1 2\r\n"), n: 27, local: true},
+		{name: "v2 tcp4", data: append(v2(0x21, 0x11, inet4), "GET"...), n: 28, src: "10.0.0.1:1234"},
+		{name: "v2 udp6", data: v2(0x21, 0x22, ipv6), n: 52, src: "[::1]:80"},
+		{name: "v2 unix", data: v2(0x21, 0x31, unix), n: 232, src: "/tmp/src.sock"},
+		{name: "v2 local", data: v2(0x20, 0x11, inet4), n: 28, local: true},
+		{name: "v2 unspec", data: v2(0x21, 0x00, nil), n: 16, local: true},
+		{name: "v2 tlvs", data: v2(0x21, 0x11, inet4, tlv(0x01, []byte("h2")), tlv(0x02, nil)), n: 36, src: "10.0.0.1:1234", tlvs: 2},
+		{name: "v2 crc", data: withCRC(v2(0x21, 0x11, inet4)), n: 35, src: "10.0.0.1:1234", tlvs: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, n, err := proxyproto.Parse(tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tc.n || h.Local != tc.local || len(h.TLVs) != tc.tlvs {
+				t.Fatalf("got length %d local %v tlvs %d", n, h.Local, len(h.TLVs))
+			}
+			if tc.local {
+				if h.Source != nil || h.Destination != nil {
+					t.Fatalf("LOCAL header has addresses %v %v", h.Source, h.Destination)
+				}
+				return
+			}
+			if h.Source.String() != tc.src {
+				t.Fatalf("got source %v, want %s", h.Source, tc.src)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	full := v2(0x21, 0x11, inet4)
+	badCRC := withCRC(v2(0x21, 0x11, inet4))
+	badCRC[len(badCRC)-1] ^= 1
+	// 长度为5的CRC32C
+	longCRC := v2(0x21, 0x11, inet4, tlv(proxyproto.TLVTypeCRC32C, make([]byte, 5)))
+
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		// 数据不完整时等待更多的数据
+		{"empty", nil, shleverror.ErrIncompletePacket},
+		{"v1 prefix", []byte("PROX"), shleverror.ErrIncompletePacket},
+		{"v1 no crlf", []byte("PROXY TCP4 10.0.0.1"), shleverror.ErrIncompletePacket},
+		{"v2 signature", signature[:5], shleverror.ErrIncompletePacket},
+		{"v2 fixed header", full[:14], shleverror.ErrIncompletePacket},
+		{"v2 addresses", full[:len(full)-1], shleverror.ErrIncompletePacket},
+		// 声明的长度超过已经收到的数据
+		{"v2 oversized length", append(full[:14:14], 0xff, 0xff), shleverror.ErrIncompletePacket},
+
+		{"not proxy", []byte("GET / HTTP/1.1\r\n"), shleverror.ErrInvalidProxyHeader},
+		{"bad signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), full[12:]...), shleverror.ErrInvalidProxyHeader},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120)), shleverror.ErrInvalidProxyHeader},
+		{"v1 empty", []byte("PROXY \r\n"), shleverror.ErrInvalidProxyHeader},
+		{"v1 family", []byte("PROXY UDP4 10.0.0.1 10.0.0.2 1234 443\r\n"), shleverror.ErrInvalidProxyHeader},
+		{"v1 fields", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1234\r\n"), shleverror.ErrInvalidProxyHeader},
+		{"v1 address family mismatch", []byte("PROXY TCP4 ::1 ::2 1234 443\r\n"), shleverror.ErrInvalidProxyHeader},
+		{"v1 bad ip", []byte("PROXY TCP4 10.0.0.256 10.0.0.2 1234 443\r\n"), shleverror.ErrInvalidProxyHeader},
+		{"v1 bad port", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 65536 443\r\n"), shleverror.ErrInvalidProxyHeader},
+		{"v1 leading zero port", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 01234 443\r\n"), shleverror.ErrInvalidProxyHeader},
+		{"v2 version", v2(0x11, 0x11, inet4), shleverror.ErrInvalidProxyHeader},
+		{"v2 command", v2(0x22, 0x11, inet4), shleverror.ErrInvalidProxyHeader},
+		{"v2 unknown family", v2(0x21, 0x41, inet4), shleverror.ErrInvalidProxyHeader},
+		{"v2 unknown protocol", v2(0x21, 0x13, inet4), shleverror.ErrInvalidProxyHeader},
+		{"v2 short addresses", v2(0x21, 0x21, inet4), shleverror.ErrInvalidProxyHeader},
+		{"v2 truncated tlv header", v2(0x21, 0x11, inet4, []byte{0x01, 0x00}), shleverror.ErrInvalidProxyHeader},
+		{"v2 tlv overflow", v2(0x21, 0x11, inet4, []byte{0x01, 0x00, 0x05, 'a'}), shleverror.ErrInvalidProxyHeader},
+		{"v2 bad crc", badCRC, shleverror.ErrInvalidProxyHeader},
+		{"v2 crc length", longCRC, shleverror.ErrInvalidProxyHeader},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if h, _, err := proxyproto.Parse(tc.data); err != tc.err {
+				t.Fatalf("got %+v %v, want %v", h, err, tc.err)
+			}
+		})
+	}
+}
+
+// TLV的值指向解析的缓冲区，地址是拷贝出来的
+func TestParseTLVValues(t *testing.T) {
+	b := v2(0x21, 0x11, inet4, tlv(0x01, []byte("h2")), tlv(0xe0, []byte("custom")))
+	h, _, err := proxyproto.Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.TLVs[0].Type != 0x01 || string(h.TLVs[0].Value) != "h2" || h.TLVs[1].Type != 0xe0 || string(h.TLVs[1].Value) != "custom" {
+		t.Fatalf("got TLVs %+v", h.TLVs)
+	}
+	src := h.Source.(*net.TCPAddr)
+	copy(b[16:], bytes.Repeat([]byte{0}, 12))
+	if src.IP.String() != "10.0.0.1" {
+		t.Fatalf("source address changed with the buffer: %v", src)
+	}
+}
@@ -0,0 +1,103 @@
+package socket
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// 根据协议和IP选择地址族，tcp4/udp4只用IPv4，tcp6/udp6只用IPv6，
+// tcp/udp根据地址决定，不带IP时为了兼容之前的行为使用IPv4
+func ipFamily(network string, ip net.IP) int {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return unix.AF_INET
+	case strings.HasSuffix(network, "6"):
+		return unix.AF_INET6
+	case len(ip) == 0 || ip.To4() != nil:
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// 地址族对应的通配地址
+func unspecifiedIP(family int) net.IP {
+	if family == unix.AF_INET6 {
+		return net.IPv6unspecified
+	}
+	return net.IPv4zero
+}
+
+// 把IP和端口转换为对应地址族的套接字地址
+func ipToSockaddr(family int, ip net.IP, port int, zone string) (unix.Sockaddr, error) {
+	switch family {
+	case unix.AF_INET:
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, &net.AddrError{Err: "non-IPv4 address", Addr: ip.String()}
+		}
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return sa, nil
+	case unix.AF_INET6:
+		ip6 := ip.To16()
+		if ip6 == nil {
+			return nil, &net.AddrError{Err: "non-IPv6 address", Addr: ip.String()}
+		}
+		sa := &unix.SockaddrInet6{Port: port, ZoneId: zoneToIndex(zone)}
+		copy(sa.Addr[:], ip6)
+		return sa, nil
+	}
+	return nil, &net.AddrError{Err: "invalid address family", Addr: ip.String()}
+}
+
+// 把套接字地址转换为IP、端口和zone
+func sockaddrToIP(sa unix.Sockaddr) (ip net.IP, port int, zone string, ok bool) {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return sockaddrInet4ToIP(sa), sa.Port, "", true
+	case *unix.SockaddrInet6:
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return ip, sa.Port, indexToZone(sa.ZoneId), true
+	}
+	return nil, 0, "", false
+}
+
+// 把zone（网卡名或者网卡索引）转换为网卡索引
+func zoneToIndex(zone string) uint32 {
+	if zone == "" {
+		return 0
+	}
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		return uint32(ifi.Index)
+	}
+	n, _ := strconv.ParseUint(zone, 10, 32)
+	return uint32(n)
+}
+
+// 把网卡索引转换为zone，找不到网卡时使用索引数字
+func indexToZone(index uint32) string {
+	if index == 0 {
+		return ""
+	}
+	if ifi, err := net.InterfaceByIndex(int(index)); err == nil {
+		return ifi.Name
+	}
+	return strconv.FormatUint(uint64(index), 10)
+}
+
+// 设置IPV6_V6ONLY，只对IPv6套接字生效，tcp6/udp6总是只接收IPv6，tcp/udp由ipv6only决定是否双栈
+func setIPv6Only(fd, family int, network string, ipv6only bool) error {
+	if family != unix.AF_INET6 {
+		return nil
+	}
+	v := 0
+	if ipv6only || strings.HasSuffix(network, "6") {
+		v = 1
+	}
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v))
+}
@@ -18,6 +18,14 @@ var ipv4InIPv6Prefix = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x
 // 监听端口的连接队列和半连接队列长度
 var listenerBacklogMaxSize = 128
 
+// 没有指定backlog时使用默认值
+func listenBacklog(backlog int) int {
+	if backlog <= 0 {
+		return listenerBacklogMaxSize
+	}
+	return backlog
+}
+
 // ListenerBacklogMaxSize 获取服务器配置
 func ListenerBacklogMaxSize() int {
 	fd, err := os.Open("/proc/sys/net/core/somaxconn")
@@ -50,19 +58,32 @@ type SocketOption struct {
 	Opt        int
 }
 
-// TCP4ListenSocket 新建一个监听套接字
-func TCP4ListenSocket(addr string, sockOpts ...SocketOption) (fd FD, netAddr net.Addr, err error) {
-	sa, netAddr, err := GetTCP4SockAddr(addr)
+// TCPListenSocket 新建一个监听套接字，network为tcp、tcp4或者tcp6，
+// 地址为IPv6时ipv6only决定tcp监听套接字是否同时接收IPv4连接（双栈），backlog不大于0时使用默认值
+func TCPListenSocket(network, addr string, ipv6only bool, backlog int, sockOpts ...SocketOption) (fd FD, netAddr net.Addr, err error) {
+	sa, family, netAddr, err := GetTCPSockAddr(network, addr)
 	if err != nil {
 		logger.Error(err)
 		return
 	}
 
-	if fd, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP); err != nil {
+	if fd, err = unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP); err != nil {
 		err = os.NewSyscallError("socket", err)
 		logger.Error(err)
 		return
 	}
+	// 出错时关闭套接字，不返回已经关闭的fd
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+			fd = 0
+		}
+	}()
+
+	if err = setIPv6Only(fd, family, network, ipv6only); err != nil {
+		logger.Error(err)
+		return
+	}
 
 	for _, sockOpt := range sockOpts {
 		if err = sockOpt.SetSockOpt(fd, sockOpt.Opt); err != nil {
@@ -77,40 +98,75 @@ func TCP4ListenSocket(addr string, sockOpts ...SocketOption) (fd FD, netAddr net
 	}
 
 	// 设置backlog
-	err = os.NewSyscallError("listen", unix.Listen(fd, listenerBacklogMaxSize))
+	if err = os.NewSyscallError("listen", unix.Listen(fd, listenBacklog(backlog))); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	// 端口为0时由内核分配端口，取实际绑定的地址
+	if sa, err := unix.Getsockname(fd); err == nil {
+		netAddr = SockaddrToTCPAddr(sa)
+	}
 
-	return fd, netAddr, err
+	return fd, netAddr, nil
 }
 
-// GetTCP4SockAddr 获得出IPV4,TCP套接字的地址
-func GetTCP4SockAddr(addr string) (sa *unix.SockaddrInet4, tcpAddr *net.TCPAddr, err error) {
-	// 解析地址并返回对应结构
-	tcpAddr, err = net.ResolveTCPAddr("tcp", addr)
+// TCPConnectSocket 新建一个非阻塞的tcp套接字并向addr发起连接，不等待连接完成，
+// 之后套接字可写时用SO_ERROR获取连接的结果
+func TCPConnectSocket(network, addr string, sockOpts ...SocketOption) (fd FD, sa unix.Sockaddr, netAddr net.Addr, err error) {
+	sa, family, tcpAddr, err := GetTCPSockAddr(network, addr)
 	if err != nil {
+		return
+	}
+
+	if fd, err = unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP); err != nil {
+		err = os.NewSyscallError("socket", err)
 		logger.Error(err)
 		return
 	}
+	// 出错时关闭套接字，不返回已经关闭的fd
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+			fd = 0
+		}
+	}()
 
-	if len(tcpAddr.IP) == 0 {
-		tcpAddr.IP = net.IPv4zero
+	for _, sockOpt := range sockOpts {
+		if err = sockOpt.SetSockOpt(fd, sockOpt.Opt); err != nil {
+			return
+		}
 	}
-	ip4 := tcpAddr.IP.To4()
-	if ip4 == nil {
-		return &unix.SockaddrInet4{}, tcpAddr, &net.AddrError{Err: "non-IPv4 address", Addr: tcpAddr.IP.String()}
+
+	// 非阻塞套接字的连接在后台完成，返回EINPROGRESS
+	if err = unix.Connect(fd, sa); err != nil && err != unix.EINPROGRESS {
+		err = os.NewSyscallError("connect", err)
+		return
 	}
+	return fd, sa, tcpAddr, nil
+}
 
-	addr4 := &unix.SockaddrInet4{Port: tcpAddr.Port}
-	copy(addr4.Addr[:], ip4)
+// GetTCPSockAddr 获得TCP套接字的地址和地址族
+func GetTCPSockAddr(network, addr string) (sa unix.Sockaddr, family int, tcpAddr *net.TCPAddr, err error) {
+	// 解析地址并返回对应结构
+	tcpAddr, err = net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
 
-	return addr4, tcpAddr, nil
+	family = ipFamily(network, tcpAddr.IP)
+	if len(tcpAddr.IP) == 0 {
+		tcpAddr.IP = unspecifiedIP(family)
+	}
+	sa, err = ipToSockaddr(family, tcpAddr.IP, tcpAddr.Port, tcpAddr.Zone)
+	return
 }
 
 // SockaddrToTCPAddr 把SockAddr转换为TCPAddr
 func SockaddrToTCPAddr(sa unix.Sockaddr) net.Addr {
-	switch sa := sa.(type) {
-	case *unix.SockaddrInet4:
-		ip := sockaddrInet4ToIP(sa)
-		return &net.TCPAddr{IP: ip, Port: sa.Port}
+	if ip, port, zone, ok := sockaddrToIP(sa); ok {
+		return &net.TCPAddr{IP: ip, Port: port, Zone: zone}
 	}
 	return nil
 }
@@ -0,0 +1,78 @@
+package socket
+
+import (
+	"github.com/Senhnn/shlev/tools/logger"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+)
+
+// UDPListenSocket 新建一个绑定地址的UDP套接字，network为udp、udp4或者udp6
+func UDPListenSocket(network, addr string, ipv6only bool, sockOpts ...SocketOption) (fd FD, netAddr net.Addr, err error) {
+	sa, family, netAddr, err := GetUDPSockAddr(network, addr)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	if fd, err = unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP); err != nil {
+		err = os.NewSyscallError("socket", err)
+		logger.Error(err)
+		return
+	}
+	// 出错时关闭套接字，不返回已经关闭的fd
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+			fd = 0
+		}
+	}()
+
+	if err = setIPv6Only(fd, family, network, ipv6only); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	for _, sockOpt := range sockOpts {
+		if err = sockOpt.SetSockOpt(fd, sockOpt.Opt); err != nil {
+			return
+		}
+	}
+
+	// 绑定套接字
+	if err = os.NewSyscallError("bind", unix.Bind(fd, sa)); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	// 端口为0时由内核分配端口，取实际绑定的地址
+	if sa, err := unix.Getsockname(fd); err == nil {
+		netAddr = SockaddrToUDPAddr(sa)
+	}
+
+	return fd, netAddr, nil
+}
+
+// GetUDPSockAddr 获得UDP套接字的地址和地址族
+func GetUDPSockAddr(network, addr string) (sa unix.Sockaddr, family int, udpAddr *net.UDPAddr, err error) {
+	udpAddr, err = net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	family = ipFamily(network, udpAddr.IP)
+	if len(udpAddr.IP) == 0 {
+		udpAddr.IP = unspecifiedIP(family)
+	}
+	sa, err = ipToSockaddr(family, udpAddr.IP, udpAddr.Port, udpAddr.Zone)
+	return
+}
+
+// SockaddrToUDPAddr 把SockAddr转换为UDPAddr
+func SockaddrToUDPAddr(sa unix.Sockaddr) net.Addr {
+	if ip, port, zone, ok := sockaddrToIP(sa); ok {
+		return &net.UDPAddr{IP: ip, Port: port, Zone: zone}
+	}
+	return nil
+}
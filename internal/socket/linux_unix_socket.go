@@ -0,0 +1,157 @@
+package socket
+
+import (
+	"github.com/Senhnn/shlev/tools/logger"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// IsAbstractUnixPath 以@开头的是抽象命名空间的地址，不对应文件系统中的文件
+func IsAbstractUnixPath(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// RemoveStaleUnixSocket 删除上一次进程异常退出时遗留的套接字文件。
+// 文件存在但不是套接字，或者还有进程在监听时返回错误，不删除
+func RemoveStaleUnixSocket(path string) error {
+	if IsAbstractUnixPath(path) {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return &net.AddrError{Err: "file exists and is not a socket", Addr: path}
+	}
+
+	// 能连上说明有进程正在使用。用非阻塞的connect探测，旧进程的backlog满了时不会阻塞启动
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(fd)
+	err = unix.Connect(fd, &unix.SockaddrUnix{Name: path})
+	if err == unix.EINPROGRESS {
+		err = waitConnect(fd, staleProbeTimeout)
+	}
+	switch err {
+	case nil, unix.EAGAIN, unix.ETIMEDOUT:
+		// backlog满了或者超时也说明还有进程在监听
+		return os.NewSyscallError("bind", unix.EADDRINUSE)
+	case unix.ECONNREFUSED:
+		logger.Info("remove stale unix socket:", path)
+		return os.Remove(path)
+	}
+	return os.NewSyscallError("connect", err)
+}
+
+// 探测遗留的套接字文件时等待连接完成的时间
+const staleProbeTimeout = 100 * time.Millisecond
+
+// 等待非阻塞的connect完成，返回连接的结果，超时返回ETIMEDOUT
+func waitConnect(fd int, timeout time.Duration) error {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+	n, err := unix.Poll(fds, int(timeout/time.Millisecond))
+	for err == unix.EINTR {
+		n, err = unix.Poll(fds, int(timeout/time.Millisecond))
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return unix.ETIMEDOUT
+	}
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if soErr != 0 {
+		return unix.Errno(soErr)
+	}
+	return nil
+}
+
+// UnixListenSocket 新建一个unix域监听套接字，perm不为0时修改文件权限，uid、gid不为-1时修改文件属主，
+// backlog不大于0时使用默认值
+func UnixListenSocket(path string, perm os.FileMode, uid, gid, backlog int, sockOpts ...SocketOption) (fd FD, netAddr net.Addr, err error) {
+	if err = RemoveStaleUnixSocket(path); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	if fd, err = unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0); err != nil {
+		err = os.NewSyscallError("socket", err)
+		logger.Error(err)
+		return
+	}
+	// 出错时关闭套接字，不返回已经关闭的fd
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+			fd = 0
+		}
+	}()
+
+	for _, sockOpt := range sockOpts {
+		if err = sockOpt.SetSockOpt(fd, sockOpt.Opt); err != nil {
+			return
+		}
+	}
+
+	// 绑定套接字，抽象命名空间的地址由unix.SockaddrUnix处理@前缀
+	if err = os.NewSyscallError("bind", unix.Bind(fd, &unix.SockaddrUnix{Name: path})); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	// 在listen之前修改权限和属主，避免开始监听之后有一段时间权限不对
+	if !IsAbstractUnixPath(path) {
+		if perm != 0 {
+			if err = os.Chmod(path, perm); err != nil {
+				logger.Error(err)
+				return
+			}
+		}
+		if uid != -1 || gid != -1 {
+			if err = os.Chown(path, uid, gid); err != nil {
+				logger.Error(err)
+				return
+			}
+		}
+	}
+
+	err = os.NewSyscallError("listen", unix.Listen(fd, listenBacklog(backlog)))
+
+	return fd, &net.UnixAddr{Name: path, Net: "unix"}, err
+}
+
+// UnixConnectSocket 新建一个非阻塞的unix域套接字并连接path，
+// unix域套接字的连接立即完成，对端的连接队列满时返回EAGAIN
+func UnixConnectSocket(path string) (fd FD, sa unix.Sockaddr, netAddr net.Addr, err error) {
+	if fd, err = unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0); err != nil {
+		err = os.NewSyscallError("socket", err)
+		logger.Error(err)
+		return
+	}
+	sa = &unix.SockaddrUnix{Name: path}
+	if err = unix.Connect(fd, sa); err != nil {
+		_ = unix.Close(fd)
+		return 0, nil, nil, os.NewSyscallError("connect", err)
+	}
+	return fd, sa, &net.UnixAddr{Name: path, Net: "unix"}, nil
+}
+
+// SockaddrToUnixAddr 把SockAddr转换为UnixAddr
+func SockaddrToUnixAddr(sa unix.Sockaddr) net.Addr {
+	if sa, ok := sa.(*unix.SockaddrUnix); ok {
+		return &net.UnixAddr{Name: sa.Name, Net: "unix"}
+	}
+	return &net.UnixAddr{Net: "unix"}
+}
@@ -4,34 +4,48 @@ import (
 	"fmt"
 	"github.com/Senhnn/shlev/internal/socket"
 	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
 	"golang.org/x/sys/unix"
 	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Listener struct {
 	once             sync.Once
 	Fd               int
 	Addr             net.Addr
-	Address, Network string
+	Address, Network string // Network为tcp、udp或者unix
 	SockOpts         []socket.SocketOption
-	//pollAttachment   *netpoll.PollAttachment // listener attachment for poller
-	acceptCallback func(int, uint32) error
+	network          string // 创建时指定的协议，比如tcp6，端口复用时按它创建新的监听套接字
+	index            int    // 在服务器监听器列表中的索引，端口复用创建的监听套接字和原监听器相同
+	lnOpts           ListenerOptions
+	handedOff        int32 // 1：已经交接给新进程，关闭时不删除unix域套接字文件
+	inherited        []int // 父进程端口复用时交接的其他监听套接字，还没有分配给事件循环
 }
 
+// ConvertOptionToSocketOption 把选项转换为tcp监听器的套接字选项，其他协议使用ConvertOptionToSocketOptionFor
 func ConvertOptionToSocketOption(options *Options) ([]socket.SocketOption, error) {
+	return ConvertOptionToSocketOptionFor("tcp", options)
+}
+
+// ConvertOptionToSocketOptionFor 按协议把选项转换为套接字选项，network为tcp、udp或者unix，
+// TCP_NODELAY只对tcp生效，地址复用和端口复用对unix域套接字不生效
+func ConvertOptionToSocketOptionFor(network string, options *Options) ([]socket.SocketOption, error) {
 	var sockOpts []socket.SocketOption
 
-	if options.ReusePort {
+	// unix域套接字不支持端口复用
+	if options.ReusePort && network != "unix" {
 		sockOpt := socket.SocketOption{SetSockOpt: socket.SetReusePort, Opt: 1}
 		sockOpts = append(sockOpts, sockOpt)
 	}
-	if options.ReuseAddr {
+	if options.ReuseAddr && network != "unix" {
 		sockOpt := socket.SocketOption{SetSockOpt: socket.SetReuseAddr, Opt: 1}
 		sockOpts = append(sockOpts, sockOpt)
 	}
-	if options.TCPNoDelay {
+	if options.TCPNoDelay && network == "tcp" {
 		sockOpt := socket.SocketOption{SetSockOpt: socket.SetNoDelay, Opt: 1}
 		sockOpts = append(sockOpts, sockOpt)
 	}
@@ -46,10 +60,121 @@ func ConvertOptionToSocketOption(options *Options) ([]socket.SocketOption, error
 	return sockOpts, nil
 }
 
+// 把tcp://host:port这样的地址拆分成协议和地址，不带协议时默认为tcp
+func parseProtoAddr(addr string) (network, address string) {
+	network, address = "tcp", addr
+	if pair := strings.SplitN(addr, "://", 2); len(pair) == 2 {
+		network, address = strings.ToLower(pair[0]), pair[1]
+	}
+	return
+}
+
+// NewListener 根据地址创建监听器，地址格式为tcp://host:port、udp://host:port或者unix:///path/to.sock，
+// tcp4、tcp6、udp4、udp6限定地址族，IPv6地址写成tcp://[::1]:8080，
+// unix://@name表示抽象命名空间的地址，不带协议时默认为tcp
+func NewListener(addr string, options *Options) (*Listener, error) {
+	network, address := parseProtoAddr(addr)
+	return newListener(network, address, options, options.listenerOptions(network, address))
+}
+
+func newListener(network, address string, options *Options, lnOpts ListenerOptions) (*Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return newTCPListener(network, address, options, lnOpts)
+	case "udp", "udp4", "udp6":
+		return newUDPListener(network, address, options, lnOpts)
+	case "unix":
+		return newUnixListener(address, options, lnOpts)
+	default:
+		logger.Error("NewListener unsupported network:", network)
+		return nil, shleverror.ErrUnsupportedProtocol
+	}
+}
+
+// NewUnixListener 创建unix域套接字监听器，会先删除遗留的套接字文件
+func NewUnixListener(path string, options *Options) (*Listener, error) {
+	return newUnixListener(path, options, options.listenerOptions("unix", path))
+}
+
+func newUnixListener(path string, options *Options, lnOpts ListenerOptions) (l *Listener, err error) {
+	if l, ok, err := inheritListener("unix", path, options, lnOpts); ok {
+		return l, err
+	}
+	socketOpts, err := ConvertOptionToSocketOptionFor("unix", options)
+	if err != nil {
+		logger.Error("NewUnixListener error:", err)
+		return nil, err
+	}
+	l = &Listener{
+		once:     sync.Once{},
+		Fd:       0,
+		Addr:     nil,
+		Address:  path,
+		Network:  "unix",
+		SockOpts: socketOpts,
+		network:  "unix",
+		lnOpts:   lnOpts,
+	}
+	uid, gid := -1, -1
+	if options.UnixSocketChown {
+		uid, gid = options.UnixSocketUID, options.UnixSocketGID
+	}
+	l.Fd, l.Addr, err = socket.UnixListenSocket(path, options.UnixSocketPerm, uid, gid, lnOpts.Backlog, socketOpts...)
+	if err != nil {
+		logger.Error(fmt.Sprintf("NewUnixListener create new listener path:%s, error: %s", path, err))
+	}
+	return l, err
+}
+
+// NewUDPListener 创建UDP监听器，network为udp、udp4或者udp6
+func NewUDPListener(network, addr string, options *Options) (*Listener, error) {
+	return newUDPListener(network, addr, options, options.listenerOptions(network, addr))
+}
+
+func newUDPListener(network, addr string, options *Options, lnOpts ListenerOptions) (l *Listener, err error) {
+	if l, ok, err := inheritListener(network, addr, options, lnOpts); ok {
+		return l, err
+	}
+	socketOpts, err := ConvertOptionToSocketOptionFor("udp", options)
+	if err != nil {
+		logger.Error("NewUDPListener error:", err)
+		return nil, err
+	}
+	l = &Listener{
+		once:     sync.Once{},
+		Fd:       0,
+		Addr:     nil,
+		Address:  addr,
+		Network:  "udp",
+		SockOpts: socketOpts,
+		network:  network,
+		lnOpts:   lnOpts,
+	}
+	l.Fd, l.Addr, err = socket.UDPListenSocket(network, addr, options.IPv6Only, socketOpts...)
+	if err != nil {
+		logger.Error(fmt.Sprintf("NewUDPListener create new listener addr:%s, error: %s", addr, err))
+	}
+	return l, err
+}
+
+// NewTCP4Listener 创建只监听IPv4地址的TCP监听器
 func NewTCP4Listener(addr string, options *Options) (l *Listener, err error) {
-	socketOpts, err := ConvertOptionToSocketOption(options)
+	return NewTCPListener("tcp4", addr, options)
+}
+
+// NewTCPListener 创建TCP监听器，network为tcp、tcp4或者tcp6，
+// tcp监听IPv6地址（比如[::]:8080）时默认双栈，同时接收IPv4连接，可以用WithIPv6Only关闭
+func NewTCPListener(network, addr string, options *Options) (*Listener, error) {
+	return newTCPListener(network, addr, options, options.listenerOptions(network, addr))
+}
+
+func newTCPListener(network, addr string, options *Options, lnOpts ListenerOptions) (l *Listener, err error) {
+	if l, ok, err := inheritListener(network, addr, options, lnOpts); ok {
+		return l, err
+	}
+	socketOpts, err := ConvertOptionToSocketOptionFor("tcp", options)
 	if err != nil {
-		logger.Error("NewTCP4Listener error:", err)
+		logger.Error("NewTCPListener error:", err)
 		return nil, err
 	}
 	l = &Listener{
@@ -59,18 +184,52 @@ func NewTCP4Listener(addr string, options *Options) (l *Listener, err error) {
 		Address:  addr,
 		Network:  "tcp",
 		SockOpts: socketOpts,
+		network:  network,
+		lnOpts:   lnOpts,
 	}
-	l.Fd, l.Addr, err = socket.TCP4ListenSocket(addr, socketOpts...)
+	l.Fd, l.Addr, err = socket.TCPListenSocket(network, addr, options.IPv6Only, lnOpts.Backlog, socketOpts...)
 	if err != nil {
-		logger.Error(fmt.Sprintf("NewTCP4Listener create new listener addr:%s, error: %s", addr, err))
+		logger.Error(fmt.Sprintf("NewTCPListener create new listener %s addr:%s, error: %s", network, addr, err))
 	}
 	return l, err
 }
 
-func (l *Listener) SetAcceptCallback(f func(int, uint32) error) {
-	l.acceptCallback = f
+// 端口复用时给其他事件循环创建一个监听同一地址的套接字，端口为0时绑定已经分配的端口，
+// 父进程交接了端口复用的监听套接字时优先使用
+func (l *Listener) reuse(options *Options) (*Listener, error) {
+	if nl, err := l.nextInherited(); nl != nil || err != nil {
+		return nl, err
+	}
+	address := l.Address
+	if l.Network != "unix" && l.Addr != nil {
+		address = l.Addr.String()
+	}
+	nl, err := newListener(l.network, address, options, l.lnOpts)
+	if err != nil {
+		return nil, err
+	}
+	nl.Address = l.Address
+	nl.index = l.index
+	return nl, nil
 }
 
+// 把accept得到的对端地址转换为net.Addr
+func (l *Listener) sockaddrToAddr(sa unix.Sockaddr) net.Addr {
+	switch l.Network {
+	case "unix":
+		return socket.SockaddrToUnixAddr(sa)
+	case "udp":
+		return socket.SockaddrToUDPAddr(sa)
+	}
+	return socket.SockaddrToTCPAddr(sa)
+}
+
+// SetAcceptCallback 保留下来兼容旧的调用者，不做任何事情：监听套接字的事件一直由事件循环处理，
+// 新连接按协议在accept或者readUDP中创建，这个回调从来没有被调用过。
+//
+// Deprecated: 接收连接之后的处理放在EventHandler.OnOpen中
+func (l *Listener) SetAcceptCallback(_ func(int, uint32) error) {}
+
 func (l *Listener) GetFD() int {
 	return l.Fd
 }
@@ -84,6 +243,10 @@ func (l *Listener) Close() {
 			} else {
 				logger.Debug("ln close success!")
 			}
+			// 删除unix域套接字文件
+			if l.Network == "unix" && !socket.IsAbstractUnixPath(l.Address) && atomic.LoadInt32(&l.handedOff) == 0 {
+				_ = os.Remove(l.Address)
+			}
 		}
 	})
 }
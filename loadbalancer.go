@@ -1,8 +1,13 @@
 package shlev
 
 import (
+	"encoding/binary"
 	"hash/crc32"
+	"hash/fnv"
+	"math/rand"
 	"net"
+	"sort"
+	"time"
 )
 
 // LoadBalancing 负载均衡算法，默认为轮询
@@ -15,72 +20,195 @@ const (
 	// LeastConnections 最小连接
 	LeastConnections
 
-	// SourceAddrHash hash值
+	// SourceAddrHash 按对端IP和端口的hash值
 	SourceAddrHash
+
+	// SourceIPHash 只按对端IP的hash值，同一个IP的连接总是交给同一个事件循环
+	SourceIPHash
+
+	// ConsistentHash 按对端IP的一致性hash，事件循环数量变化时只有少量IP会换到别的事件循环
+	ConsistentHash
+
+	// PowerOfTwoChoices 随机选两个事件循环，取连接数少的一个
+	PowerOfTwoChoices
+
+	// LeastLoad 综合回调耗时、读写字节数、任务数和连接数，选负载最低的事件循环，参看NewLoadAwareLoadBalancer
+	LeastLoad
 )
 
-// loadBalancer 负载均衡接口
-type loadBalancer interface {
-	register(*EventLoop)
-	next(net.Addr) *EventLoop
-	iterate(func(int, *EventLoop) bool)
-	len() int
+// 一致性hash中每个事件循环的虚拟节点数
+const consistentHashReplicas = 160
+
+// 负载感知负载均衡刷新统计数据的间隔
+const loadStatsRefresh = 100 * time.Millisecond
+
+// LoadBalancer 负载均衡器，决定新连接交给哪个事件循环处理，可以用WithCustomLoadBalancer设置自己的实现。
+// 服务器启动时设置好EventLoop的索引之后调用Register；Next在主响应器接收连接和Dial时调用，服务器加锁保证同一时间只有一个goroutine调用，
+// 实现不需要加锁，端口复用模式和udp接收的连接由内核分配，不会调用Next，开启PROXY协议时参看ConnLoadBalancer；Iterate和Len在服务器启动之后只读
+type LoadBalancer interface {
+	// Register 注册事件循环
+	Register(*EventLoop)
+	// Next 为地址是addr的新连接选择事件循环
+	Next(addr net.Addr) *EventLoop
+	// Iterate 按注册顺序遍历事件循环，f返回false时停止
+	Iterate(f func(int, *EventLoop) bool)
+	// Len 事件循环数量
+	Len() int
+}
+
+// ConnLoadBalancer 可选实现，开启PROXY协议时，接收连接时只能按代理的地址选择事件循环，
+// 解析完协议头之后再调用NextConn按连接重新选择：这时RemoteAddr是头部中的源地址，ProxyTLV可以取到头部中的扩展字段。
+// 选择的事件循环和原来的不同时，在调用OnOpen之前把连接迁移过去。NextConn在连接所在的事件循环中调用，
+// 多个事件循环可能同时调用，实现要保证并发安全
+type ConnLoadBalancer interface {
+	LoadBalancer
+	// NextConn 为解析完PROXY协议头的连接选择事件循环
+	NextConn(c *Conn) *EventLoop
+}
+
+// BaseLoadBalancer 实现了LoadBalancer中除Next之外的方法，自定义负载均衡器可以嵌入它，只实现Next
+type BaseLoadBalancer struct {
+	EventLoops []*EventLoop
+}
+
+// Register 注册事件循环
+func (lb *BaseLoadBalancer) Register(e *EventLoop) {
+	lb.EventLoops = append(lb.EventLoops, e)
+}
+
+// Iterate 按注册顺序遍历事件循环
+func (lb *BaseLoadBalancer) Iterate(f func(int, *EventLoop) bool) {
+	for i, el := range lb.EventLoops {
+		if !f(i, el) {
+			break
+		}
+	}
+}
+
+// Len 事件循环数量
+func (lb *BaseLoadBalancer) Len() int {
+	return len(lb.EventLoops)
 }
 
 // roundRobinLoadBalancer 轮询负载均衡
 type roundRobinLoadBalancer struct {
-	nextIndex  int
-	eventLoops []*EventLoop
-	size       int
+	BaseLoadBalancer
+	nextIndex int
 }
 
 // leastConnectionsLoadBalancer 最少连接负载均衡
 type leastConnectionsLoadBalancer struct {
-	eventLoops []*EventLoop
-	size       int
+	BaseLoadBalancer
 }
 
 // sourceAddrHashLoadBalancer hash负载均衡
 type sourceAddrHashLoadBalancer struct {
-	eventLoops []*EventLoop
-	size       int
+	BaseLoadBalancer
 }
 
-// ==================================== 轮询负载均衡接口实现 ====================================
-// 注册
-func (lb *roundRobinLoadBalancer) register(e *EventLoop) {
-	e.index = lb.size
-	lb.eventLoops = append(lb.eventLoops, e)
-	lb.size++
+// sourceIPHashLoadBalancer 按IP的hash负载均衡
+type sourceIPHashLoadBalancer struct {
+	BaseLoadBalancer
 }
 
-// next returns the eligible event-loop based on Round-Robin algorithm.
-func (lb *roundRobinLoadBalancer) next(_ net.Addr) (e *EventLoop) {
-	e = lb.eventLoops[lb.nextIndex]
-	if lb.nextIndex++; lb.nextIndex >= lb.size {
-		lb.nextIndex = 0
+// consistentHashLoadBalancer 一致性hash负载均衡
+type consistentHashLoadBalancer struct {
+	BaseLoadBalancer
+	key     func(net.Addr) []byte // 计算hash的key
+	connKey func(*Conn) []byte    // 解析完PROXY协议头之后计算hash的key，为nil时对源地址使用key
+	ring    []ringNode            // 按hash值排序的虚拟节点
+}
+
+// 一致性hash环上的虚拟节点
+type ringNode struct {
+	hash uint32
+	loop *EventLoop
+}
+
+// p2cLoadBalancer 两次随机选择负载均衡
+type p2cLoadBalancer struct {
+	BaseLoadBalancer
+	rnd *rand.Rand // Next同一时间只有一个goroutine调用，不需要加锁
+}
+
+// LoadWeights 负载感知负载均衡中各项负载的权重，每项负载先换算成占所有事件循环总和的比例再加权求和
+type LoadWeights struct {
+	Busy  float64 // 统计窗口内执行回调的时间
+	Bytes float64 // 统计窗口内读写的字节数
+	Tasks float64 // 任务队列中还没有执行的任务数
+	Conns float64 // 连接数
+}
+
+// LeastLoad使用的默认权重
+var defaultLoadWeights = LoadWeights{Busy: 0.4, Bytes: 0.2, Tasks: 0.2, Conns: 0.2}
+
+// loadAwareLoadBalancer 负载感知负载均衡
+type loadAwareLoadBalancer struct {
+	BaseLoadBalancer
+	weights   LoadWeights
+	stats     []LoopStats // 缓存的统计数据，每loadStatsRefresh刷新一次
+	assigned  []int       // 刷新之后分配给每个事件循环的连接数，避免刷新之前都分给同一个事件循环
+	refreshed time.Time
+}
+
+// NewLoadAwareLoadBalancer 按加权负载选择事件循环的负载均衡器，统计数据参看EventLoop.Stats
+func NewLoadAwareLoadBalancer(weights LoadWeights) LoadBalancer {
+	return &loadAwareLoadBalancer{weights: weights}
+}
+
+// NewKeyHashLoadBalancer 按自定义key做一致性hash的负载均衡器，key为nil时使用对端IP，
+// 可以按租户等业务信息把连接固定到同一个事件循环。开启PROXY协议时，解析完协议头之后按头部中的源地址重新计算
+func NewKeyHashLoadBalancer(key func(net.Addr) []byte) LoadBalancer {
+	if key == nil {
+		key = ipKey
 	}
-	return
+	return &consistentHashLoadBalancer{key: key}
 }
 
-func (lb *roundRobinLoadBalancer) iterate(f func(int, *EventLoop) bool) {
-	for i, el := range lb.eventLoops {
-		if !f(i, el) {
-			break
-		}
+// NewConnKeyHashLoadBalancer 按连接计算key做一致性hash的负载均衡器，用于PROXY协议后面的服务，
+// 比如按代理在TLV中传递的租户把连接固定到同一个事件循环。key在解析完PROXY协议头之后调用，参看ConnLoadBalancer，
+// 没有开启PROXY协议的连接按对端IP选择
+func NewConnKeyHashLoadBalancer(key func(c *Conn) []byte) LoadBalancer {
+	return &consistentHashLoadBalancer{key: ipKey, connKey: key}
+}
+
+// 根据负载均衡枚举值创建内置的负载均衡器
+func newLoadBalancer(lb LoadBalancing) LoadBalancer {
+	switch lb {
+	case LeastConnections:
+		return &leastConnectionsLoadBalancer{}
+	case SourceAddrHash:
+		return &sourceAddrHashLoadBalancer{}
+	case SourceIPHash:
+		return &sourceIPHashLoadBalancer{}
+	case ConsistentHash:
+		return NewKeyHashLoadBalancer(nil)
+	case PowerOfTwoChoices:
+		return &p2cLoadBalancer{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	case LeastLoad:
+		return NewLoadAwareLoadBalancer(defaultLoadWeights)
+	default:
+		return &roundRobinLoadBalancer{}
 	}
 }
 
-func (lb *roundRobinLoadBalancer) len() int {
-	return lb.size
+// ==================================== 轮询负载均衡接口实现 ====================================
+// Next 按顺序轮流选择事件循环
+func (lb *roundRobinLoadBalancer) Next(_ net.Addr) (e *EventLoop) {
+	e = lb.EventLoops[lb.nextIndex]
+	if lb.nextIndex++; lb.nextIndex >= len(lb.EventLoops) {
+		lb.nextIndex = 0
+	}
+	return
 }
 
 // ================================= 最小连接负载均衡接口实现 =================================
-func (lb *leastConnectionsLoadBalancer) min() (el *EventLoop) {
-	el = lb.eventLoops[0]
-	minN := el.loadConn()
-	for _, v := range lb.eventLoops[1:] {
-		if n := v.loadConn(); n < minN {
+// Next 返回连接数最少的EventLoop
+func (lb *leastConnectionsLoadBalancer) Next(_ net.Addr) (el *EventLoop) {
+	el = lb.EventLoops[0]
+	minN := el.ConnCount()
+	for _, v := range lb.EventLoops[1:] {
+		if n := v.ConnCount(); n < minN {
 			minN = n
 			el = v
 		}
@@ -88,58 +216,200 @@ func (lb *leastConnectionsLoadBalancer) min() (el *EventLoop) {
 	return
 }
 
-func (lb *leastConnectionsLoadBalancer) register(el *EventLoop) {
-	el.index = lb.size
-	lb.eventLoops = append(lb.eventLoops, el)
-	lb.size++
+// ======================================= 哈希负载均衡接口实现 ========================================
+// hash 算hash值
+func (lb *sourceAddrHashLoadBalancer) hash(s string) int {
+	v := int(crc32.ChecksumIEEE([]byte(s)))
+	if v >= 0 {
+		return v
+	}
+	return -v
+}
+
+// hashAddr 计算地址的hash值，IP统一转换成16字节，IPv4地址和IPv4映射的IPv6地址结果相同，
+// 不使用String()避免IPv6的多种文本表示和zone影响结果
+func (lb *sourceAddrHashLoadBalancer) hashAddr(netAddr net.Addr) int {
+	var (
+		ip   net.IP
+		port int
+	)
+	switch addr := netAddr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	default:
+		if netAddr == nil {
+			return 0
+		}
+		return lb.hash(netAddr.String())
+	}
+
+	var b [net.IPv6len + 2]byte
+	copy(b[:net.IPv6len], ip.To16())
+	b[net.IPv6len], b[net.IPv6len+1] = byte(port>>8), byte(port)
+	v := int(crc32.ChecksumIEEE(b[:]))
+	if v >= 0 {
+		return v
+	}
+	return -v
 }
 
-// next 返回可用的EventLoop
-func (lb *leastConnectionsLoadBalancer) next(_ net.Addr) (el *EventLoop) {
-	return lb.min()
+// Next 按对端地址的hash值选择事件循环
+func (lb *sourceAddrHashLoadBalancer) Next(netAddr net.Addr) *EventLoop {
+	hashCode := lb.hashAddr(netAddr)
+	return lb.EventLoops[hashCode%len(lb.EventLoops)]
 }
 
-func (lb *leastConnectionsLoadBalancer) iterate(f func(int, *EventLoop) bool) {
-	for i, el := range lb.eventLoops {
-		if !f(i, el) {
-			break
-		}
+// NextConn 按PROXY协议头中的源地址重新选择
+func (lb *sourceAddrHashLoadBalancer) NextConn(c *Conn) *EventLoop {
+	return lb.Next(c.RemoteAddr())
+}
+
+// ipKey 地址中的IP，统一转换成16字节，不是IP地址时使用String()
+func ipKey(netAddr net.Addr) []byte {
+	switch addr := netAddr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.To16()
+	case *net.UDPAddr:
+		return addr.IP.To16()
+	case nil:
+		return nil
 	}
+	return []byte(netAddr.String())
 }
 
-func (lb *leastConnectionsLoadBalancer) len() int {
-	return lb.size
+// hash32 fnv-1a之后再打散一次，让相近的key也能均匀分布
+func hash32(b []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(b)
+	v := h.Sum32()
+	v ^= v >> 16
+	v *= 0x85ebca6b
+	v ^= v >> 13
+	v *= 0xc2b2ae35
+	v ^= v >> 16
+	return v
 }
 
-// ======================================= 哈希负载均衡接口实现 ========================================
-func (lb *sourceAddrHashLoadBalancer) register(el *EventLoop) {
-	el.index = lb.size
-	lb.eventLoops = append(lb.eventLoops, el)
-	lb.size++
+// ===================================== IP哈希负载均衡接口实现 ======================================
+// Next 按对端IP的hash值选择事件循环，忽略端口
+func (lb *sourceIPHashLoadBalancer) Next(netAddr net.Addr) *EventLoop {
+	return lb.EventLoops[hash32(ipKey(netAddr))%uint32(len(lb.EventLoops))]
 }
 
-// hash 算hash值
-func (lb *sourceAddrHashLoadBalancer) hash(s string) int {
-	v := int(crc32.ChecksumIEEE([]byte(s)))
-	if v >= 0 {
-		return v
+// NextConn 按PROXY协议头中的源IP重新选择
+func (lb *sourceIPHashLoadBalancer) NextConn(c *Conn) *EventLoop {
+	return lb.Next(c.RemoteAddr())
+}
+
+// ==================================== 一致性哈希负载均衡接口实现 ====================================
+// Register 注册事件循环并在环上加入虚拟节点，虚拟节点只和事件循环的索引有关
+func (lb *consistentHashLoadBalancer) Register(e *EventLoop) {
+	lb.BaseLoadBalancer.Register(e)
+	var b [16]byte
+	for i := 0; i < consistentHashReplicas; i++ {
+		binary.BigEndian.PutUint64(b[:8], uint64(e.index))
+		binary.BigEndian.PutUint64(b[8:], uint64(i))
+		lb.ring = append(lb.ring, ringNode{hash: hash32(b[:]), loop: e})
 	}
-	return -v
+	sort.Slice(lb.ring, func(i, j int) bool { return lb.ring[i].hash < lb.ring[j].hash })
 }
 
-func (lb *sourceAddrHashLoadBalancer) next(netAddr net.Addr) *EventLoop {
-	hashCode := lb.hash(netAddr.String())
-	return lb.eventLoops[hashCode%lb.size]
+// Next 在环上顺时针找到第一个虚拟节点
+func (lb *consistentHashLoadBalancer) Next(netAddr net.Addr) *EventLoop {
+	return lb.lookup(lb.key(netAddr))
 }
 
-func (lb *sourceAddrHashLoadBalancer) iterate(f func(int, *EventLoop) bool) {
-	for i, el := range lb.eventLoops {
-		if !f(i, el) {
-			break
-		}
+// NextConn 按PROXY协议头中的信息重新计算key
+func (lb *consistentHashLoadBalancer) NextConn(c *Conn) *EventLoop {
+	if lb.connKey != nil {
+		return lb.lookup(lb.connKey(c))
 	}
+	return lb.Next(c.RemoteAddr())
 }
 
-func (lb *sourceAddrHashLoadBalancer) len() int {
-	return lb.size
+// 在环上顺时针找到key之后的第一个虚拟节点
+func (lb *consistentHashLoadBalancer) lookup(key []byte) *EventLoop {
+	h := hash32(key)
+	i := sort.Search(len(lb.ring), func(i int) bool { return lb.ring[i].hash >= h })
+	if i == len(lb.ring) {
+		i = 0
+	}
+	return lb.ring[i].loop
+}
+
+var (
+	_ ConnLoadBalancer = (*sourceAddrHashLoadBalancer)(nil)
+	_ ConnLoadBalancer = (*sourceIPHashLoadBalancer)(nil)
+	_ ConnLoadBalancer = (*consistentHashLoadBalancer)(nil)
+)
+
+// ==================================== 两次随机选择负载均衡接口实现 ====================================
+// Next 随机选两个不同的事件循环，返回连接数少的一个
+func (lb *p2cLoadBalancer) Next(_ net.Addr) *EventLoop {
+	n := len(lb.EventLoops)
+	if n == 1 {
+		return lb.EventLoops[0]
+	}
+	i := lb.rnd.Intn(n)
+	j := lb.rnd.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	a, b := lb.EventLoops[i], lb.EventLoops[j]
+	if b.ConnCount() < a.ConnCount() {
+		return b
+	}
+	return a
+}
+
+// ===================================== 负载感知负载均衡接口实现 ======================================
+// 刷新缓存的统计数据
+func (lb *loadAwareLoadBalancer) refresh(now time.Time) {
+	lb.stats = lb.stats[:0]
+	for _, e := range lb.EventLoops {
+		lb.stats = append(lb.stats, e.Stats())
+	}
+	if len(lb.assigned) != len(lb.EventLoops) {
+		lb.assigned = make([]int, len(lb.EventLoops))
+	}
+	for i := range lb.assigned {
+		lb.assigned[i] = 0
+	}
+	lb.refreshed = now
+}
+
+// Next 返回加权负载最低的事件循环
+func (lb *loadAwareLoadBalancer) Next(_ net.Addr) *EventLoop {
+	if now := time.Now(); now.Sub(lb.refreshed) >= loadStatsRefresh || len(lb.stats) != len(lb.EventLoops) {
+		lb.refresh(now)
+	}
+
+	var busy, bytes, tasks, conns float64
+	for i, st := range lb.stats {
+		busy += float64(st.BusyTime)
+		bytes += float64(st.BytesIn + st.BytesOut)
+		tasks += float64(st.PendingTasks)
+		conns += float64(int(st.Conns) + lb.assigned[i])
+	}
+	share := func(v, total float64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return v / total
+	}
+
+	best, bestScore := 0, 0.0
+	for i, st := range lb.stats {
+		score := lb.weights.Busy*share(float64(st.BusyTime), busy) +
+			lb.weights.Bytes*share(float64(st.BytesIn+st.BytesOut), bytes) +
+			lb.weights.Tasks*share(float64(st.PendingTasks), tasks) +
+			lb.weights.Conns*share(float64(int(st.Conns)+lb.assigned[i]), conns)
+		if i == 0 || score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+	lb.assigned[best]++
+	return lb.EventLoops[best]
 }
@@ -0,0 +1,278 @@
+package shlev
+
+import (
+	"fmt"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"github.com/Senhnn/shlev/tools/task_queue"
+)
+
+// 连接迁移分三步：
+// 1. MigrateTo在源事件循环中把连接标记为迁移中，之后的异步任务暂存在连接上；
+// 2. 源事件循环执行完之前已经排队的异步任务，再把连接从epoll和连接表中删除，用紧急任务交给目标事件循环；
+// 3. 目标事件循环注册连接，然后按顺序执行暂存的任务；目标事件循环在接管之前退出时，退出时接管连接并关闭。
+// 接收缓冲区和发送缓冲区随连接一起转移，同一个连接的异步写在迁移前后保持调用顺序。
+
+const (
+	// 连接数超过平均值的比例，超过时自动迁移
+	rebalanceTolerance = 0.25
+	// 每次最多迁移的连接数
+	rebalanceBatch = 32
+)
+
+// 迁移期间暂存的异步任务
+type connTask struct {
+	fn  task_queue.TaskFunc
+	arg interface{}
+}
+
+// 迁移任务的参数
+type migration struct {
+	conn *Conn
+	to   *EventLoop
+}
+
+// MigrateTo 把连接迁移到索引为index的事件循环，只能在连接所属的事件循环中调用，比如OnTraffic或者Conn.AfterFunc的回调。
+// 迁移是异步完成的，返回之后本次回调中仍然可以读写连接；迁移期间的AsyncWrite、Close在迁移完成之后按调用顺序执行，
+// Conn.AfterFunc设置的定时器到期时转到新的事件循环执行
+func (c *Conn) MigrateTo(index int) error {
+	if c.isDatagram {
+		return shleverror.ErrMigrateDatagram
+	}
+	if c.pooled != nil {
+		return shleverror.ErrMigratePooled
+	}
+	src := c.loop
+	if !src.ownsConn(c) {
+		return shleverror.ErrConnectionClosed
+	}
+	dst := src.server.eventLoop(index)
+	if dst == nil {
+		return shleverror.ErrInvalidEventLoop
+	}
+	if dst == src {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.migrating {
+		return shleverror.ErrConnectionMigrating
+	}
+	// 放到普通任务队列的末尾，在这之前排队的异步任务仍然在源事件循环中执行
+	if err := src.netpoll.AddTask(src.handOver, &migration{conn: c, to: dst}); err != nil {
+		return err
+	}
+	c.migrating = true
+	return nil
+}
+
+// 把任务交给连接所属的事件循环执行，连接正在迁移时先暂存，迁移完成之后在新的事件循环中按顺序执行，可以在任意goroutine中调用
+func (c *Conn) dispatch(fn task_queue.TaskFunc, arg interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.migrating {
+		c.pending = append(c.pending, connTask{fn: fn, arg: arg})
+		return nil
+	}
+	return c.loop.netpoll.AddTask(fn, arg)
+}
+
+// 连接当前所属的事件循环，可以在任意goroutine中调用
+func (c *Conn) currentLoop() *EventLoop {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loop
+}
+
+// 迁移结束，在当前事件循环中按顺序执行暂存的任务，之后的任务直接进入当前事件循环的任务队列
+func (c *Conn) finishMigration() error {
+	c.mu.Lock()
+	tasks := c.pending
+	c.pending = nil
+	c.migrating = false
+	c.mu.Unlock()
+
+	for _, t := range tasks {
+		switch err := t.fn(t.arg); err {
+		case nil:
+		case shleverror.ErrServerShutdown:
+			return err
+		default:
+			logger.Warn("migration task error:", err)
+		}
+	}
+	return nil
+}
+
+// 按索引查找事件循环
+func (s *Server) eventLoop(index int) (el *EventLoop) {
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
+		if i == index {
+			el = e
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// 源事件循环执行完迁移之前排队的任务之后，把连接交给目标事件循环
+func (e *EventLoop) handOver(itf interface{}) error {
+	m := itf.(*migration)
+	c := m.conn
+	// 迁移之前连接已经关闭，暂存的异步写在这里执行，回调会收到ErrConnectionClosed
+	if !e.ownsConn(c) {
+		return c.finishMigration()
+	}
+	// 服务器正在关闭，目标事件循环可能已经退出，连接留在当前事件循环
+	select {
+	case <-e.server.shutdown:
+		return c.finishMigration()
+	default:
+	}
+
+	if err := e.netpoll.Delete(c.fd); err != nil {
+		logger.Error(fmt.Sprintf("migrate fd:%d from eventloop(%d) error:%v", c.fd, e.index, err))
+		return c.finishMigration()
+	}
+	delete(e.tcpConnectionMap, c.fd)
+	e.addConn(-1)
+
+	c.mu.Lock()
+	c.loop = m.to
+	c.mu.Unlock()
+	if !m.to.deliver(m.to.adopt, c) {
+		c.mu.Lock()
+		c.loop = e
+		c.mu.Unlock()
+		return e.adopt(c)
+	}
+	return nil
+}
+
+// 用紧急任务把连接交给事件循环，由fn接管。事件循环已经退出时返回false，连接还在调用者手里；
+// 交过去之后事件循环在执行fn之前退出时，由adoptIncoming接管并关闭
+func (e *EventLoop) deliver(fn task_queue.TaskFunc, c *Conn) bool {
+	e.incomingMu.Lock()
+	defer e.incomingMu.Unlock()
+	if e.stopped {
+		return false
+	}
+	if err := e.netpoll.AddUrgentTask(fn, c); err != nil {
+		logger.Error(fmt.Sprintf("hand over fd:%d to eventloop(%d) error:%v", c.fd, e.index, err))
+		return false
+	}
+	if e.incoming == nil {
+		e.incoming = make(map[*Conn]struct{})
+	}
+	e.incoming[c] = struct{}{}
+	return true
+}
+
+// 事件循环退出时调用，之后不再接收交过来的连接。已经交过来但还没有接管的连接在这里接管，随后和其他连接一起关闭
+func (e *EventLoop) adoptIncoming() {
+	e.incomingMu.Lock()
+	e.stopped = true
+	incoming := e.incoming
+	e.incoming = nil
+	e.incomingMu.Unlock()
+	for c := range incoming {
+		_ = e.adopt(c)
+	}
+}
+
+// 接管迁移过来的连接，发送缓冲区还有数据时同时监听写事件
+func (e *EventLoop) adopt(itf interface{}) error {
+	c := itf.(*Conn)
+	e.incomingMu.Lock()
+	delete(e.incoming, c)
+	e.incomingMu.Unlock()
+	e.tcpConnectionMap[c.fd] = c
+	e.addConn(1)
+
+	var err error
+	if c.outboundBuffer.IsEmpty() {
+		err = e.netpoll.AddRead(c.fd)
+	} else {
+		err = e.netpoll.AddReadWrite(c.fd)
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("adopt fd:%d in eventloop(%d) error:%v", c.fd, e.index, err))
+		_ = e.closeConnection(c)
+	} else if e.draining {
+		e.drainConn(c)
+	}
+	return c.finishMigration()
+}
+
+// 自动迁移：连接数比平均值多出rebalanceTolerance以上时，把多出来的连接迁移到连接最少的事件循环，
+// 每次最多迁移到平均值，避免在两个事件循环之间来回迁移
+func (e *EventLoop) rebalance() error {
+	e.timers.AfterFunc(e.server.opts.RebalanceInterval, e.rebalance)
+	if e.draining {
+		return nil
+	}
+
+	var (
+		total    int32
+		n        int
+		target   *EventLoop
+		minConns int32
+	)
+	e.server.lb.Iterate(func(_ int, el *EventLoop) bool {
+		conns := el.loadConn()
+		total += conns
+		n++
+		if target == nil || conns < minConns {
+			target, minConns = el, conns
+		}
+		return true
+	})
+	if n < 2 || target == e {
+		return nil
+	}
+	avg := float64(total) / float64(n)
+	conns := float64(e.loadConn())
+	if conns <= avg*(1+rebalanceTolerance) {
+		return nil
+	}
+
+	move := int(conns - avg)
+	if room := int(avg - float64(minConns)); room < move {
+		move = room
+	}
+	if move > rebalanceBatch {
+		move = rebalanceBatch
+	}
+	for _, c := range e.tcpConnectionMap {
+		if move <= 0 {
+			break
+		}
+		if c.notified && c.pooled == nil && c.MigrateTo(target.index) == nil {
+			move--
+		}
+	}
+	return nil
+}
+
+// 开启自动迁移，在事件循环启动之前调用，主响应器没有连接，不需要迁移
+func (e *EventLoop) initRebalance() {
+	if d := e.server.opts.RebalanceInterval; d > 0 && e.index >= 0 {
+		e.timers.AfterFunc(d, e.rebalance)
+	}
+}
+
+// 定时任务到期时连接已经迁移到其他事件循环，转过去执行
+func (c *Conn) runTimer(e *EventLoop, fn func(*Conn) HandleResult) error {
+	if e.ownsConn(c) {
+		return e.handleResult(c, fn(c))
+	}
+	if c.currentLoop() == e {
+		// 连接已经关闭
+		return nil
+	}
+	return c.dispatch(func(_ interface{}) error {
+		return c.runTimer(c.loop, fn)
+	}, nil)
+}
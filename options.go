@@ -1,6 +1,8 @@
 package shlev
 
 import (
+	"crypto/tls"
+	"os"
 	"time"
 )
 
@@ -29,6 +31,9 @@ type Options struct {
 	// 可以最多写的数据
 	WriteBufferCap int
 
+	// IPv6Only tcp、udp监听IPv6地址时只接收IPv6，不开启双栈，tcp6、udp6总是只接收IPv6
+	IPv6Only bool
+
 	// 是否开启Nagle算法，true表示不开启，false表示开启
 	TCPNoDelay bool
 
@@ -40,6 +45,76 @@ type Options struct {
 
 	// 负载均衡器
 	LB LoadBalancing
+
+	// CustomLB 自定义负载均衡器，不为nil时忽略LB
+	CustomLB LoadBalancer
+
+	// BusyTimeStats 统计回调的耗时（LoopStats.BusyTime），每次回调多两次time.Now，使用LeastLoad负载均衡时总是统计
+	BusyTimeStats bool
+
+	// RebalanceInterval 自动迁移连接的检查周期，事件循环的连接数比平均值多25%以上时迁移到连接最少的事件循环，0表示不自动迁移
+	RebalanceInterval time.Duration
+
+	// BusyPoll 忙轮询窗口，事件循环在最近一次有事件之后的这段时间内不阻塞等待，以CPU换取更低的延迟，0表示不忙轮询。
+	// 窗口从最近一次有IO事件或者任务唤醒的时间开始计算，不是每次阻塞之前都先空转这么久，窗口内没有新事件时恢复阻塞等待
+	BusyPoll time.Duration
+
+	// UnixSocketPerm unix域套接字文件的权限，0表示使用默认权限（受umask影响）
+	UnixSocketPerm os.FileMode
+
+	// UnixSocketChown 是否修改unix域套接字文件的属主为UnixSocketUID和UnixSocketGID
+	UnixSocketChown bool
+
+	// UnixSocketUID unix域套接字文件的属主，-1表示不修改
+	UnixSocketUID int
+
+	// UnixSocketGID unix域套接字文件的属组，-1表示不修改
+	UnixSocketGID int
+
+	// Ticker 是否开启定时器，开启后EventHandler实现了TickHandler时会周期性调用OnTick
+	Ticker bool
+
+	// InheritedListeners 优先使用父进程通过Server.Handoff交接的监听套接字，没有交接的地址正常监听
+	InheritedListeners bool
+
+	// ProxyProtocol 所有tcp和unix监听器接收的连接都要先发送PROXY协议头，只开启部分监听器时使用ListenerOptions.ProxyProtocol
+	ProxyProtocol bool
+
+	// ProxyHeaderTimeout 连接建立之后等待PROXY协议头的时间，超时之后关闭连接，0表示5秒
+	ProxyHeaderTimeout time.Duration
+
+	// TLSConfig 所有tcp和unix监听器接收的连接都使用TLS，握手完成之后才调用OnOpen，OnTraffic看到的是明文，
+	// 只开启部分监听器时使用ListenerOptions.TLSConfig
+	TLSConfig *tls.Config
+
+	// TLSHandshakeTimeout TLS握手的超时时间，超时之后关闭连接，0表示10秒
+	TLSHandshakeTimeout time.Duration
+
+	// MaxTLSHandshakes 同时进行的TLS握手数量上限，每个握手占用一个goroutine，超过上限的新连接直接关闭，0表示1024
+	MaxTLSHandshakes int
+
+	// ConnectTimeout Client.Dial、Server.Dial发起的连接的超时时间，0表示10秒
+	ConnectTimeout time.Duration
+
+	// Listeners 单个监听器的选项，key为监听地址，通过WithListenerOptions设置
+	Listeners map[string]ListenerOptions
+}
+
+// ListenerOptions 单个监听器的选项，多个监听器共用一个服务器时可以分别设置
+type ListenerOptions struct {
+	// Backlog 监听套接字的连接队列长度，0表示使用默认值，对udp无效
+	Backlog int
+
+	// ProxyProtocol 这个监听器接收的连接要先发送PROXY协议头，对udp无效
+	ProxyProtocol bool
+
+	// TLSConfig 这个监听器使用的TLS配置，不为nil时覆盖Options.TLSConfig，对udp无效
+	TLSConfig *tls.Config
+}
+
+// 获取监听器的选项，地址按协议和地址匹配，tcp://host:port和host:port是同一个监听器
+func (opts *Options) listenerOptions(network, address string) ListenerOptions {
+	return opts.Listeners[network+"://"+address]
 }
 
 type OptionFunc = func(*Options)
@@ -95,6 +170,65 @@ func WithLoadBalancing(lb LoadBalancing) OptionFunc {
 	}
 }
 
+// WithCustomLoadBalancer 使用自定义的负载均衡器，一个负载均衡器只能给一个服务器使用
+func WithCustomLoadBalancer(lb LoadBalancer) OptionFunc {
+	return func(opts *Options) {
+		opts.CustomLB = lb
+	}
+}
+
+// WithBusyTimeStats 统计回调的耗时，自定义的负载均衡器或者监控需要LoopStats.BusyTime时开启
+func WithBusyTimeStats() OptionFunc {
+	return func(opts *Options) {
+		opts.BusyTimeStats = true
+	}
+}
+
+// WithRebalance 开启连接自动迁移，每个事件循环每隔interval检查一次自己的连接数
+func WithRebalance(interval time.Duration) OptionFunc {
+	return func(opts *Options) {
+		opts.RebalanceInterval = interval
+	}
+}
+
+// WithProxyProtocol 所有tcp和unix监听器接收的连接都要先发送PROXY协议v1或者v2的头部，
+// 解析完之后才调用OnOpen，timeout内没有收到合法的头部时关闭连接，0表示5秒
+func WithProxyProtocol(timeout time.Duration) OptionFunc {
+	return func(opts *Options) {
+		opts.ProxyProtocol = true
+		opts.ProxyHeaderTimeout = timeout
+	}
+}
+
+// WithTLS 所有tcp和unix监听器接收的连接都使用TLS，握手在单独的goroutine中进行，握手完成之后在事件循环中加解密，
+// 证书选择（SNI）、ALPN、会话复用和客户端证书校验都按config处理，握手之后的状态用Conn.TLSState获取
+func WithTLS(config *tls.Config) OptionFunc {
+	return func(opts *Options) {
+		opts.TLSConfig = config
+	}
+}
+
+// WithTLSHandshakeTimeout 指定TLS握手的超时时间
+func WithTLSHandshakeTimeout(timeout time.Duration) OptionFunc {
+	return func(opts *Options) {
+		opts.TLSHandshakeTimeout = timeout
+	}
+}
+
+// WithMaxTLSHandshakes 指定同时进行的TLS握手数量上限
+func WithMaxTLSHandshakes(max int) OptionFunc {
+	return func(opts *Options) {
+		opts.MaxTLSHandshakes = max
+	}
+}
+
+// WithConnectTimeout 指定主动发起的连接的超时时间
+func WithConnectTimeout(timeout time.Duration) OptionFunc {
+	return func(opts *Options) {
+		opts.ConnectTimeout = timeout
+	}
+}
+
 // WithNumEventLoop 指定EventLoop数量
 func WithNumEventLoop(numEventLoop int) OptionFunc {
 	return func(opts *Options) {
@@ -116,6 +250,13 @@ func WithReuseAddr(reuseAddr bool) OptionFunc {
 	}
 }
 
+// WithIPv6Only 设置IPV6_V6ONLY，监听IPv6地址时不接收IPv4连接
+func WithIPv6Only(ipv6Only bool) OptionFunc {
+	return func(opts *Options) {
+		opts.IPv6Only = ipv6Only
+	}
+}
+
 // WithTCPKeepAlive 设置tcp的keep-alive机制
 func WithTCPKeepAlive(tcpKeepAlive time.Duration) OptionFunc {
 	return func(opts *Options) {
@@ -143,3 +284,52 @@ func WithSocketSendBuffer(sendBuf int) OptionFunc {
 		opts.SocketSendBuffer = sendBuf
 	}
 }
+
+// WithBusyPoll 设置忙轮询窗口，对延迟敏感的场景使用，参看Options.BusyPoll
+func WithBusyPoll(busyPoll time.Duration) OptionFunc {
+	return func(opts *Options) {
+		opts.BusyPoll = busyPoll
+	}
+}
+
+// WithTicker 开启定时器，周期性调用OnTick
+func WithTicker(ticker bool) OptionFunc {
+	return func(opts *Options) {
+		opts.Ticker = ticker
+	}
+}
+
+// WithUnixSocketPerm 设置unix域套接字文件的权限
+func WithUnixSocketPerm(perm os.FileMode) OptionFunc {
+	return func(opts *Options) {
+		opts.UnixSocketPerm = perm
+	}
+}
+
+// WithUnixSocketOwner 设置unix域套接字文件的属主和属组，-1表示不修改
+func WithUnixSocketOwner(uid, gid int) OptionFunc {
+	return func(opts *Options) {
+		opts.UnixSocketChown = true
+		opts.UnixSocketUID = uid
+		opts.UnixSocketGID = gid
+	}
+}
+
+// WithInheritedListeners 使用父进程通过Server.Handoff交接的监听套接字，
+// 第一个服务器启动完成之后通知父进程，并关闭没有用到的交接套接字
+func WithInheritedListeners() OptionFunc {
+	return func(opts *Options) {
+		opts.InheritedListeners = true
+	}
+}
+
+// WithListenerOptions 设置地址为addr的监听器的选项，addr和传给RunMulti的地址一致
+func WithListenerOptions(addr string, lnOpts ListenerOptions) OptionFunc {
+	return func(opts *Options) {
+		if opts.Listeners == nil {
+			opts.Listeners = make(map[string]ListenerOptions)
+		}
+		network, address := parseProtoAddr(addr)
+		opts.Listeners[network+"://"+address] = lnOpts
+	}
+}
@@ -0,0 +1,345 @@
+package shlev
+
+import (
+	"fmt"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// 连接池按地址和事件循环分片，分片保存在事件循环上，只在这个事件循环中访问，不需要加锁。
+// Get从调用者所在事件循环的分片中取连接，上游连接的读写和回调都在同一个事件循环中，不需要跨事件循环转发。
+// 分片用事件循环的定时器做健康检查，连接失败之后按指数退避加随机抖动重连，并保持MinIdle个空闲连接。
+
+const (
+	defaultPoolMaxIdle     = 8
+	defaultPoolBackoffBase = 100 * time.Millisecond
+	defaultPoolBackoffMax  = 30 * time.Second
+)
+
+// PoolConfig 连接池的配置，连接数都是每个地址在每个事件循环上的数量
+type PoolConfig struct {
+	// MinIdle 保持的最少空闲连接数，不够时在后台建立连接，0表示不预先建立
+	MinIdle int
+
+	// MaxIdle 最多保留的空闲连接数，归还时超过的连接直接关闭，0表示8，小于MinIdle时使用MinIdle
+	MaxIdle int
+
+	// MaxLifetime 连接建立之后的最长使用时间，到期的空闲连接被关闭，借出的连接在归还时关闭，0表示不限制
+	MaxLifetime time.Duration
+
+	// HealthCheckInterval 检查空闲连接的周期，0表示不检查
+	HealthCheckInterval time.Duration
+
+	// Ping 健康检查时对每个已经建立的空闲连接调用，在事件循环中执行，比如发送一个PING命令，
+	// 对端的回复和其他数据一样交给OnTraffic。返回错误时关闭连接，为nil时只检查MaxLifetime
+	Ping func(c *Conn) error
+
+	// BackoffBase 连接失败之后第一次重连的等待时间，之后每失败一次翻倍，实际等待时间在一半到全部之间随机，0表示100毫秒
+	BackoffBase time.Duration
+
+	// BackoffMax 重连等待时间的上限，0表示30秒
+	BackoffMax time.Duration
+}
+
+// ConnPool 上游连接池，连接由服务器（或者Client）的事件循环驱动，回调和其他连接一样交给EventHandler。
+// Get、Put只能在事件循环中调用，比如OnTraffic，借出的连接和调用者在同一个事件循环上。
+// 连接池中的连接不会被迁移，服务器关闭时空闲连接直接关闭
+type ConnPool struct {
+	s       *Server
+	network string
+	config  PoolConfig
+	closed  int32
+}
+
+// 事件循环上分片的key
+type poolKey struct {
+	pool *ConnPool
+	addr string
+}
+
+// 一个地址在一个事件循环上的连接
+type poolShard struct {
+	pool     *ConnPool
+	loop     *EventLoop
+	addr     string
+	idle     []*Conn   // 空闲连接，包括正在建立的连接，后归还的先借出
+	failures int       // 连续失败的次数
+	retryAt  time.Time // 退避结束的时间，之前不发起新连接
+	retrying bool      // 已经设置了退避结束之后补充连接的定时器
+}
+
+// 连接在池中的状态，只在事件循环中访问
+type pooledConn struct {
+	shard   *poolShard
+	created time.Time
+	idle    bool // 在空闲列表中
+	closed  bool // 已经从池中移除
+}
+
+// NewConnPool 创建连接池，在s的事件循环上发起network（tcp、tcp4、tcp6或者unix）连接，可以在OnBoot中调用
+func NewConnPool(s *Server, network string, config PoolConfig) *ConnPool {
+	if config.MaxIdle <= 0 {
+		config.MaxIdle = defaultPoolMaxIdle
+	}
+	if config.MaxIdle < config.MinIdle {
+		config.MaxIdle = config.MinIdle
+	}
+	if config.BackoffBase <= 0 {
+		config.BackoffBase = defaultPoolBackoffBase
+	}
+	if config.BackoffMax <= 0 {
+		config.BackoffMax = defaultPoolBackoffMax
+	}
+	return &ConnPool{s: s, network: network, config: config}
+}
+
+// Get 在事件循环loop上借出一个到addr的连接，只能在loop中调用，通常传入当前连接的Conn.EventLoop()。
+// 优先使用已经建立的空闲连接，没有时发起新连接并立即返回，写入的数据在连接建立之后发送。
+// 连接失败之后的退避期间返回shleverror.ErrUpstreamUnavailable。用完之后要调用Put归还
+func (p *ConnPool) Get(addr string, loop *EventLoop) (*Conn, error) {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return nil, shleverror.ErrPoolClosed
+	}
+	if loop == nil || loop.server != p.s || loop.index < 0 {
+		return nil, shleverror.ErrInvalidEventLoop
+	}
+	if loop.exiting {
+		return nil, shleverror.ErrServerInShutdown
+	}
+	sh := loop.poolShard(p, addr)
+	c := sh.take()
+	if c == nil {
+		if time.Now().Before(sh.retryAt) {
+			return nil, shleverror.ErrUpstreamUnavailable
+		}
+		var err error
+		if c, err = sh.dial(); err != nil {
+			return nil, err
+		}
+	}
+	sh.refill()
+	return c, nil
+}
+
+// Put 归还Get借出的连接，只能在连接所属的事件循环中调用。归还之前要处理完对端的回复。
+// 连接已经关闭、到期、空闲连接已满或者连接池已经关闭时关闭连接
+func (p *ConnPool) Put(c *Conn) {
+	pc := c.pooled
+	if pc == nil || pc.shard.pool != p || pc.idle || pc.closed {
+		return
+	}
+	sh := pc.shard
+	if atomic.LoadInt32(&p.closed) == 1 || sh.loop.draining || sh.loop.exiting || c.closing ||
+		len(sh.idle) >= p.config.MaxIdle || sh.expired(c, time.Now()) {
+		pc.closed = true
+		_ = c.Close()
+		sh.refill()
+		return
+	}
+	pc.idle = true
+	sh.idle = append(sh.idle, c)
+}
+
+// Close 关闭连接池和所有空闲连接，借出的连接在归还时关闭，可以在任意goroutine中调用
+func (p *ConnPool) Close() {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return
+	}
+	p.s.lb.Iterate(func(_ int, e *EventLoop) bool {
+		err := e.netpoll.AddTask(func(_ interface{}) error {
+			for key, sh := range e.pools {
+				if key.pool != p {
+					continue
+				}
+				delete(e.pools, key)
+				for _, c := range append([]*Conn(nil), sh.idle...) {
+					sh.closeIdle(c)
+				}
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			logger.Error("failed to call AddTask on event-loop when closing pool:", err)
+		}
+		return true
+	})
+}
+
+// 事件循环上连接池的分片，第一次使用时创建并开始健康检查
+func (e *EventLoop) poolShard(p *ConnPool, addr string) *poolShard {
+	key := poolKey{pool: p, addr: addr}
+	if sh, ok := e.pools[key]; ok {
+		return sh
+	}
+	if e.pools == nil {
+		e.pools = make(map[poolKey]*poolShard)
+	}
+	sh := &poolShard{pool: p, loop: e, addr: addr}
+	e.pools[key] = sh
+	if d := p.config.HealthCheckInterval; d > 0 {
+		e.timers.AfterFunc(d, sh.check)
+	}
+	return sh
+}
+
+// 取出一个空闲连接，优先使用已经建立的连接，到期的连接直接关闭
+func (sh *poolShard) take() *Conn {
+	now := time.Now()
+	for _, c := range append([]*Conn(nil), sh.idle...) {
+		if sh.expired(c, now) {
+			sh.closeIdle(c)
+		}
+	}
+	if len(sh.idle) == 0 {
+		return nil
+	}
+	i := len(sh.idle) - 1
+	for j := i; j >= 0; j-- {
+		if !sh.idle[j].connecting {
+			i = j
+			break
+		}
+	}
+	c := sh.idle[i]
+	sh.remove(c)
+	return c
+}
+
+// 从空闲列表中删除
+func (sh *poolShard) remove(c *Conn) {
+	for i, ic := range sh.idle {
+		if ic == c {
+			sh.idle = append(sh.idle[:i], sh.idle[i+1:]...)
+			break
+		}
+	}
+	c.pooled.idle = false
+}
+
+// 关闭空闲连接
+func (sh *poolShard) closeIdle(c *Conn) {
+	if c.pooled.closed {
+		return
+	}
+	sh.remove(c)
+	c.pooled.closed = true
+	_ = sh.loop.closeConnection(c)
+}
+
+func (sh *poolShard) expired(c *Conn, now time.Time) bool {
+	d := sh.pool.config.MaxLifetime
+	return d > 0 && now.Sub(c.pooled.created) >= d
+}
+
+// 在分片的事件循环上发起连接，失败时开始退避
+func (sh *poolShard) dial() (*Conn, error) {
+	c, err := sh.pool.s.dial(sh.pool.network, sh.addr, nil, sh.loop, &pooledConn{shard: sh, created: time.Now()})
+	if err != nil {
+		logger.Warn(fmt.Sprintf("pool dial %s error:%v", sh.addr, err))
+		sh.fail()
+		return nil, err
+	}
+	return c, nil
+}
+
+// 补充空闲连接到MinIdle，退避期间设置定时器，等退避结束再补充。
+// 事件循环出错退出时先关闭所有连接再通知服务器关闭，这时关闭的空闲连接不能再补充
+func (sh *poolShard) refill() {
+	p := sh.pool
+	if atomic.LoadInt32(&p.closed) == 1 || sh.loop.draining || sh.loop.exiting || len(sh.idle) >= p.config.MinIdle {
+		return
+	}
+	select {
+	case <-p.s.shutdown:
+		return
+	default:
+	}
+	if wait := time.Until(sh.retryAt); wait > 0 {
+		if !sh.retrying {
+			sh.retrying = true
+			sh.loop.timers.AfterFunc(wait, func() error {
+				sh.retrying = false
+				sh.refill()
+				return nil
+			})
+		}
+		return
+	}
+	for len(sh.idle) < p.config.MinIdle {
+		c, err := sh.dial()
+		if err != nil {
+			// 等退避结束
+			sh.refill()
+			return
+		}
+		c.pooled.idle = true
+		sh.idle = append(sh.idle, c)
+	}
+}
+
+// 连接失败，按指数退避加随机抖动计算下一次发起连接的时间
+func (sh *poolShard) fail() {
+	cfg := sh.pool.config
+	sh.failures++
+	d := cfg.BackoffMax
+	if sh.failures < 32 {
+		if b := cfg.BackoffBase << (sh.failures - 1); b > 0 && b < d {
+			d = b
+		}
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	sh.retryAt = time.Now().Add(d)
+}
+
+// 健康检查：关闭到期和Ping失败的空闲连接，然后补充空闲连接
+func (sh *poolShard) check() error {
+	p := sh.pool
+	if atomic.LoadInt32(&p.closed) == 1 || sh.loop.draining || sh.loop.exiting {
+		return nil
+	}
+	now := time.Now()
+	for _, c := range append([]*Conn(nil), sh.idle...) {
+		if c.connecting || c.pooled.closed {
+			continue
+		}
+		if sh.expired(c, now) {
+			sh.closeIdle(c)
+			continue
+		}
+		if p.config.Ping != nil {
+			if err := p.config.Ping(c); err != nil {
+				logger.Warn(fmt.Sprintf("pool ping %s error:%v", sh.addr, err))
+				sh.closeIdle(c)
+			}
+		}
+	}
+	sh.refill()
+	sh.loop.timers.AfterFunc(p.config.HealthCheckInterval, sh.check)
+	return nil
+}
+
+// 连接有了结果，成功时结束退避，失败时开始退避
+func (pc *pooledConn) connected(err error) {
+	sh := pc.shard
+	if err != nil {
+		sh.fail()
+		return
+	}
+	sh.failures = 0
+	sh.retryAt = time.Time{}
+}
+
+// 连接关闭，从池中移除并补充空闲连接
+func (pc *pooledConn) release(c *Conn) {
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	if pc.idle {
+		pc.shard.remove(c)
+	}
+	pc.shard.refill()
+}
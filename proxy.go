@@ -0,0 +1,155 @@
+package shlev
+
+import (
+	"fmt"
+	"github.com/Senhnn/shlev/internal/proxyproto"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"time"
+)
+
+// 默认等待PROXY协议头的时间
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+// PROXY协议v2中常用的TLV类型
+const (
+	ProxyTLVALPN      = 0x01 // 客户端协商的应用层协议
+	ProxyTLVAuthority = 0x02 // 客户端请求的主机名，比如TLS的SNI
+	ProxyTLVCRC32C    = 0x03 // 头部的校验和，解析时已经校验
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05 // 代理为连接生成的唯一ID
+	ProxyTLVSSL       = 0x20 // 客户端的TLS信息，内部还有子TLV
+	ProxyTLVNetNS     = 0x30 // 代理接收连接的网络命名空间
+)
+
+// ProxyTLV PROXY协议v2头部中的扩展字段
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyTLVs PROXY协议v2头部中的扩展字段，没有开启PROXY协议或者是v1头部时为nil
+func (c *Conn) ProxyTLVs() []ProxyTLV {
+	return c.proxyTLVs
+}
+
+// ProxyTLV 返回类型为typ的第一个扩展字段
+func (c *Conn) ProxyTLV(typ byte) ([]byte, bool) {
+	for _, tlv := range c.proxyTLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// 监听器接收的连接是否要先发送PROXY协议头
+func (e *EventLoop) proxyProtocol(ln *Listener) bool {
+	return ln.Network != "udp" && (e.server.opts.ProxyProtocol || ln.lnOpts.ProxyProtocol)
+}
+
+// 连接注册之后等待PROXY协议头，超时之后关闭连接
+func (e *EventLoop) awaitProxyHeader(c *Conn) {
+	timeout := e.server.opts.ProxyHeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	c.AfterFunc(timeout, func(c *Conn) HandleResult {
+		if !c.awaitingProxy {
+			return None
+		}
+		logger.Warn(fmt.Sprintf("proxy protocol header timeout, fd:%d remote:%v", c.fd, c.remoteAddr))
+		return Close
+	})
+}
+
+// 解析接收缓冲区中的PROXY协议头，解析完之后用头部中的地址替换连接的地址，开始TLS握手或者调用OnOpen，
+// 返回false表示头部还不完整，或者连接已经关闭
+func (e *EventLoop) readProxyHeader(c *Conn) (bool, error) {
+	buf, _ := c.Peek(-1)
+	h, n, err := proxyproto.Parse(buf)
+	if err == shleverror.ErrIncompletePacket {
+		c.saveInbound()
+		return false, nil
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("invalid proxy protocol header, fd:%d remote:%v", c.fd, c.remoteAddr))
+		return false, e.closeConnection(c)
+	}
+
+	if !h.Local {
+		c.remoteAddr, c.localAddr = h.Source, h.Destination
+	}
+	if len(h.TLVs) > 0 {
+		// TLV指向接收缓冲区，拷贝一份
+		c.proxyTLVs = make([]ProxyTLV, len(h.TLVs))
+		for i, tlv := range h.TLVs {
+			c.proxyTLVs[i] = ProxyTLV{Type: tlv.Type, Value: append([]byte(nil), tlv.Value...)}
+		}
+	}
+	_, _ = c.Discard(n)
+	c.awaitingProxy = false
+
+	if e.handOverProxied(c) {
+		return false, nil
+	}
+	if err = e.establish(c); err != nil || !c.opened {
+		return false, err
+	}
+	return true, nil
+}
+
+// 负载均衡器按PROXY协议头中的源地址和TLV选择了另一个事件循环时，在开始TLS握手或者调用OnOpen之前把连接交过去，
+// 返回true表示连接已经不在当前事件循环。连接还没有交给用户，没有需要保持顺序的异步任务，不需要MigrateTo的暂存过程
+func (e *EventLoop) handOverProxied(c *Conn) bool {
+	lb, ok := e.server.lb.(ConnLoadBalancer)
+	if !ok || e.draining {
+		return false
+	}
+	to := lb.NextConn(c)
+	if to == nil || to == e {
+		return false
+	}
+	// 服务器正在关闭，目标事件循环可能已经退出，连接留在当前事件循环
+	select {
+	case <-e.server.shutdown:
+		return false
+	default:
+	}
+
+	if err := e.netpoll.Delete(c.fd); err != nil {
+		logger.Error(fmt.Sprintf("hand over fd:%d from eventloop(%d) error:%v", c.fd, e.index, err))
+		return false
+	}
+	delete(e.tcpConnectionMap, c.fd)
+	e.addConn(-1)
+	// 本次读到的数据指向当前事件循环的读缓冲区，先存入接收缓冲区
+	c.saveInbound()
+
+	c.mu.Lock()
+	c.loop = to
+	c.mu.Unlock()
+	if !to.deliver(to.openProxied, c) {
+		c.mu.Lock()
+		c.loop = e
+		c.mu.Unlock()
+		_ = e.adopt(c)
+		return !e.ownsConn(c)
+	}
+	return true
+}
+
+// 接管解析完PROXY协议头之后交过来的连接，开始TLS握手或者调用OnOpen，头部之后已经收到的数据交给OnTraffic
+func (e *EventLoop) openProxied(itf interface{}) error {
+	c := itf.(*Conn)
+	if err := e.adopt(c); err != nil || !e.ownsConn(c) {
+		return err
+	}
+	if err := e.establish(c); err != nil || !e.ownsConn(c) {
+		return err
+	}
+	if c.InboundBuffered() == 0 {
+		return nil
+	}
+	return e.wake(c)
+}
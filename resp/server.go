@@ -0,0 +1,217 @@
+package resp
+
+import (
+	"fmt"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"strings"
+)
+
+// 回复缓冲区超过这个大小时不再复用，避免一次大回复之后一直占用内存
+const maxReuseBufferSize = 64 * 1024
+
+// HandlerFunc 处理一个命令，在事件循环中调用，不能阻塞。每个命令要写入且只写入一个回复，
+// 回复在处理完接收缓冲区中所有的命令之后按顺序发送
+type HandlerFunc func(w *Writer, cmd *Command)
+
+// Command 客户端发送的一个命令
+type Command struct {
+	// Args 命令的参数，Args[0]是命令名，只在本次调用中有效，需要保存时要拷贝
+	Args [][]byte
+
+	// Conn 命令所在的连接，服务器用连接的Context保存解析状态，不要修改它，也不要从中读取数据
+	Conn *shlev.Conn
+
+	state *connState
+}
+
+// Name 大写的命令名
+func (cmd *Command) Name() string {
+	return strings.ToUpper(string(cmd.Args[0]))
+}
+
+// Context 连接上用户定义的上下文
+func (cmd *Command) Context() interface{} { return cmd.state.context }
+
+// SetContext 设置连接上用户定义的上下文，同一个连接之后的命令都能拿到
+func (cmd *Command) SetContext(ctx interface{}) { cmd.state.context = ctx }
+
+// 连接的解析状态
+type connState struct {
+	writer   Writer
+	need     int         // 接收缓冲区至少要有这么多数据才能解析出下一个命令
+	context  interface{} // 用户定义的上下文
+	closed   bool        // 回复发送完之后关闭连接
+	draining bool        // 服务器正在优雅关闭
+}
+
+// Server 运行在事件循环上的RESP服务器，实现了shlev.EventHandler，按命令名把命令分发给处理函数。
+// 支持pipelining，连接默认使用RESP2，客户端可以用HELLO 3切换到RESP3
+type Server struct {
+	// NotFound 没有注册的命令，nil时回复ERR unknown command
+	NotFound HandlerFunc
+
+	// MaxBulkLength 请求中bulk string的最大长度，0表示DefaultMaxBulkLength
+	MaxBulkLength int
+
+	// MaxElements 请求中参数的最大个数，0表示DefaultMaxElements
+	MaxElements int
+
+	handlers map[string]HandlerFunc
+}
+
+var _ shlev.DrainHandler = (*Server)(nil)
+
+// NewServer 创建RESP服务器
+func NewServer() *Server {
+	return &Server{handlers: make(map[string]HandlerFunc)}
+}
+
+// HandleFunc 注册命令的处理函数，命令名不区分大小写，要在服务器开启之前注册。
+// 注册了HELLO或者QUIT时替换内置的处理
+func (s *Server) HandleFunc(name string, fn HandlerFunc) {
+	if s.handlers == nil {
+		s.handlers = make(map[string]HandlerFunc)
+	}
+	s.handlers[strings.ToUpper(name)] = fn
+}
+
+func (s *Server) OnBoot(*shlev.Server) error { return nil }
+
+func (s *Server) OnShutdown(*shlev.Server) {}
+
+func (s *Server) OnConnectionClose(*shlev.Conn, error) {}
+
+func (s *Server) OnOpen(c *shlev.Conn, _ error) ([]byte, shlev.HandleResult) {
+	// 连接原来的Context（比如DialContext传入的）用Command.Context读取
+	c.SetContext(&connState{writer: Writer{proto: 2}, context: c.Context()})
+	return nil, shlev.None
+}
+
+// OnDrain 服务器优雅关闭时，空闲的连接直接关闭，收到了部分命令的连接处理完这一批命令之后关闭
+func (s *Server) OnDrain(c *shlev.Conn) {
+	st, ok := c.Context().(*connState)
+	if !ok {
+		return
+	}
+	st.draining = true
+	if c.InboundBuffered() == 0 {
+		st.closed = true
+		_ = c.Close()
+	}
+}
+
+// OnTraffic 依次处理接收缓冲区中所有完整的命令，回复合并之后一次写给连接
+func (s *Server) OnTraffic(c *shlev.Conn) shlev.HandleResult {
+	st, ok := c.Context().(*connState)
+	if !ok || st.closed {
+		_, _ = c.Discard(-1)
+		return shlev.Close
+	}
+	if c.InboundBuffered() < st.need {
+		return shlev.None
+	}
+
+	r := Reader{MaxBulkLength: s.MaxBulkLength, MaxElements: s.MaxElements}
+	buf, _ := c.Peek(-1)
+	offset := 0
+	for !st.closed && offset < len(buf) {
+		args, n, err := r.ReadCommand(buf[offset:])
+		if err == shleverror.ErrIncompletePacket {
+			st.need = n
+			break
+		}
+		if err != nil {
+			st.writer.WriteError("ERR Protocol error: " + strings.TrimPrefix(err.Error(), shleverror.ErrRESPProtocol.Error()+": "))
+			st.closed = true
+			break
+		}
+		offset += n
+		st.need = 0
+		if len(args) > 0 {
+			s.serve(c, st, args)
+		}
+	}
+	_, _ = c.Discard(offset)
+	s.flush(c, st)
+
+	if st.closed || st.draining {
+		st.closed = true
+		_, _ = c.Discard(-1)
+		_ = c.Close()
+	}
+	return shlev.None
+}
+
+// 处理一个命令，处理函数panic时回复错误并关闭连接
+func (s *Server) serve(c *shlev.Conn, st *connState, args [][]byte) {
+	w := &st.writer
+	mark := len(w.buf)
+	cmd := &Command{Args: args, Conn: c, state: st}
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Error(fmt.Sprintf("resp handler panic: %v, command %s", p, cmd.Name()))
+			w.buf = w.buf[:mark]
+			w.WriteError("ERR internal error")
+			st.closed = true
+		}
+	}()
+
+	name := cmd.Name()
+	if fn, ok := s.handlers[name]; ok {
+		fn(w, cmd)
+		return
+	}
+	switch name {
+	case "HELLO":
+		s.hello(w, cmd)
+	case "QUIT":
+		w.WriteOK()
+		st.closed = true
+	default:
+		if s.NotFound != nil {
+			s.NotFound(w, cmd)
+			return
+		}
+		w.WriteError("ERR unknown command '" + string(args[0]) + "'")
+	}
+}
+
+// 内置的HELLO [protover]，切换协议版本并回复服务器信息
+func (s *Server) hello(w *Writer, cmd *Command) {
+	switch {
+	case len(cmd.Args) > 2:
+		w.WriteError("ERR Syntax error in HELLO option")
+		return
+	case len(cmd.Args) == 2:
+		switch string(cmd.Args[1]) {
+		case "2":
+			w.proto = 2
+		case "3":
+			w.proto = 3
+		default:
+			w.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+	w.WriteMap(2)
+	w.WriteBulkString("server")
+	w.WriteBulkString("shlev")
+	w.WriteBulkString("proto")
+	w.WriteInt(int64(w.proto))
+}
+
+// 把缓存的回复写给连接
+func (s *Server) flush(c *shlev.Conn, st *connState) {
+	w := &st.writer
+	if len(w.buf) == 0 {
+		return
+	}
+	_, _ = c.Write(w.buf)
+	if cap(w.buf) > maxReuseBufferSize {
+		w.buf = nil
+	} else {
+		w.buf = w.buf[:0]
+	}
+}
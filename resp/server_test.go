@@ -0,0 +1,273 @@
+package resp_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/resp"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 日志写到临时目录，运行测试不会在包目录下留下shlev_net.log
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "shlev-log")
+	if err != nil {
+		panic(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "shlev_net.log"))
+	if err != nil {
+		panic(err)
+	}
+	logger.SetOutput(f)
+	code := m.Run()
+	_ = f.Close()
+	if code == 0 {
+		_ = os.RemoveAll(dir)
+	} else {
+		fmt.Println("log:", f.Name())
+	}
+	os.Exit(code)
+}
+
+func TestReadValue(t *testing.T) {
+	data := []byte("%2\r\n+ok\r\n*3\r\n:-12\r\n$-1\r\n_\r\n$5\r\nhello\r\n~2\r\n#t\r\n,1.5\r\n")
+	var r resp.Reader
+	// 每次多给一个字节，数据完整之前都返回ErrIncompletePacket，需要的长度不会超过完整的长度
+	for i := 0; i < len(data); i++ {
+		_, n, err := r.ReadValue(data[:i])
+		if err != shleverror.ErrIncompletePacket || n <= i || n > len(data) {
+			t.Fatalf("prefix %d: n=%d err=%v", i, n, err)
+		}
+	}
+	v, n, err := r.ReadValue(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if v.Type != resp.Map || len(v.Elems) != 4 {
+		t.Fatalf("unexpected value: %+v", v)
+	}
+	arr := v.Elems[1]
+	if arr.Elems[0].Int != -12 || !arr.Elems[1].IsNull || arr.Elems[2].Type != resp.Null {
+		t.Fatalf("unexpected array: %+v", arr)
+	}
+	if set := v.Elems[3]; set.Type != resp.Set || !set.Elems[0].Bool || set.Elems[1].Float != 1.5 {
+		t.Fatalf("unexpected set: %+v", set)
+	}
+	if got := resp.AppendValue(nil, v); !bytes.Equal(got, data) {
+		t.Fatalf("encode: %q", got)
+	}
+
+	for _, bad := range []string{"?x\r\n", ":12a\r\n", "$-2\r\n", "*1\n", "#x\r\n", "$3\r\nabcd\r\n"} {
+		if _, _, err := r.ReadValue([]byte(bad)); err == nil || err == shleverror.ErrIncompletePacket {
+			t.Fatalf("%q: expected protocol error, got %v", bad, err)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	var r resp.Reader
+	args, n, err := r.ReadCommand([]byte("set \"a b\" 'c\\'d'  x\r\nGET"))
+	if err != nil || n != 21 || len(args) != 4 || string(args[1]) != "a b" || string(args[2]) != "c'd" || string(args[3]) != "x" {
+		t.Fatalf("inline: %q %d %v", args, n, err)
+	}
+	if _, _, err = r.ReadCommand([]byte("set \"a\r\n")); err == nil {
+		t.Fatal("unbalanced quotes should fail")
+	}
+	args, n, err = r.ReadCommand([]byte("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))
+	if err != nil || n != 20 || string(args[0]) != "GET" || string(args[1]) != "k" {
+		t.Fatalf("multibulk: %q %d %v", args, n, err)
+	}
+	// 知道bulk string的长度之后，返回整个命令需要的长度
+	if _, n, err = r.ReadCommand([]byte("*1\r\n$100\r\nabc")); err != shleverror.ErrIncompletePacket || n != 112 {
+		t.Fatalf("incomplete: %d %v", n, err)
+	}
+	r.MaxBulkLength = 10
+	if _, _, err = r.ReadCommand([]byte("*1\r\n$100\r\n")); err == nil || err == shleverror.ErrIncompletePacket {
+		t.Fatalf("bulk length limit: %v", err)
+	}
+}
+
+func newServer() *resp.Server {
+	var store sync.Map
+	s := resp.NewServer()
+	s.HandleFunc("set", func(w *resp.Writer, cmd *resp.Command) {
+		if len(cmd.Args) != 3 {
+			w.WriteError("ERR wrong number of arguments for 'set' command")
+			return
+		}
+		store.Store(string(cmd.Args[1]), string(cmd.Args[2]))
+		w.WriteOK()
+	})
+	s.HandleFunc("GET", func(w *resp.Writer, cmd *resp.Command) {
+		if v, ok := store.Load(string(cmd.Args[1])); ok {
+			w.WriteBulkString(v.(string))
+		} else {
+			w.WriteNull()
+		}
+	})
+	s.HandleFunc("CLIENT", func(w *resp.Writer, cmd *resp.Command) {
+		switch strings.ToUpper(string(cmd.Args[1])) {
+		case "SETNAME":
+			cmd.SetContext(string(cmd.Args[2]))
+			w.WriteOK()
+		case "GETNAME":
+			name, _ := cmd.Context().(string)
+			w.WriteBulkString(name)
+		}
+	})
+	s.HandleFunc("CONFIG", func(w *resp.Writer, _ *resp.Command) {
+		w.WriteMap(1)
+		w.WriteBulkString("maxmemory")
+		w.WriteDouble(0.5)
+	})
+	s.HandleFunc("PANIC", func(w *resp.Writer, _ *resp.Command) {
+		w.WriteArray(2)
+		panic("boom")
+	})
+	return s
+}
+
+func startServer(t *testing.T, s *resp.Server) string {
+	srv, err := shlev.Start(s, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _ = srv.Shutdown(ctx)
+	})
+	return srv.Addr().String()
+}
+
+// 类似redis-cli的测试客户端
+type client struct {
+	net.Conn
+	buf []byte
+	r   resp.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	return &client{Conn: conn}
+}
+
+func (c *client) send(args ...string) {
+	w := bufio.NewWriter(c)
+	v := resp.Value{Type: resp.Array}
+	for _, arg := range args {
+		v.Elems = append(v.Elems, resp.Value{Type: resp.BulkString, Str: []byte(arg)})
+	}
+	_, _ = w.Write(resp.AppendValue(nil, v))
+	_ = w.Flush()
+}
+
+// 读取一个回复，返回它的RESP编码
+func (c *client) reply(t *testing.T) string {
+	t.Helper()
+	tmp := make([]byte, 4096)
+	for {
+		if len(c.buf) > 0 {
+			_, n, err := c.r.ReadValue(c.buf)
+			if err == nil {
+				s := string(c.buf[:n])
+				c.buf = c.buf[n:]
+				return s
+			}
+			if err != shleverror.ErrIncompletePacket {
+				t.Fatal(err)
+			}
+		}
+		n, err := c.Read(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.buf = append(c.buf, tmp[:n]...)
+	}
+}
+
+func (c *client) expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if got := c.reply(t); got != w {
+			t.Fatalf("got reply %q, want %q", got, w)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	addr := startServer(t, newServer())
+	c := dial(t, addr)
+
+	c.send("SET", "k", "v")
+	c.expect(t, "+OK\r\n")
+	c.send("get", "k")
+	c.expect(t, "$1\r\nv\r\n")
+
+	// 一次发送多个命令，混合内联命令，最后一个命令分两次发送
+	_, _ = c.Write([]byte("GET missing\r\n*2\r\n$6\r\nCLIENT\r\n$7\r\nGETNAME\r\n\r\nCLIENT SETNAME app\r\nFOO bar\r\n*2\r\n$3\r\nGET"))
+	c.expect(t, "$-1\r\n", "$0\r\n\r\n", "+OK\r\n", "-ERR unknown command 'FOO'\r\n")
+	_, _ = c.Write([]byte("\r\n$1\r\nk\r\nCLIENT GETNAME\r\n"))
+	c.expect(t, "$1\r\nv\r\n", "$3\r\napp\r\n")
+
+	// 大的bulk string分多次到达
+	large := strings.Repeat("x", 200*1024)
+	c.send("SET", "large", large)
+	c.expect(t, "+OK\r\n")
+	c.send("GET", "large")
+	c.expect(t, "$204800\r\n"+large+"\r\n")
+
+	c.send("CONFIG")
+	c.expect(t, "*2\r\n$9\r\nmaxmemory\r\n$3\r\n0.5\r\n")
+	c.send("HELLO", "3")
+	c.expect(t, "%2\r\n$6\r\nserver\r\n$5\r\nshlev\r\n$5\r\nproto\r\n:3\r\n")
+	c.send("CONFIG")
+	c.expect(t, "%1\r\n$9\r\nmaxmemory\r\n,0.5\r\n")
+	c.send("GET", "missing")
+	c.expect(t, "_\r\n")
+	c.send("HELLO", "4")
+	c.expect(t, "-NOPROTO unsupported protocol version\r\n")
+
+	c.send("QUIT")
+	c.expect(t, "+OK\r\n")
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection should be closed after QUIT, got %v", err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	addr := startServer(t, newServer())
+	cases := []struct {
+		req   string
+		reply string
+	}{
+		{"*1\r\n+PING\r\n", "-ERR Protocol error: expected '$', got '+'\r\n"},
+		{"*x\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"SET \"k v\r\n", "-ERR Protocol error: unbalanced quotes in request\r\n"},
+		{"PANIC\r\nGET k\r\n", "-ERR internal error\r\n"},
+	}
+	for _, tc := range cases {
+		c := dial(t, addr)
+		_, _ = c.Write([]byte(tc.req))
+		c.expect(t, tc.reply)
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%q: connection should be closed, got %v", tc.req, err)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package resp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"math"
+	"strconv"
+)
+
+// Type RESP值的类型，取值是协议中的类型前缀
+type Type byte
+
+const (
+	SimpleString   Type = '+'
+	Error          Type = '-'
+	Integer        Type = ':'
+	BulkString     Type = '$'
+	Array          Type = '*'
+	Null           Type = '_' // RESP3
+	Boolean        Type = '#' // RESP3
+	Double         Type = ',' // RESP3
+	BigNumber      Type = '(' // RESP3
+	BulkError      Type = '!' // RESP3
+	VerbatimString Type = '=' // RESP3
+	Map            Type = '%' // RESP3
+	Set            Type = '~' // RESP3
+	Attribute      Type = '|' // RESP3
+	Push           Type = '>' // RESP3
+)
+
+const (
+	// DefaultMaxBulkLength 默认的bulk string最大长度，和redis的proto-max-bulk-len相同
+	DefaultMaxBulkLength = 512 << 20 // 512MB
+	// DefaultMaxElements 默认的聚合类型最大元素个数
+	DefaultMaxElements = 1024 * 1024
+
+	// 内联命令的最大长度
+	maxInlineLength = 64 * 1024
+	// 聚合类型的最大嵌套深度
+	maxDepth = 64
+)
+
+// Value 解析出的一个RESP值，字符串类型的内容指向解析的缓冲区
+type Value struct {
+	Type Type
+
+	// Str SimpleString、Error、BulkString、BulkError、BigNumber的内容，
+	// VerbatimString的内容包含"txt:"这样的格式前缀
+	Str []byte
+
+	// Int Integer的值
+	Int int64
+
+	// Float Double的值
+	Float float64
+
+	// Bool Boolean的值
+	Bool bool
+
+	// Elems Array、Set、Push的元素，Map和Attribute按键、值、键、值的顺序保存
+	Elems []Value
+
+	// IsNull RESP2中长度为-1的bulk string和array
+	IsNull bool
+}
+
+// Reader 增量解析RESP数据，每次从缓冲区的开头解析一个完整的值。
+// 数据不完整时返回shleverror.ErrIncompletePacket，此时返回的长度是完成解析至少需要的字节数，
+// 数据没有到达这个长度之前不需要重新解析
+type Reader struct {
+	// MaxBulkLength bulk string的最大长度，0表示DefaultMaxBulkLength
+	MaxBulkLength int
+
+	// MaxElements 聚合类型的最大元素个数，0表示DefaultMaxElements
+	MaxElements int
+}
+
+func (r *Reader) maxBulkLength() int {
+	if r.MaxBulkLength <= 0 {
+		return DefaultMaxBulkLength
+	}
+	return r.MaxBulkLength
+}
+
+func (r *Reader) maxElements() int {
+	if r.MaxElements <= 0 {
+		return DefaultMaxElements
+	}
+	return r.MaxElements
+}
+
+func protocolError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{shleverror.ErrRESPProtocol}, args...)...)
+}
+
+// ReadValue 从b的开头解析一个RESP2或者RESP3的值，返回值和消费的字节数
+func (r *Reader) ReadValue(b []byte) (Value, int, error) {
+	return r.readValue(b, 0, 0)
+}
+
+func (r *Reader) readValue(b []byte, pos, depth int) (Value, int, error) {
+	if depth > maxDepth {
+		return Value{}, 0, protocolError("too deeply nested")
+	}
+	if pos >= len(b) {
+		return Value{}, pos + 1, shleverror.ErrIncompletePacket
+	}
+	line, end, err := readLine(b, pos+1)
+	if err != nil {
+		return Value{}, end, err
+	}
+	v := Value{Type: Type(b[pos])}
+	switch v.Type {
+	case SimpleString, Error, BigNumber:
+		v.Str = line
+	case Integer:
+		if v.Int, err = parseInt(line); err != nil {
+			return Value{}, 0, protocolError("invalid integer")
+		}
+	case Null:
+		if len(line) != 0 {
+			return Value{}, 0, protocolError("invalid null")
+		}
+	case Boolean:
+		if len(line) != 1 || (line[0] != 't' && line[0] != 'f') {
+			return Value{}, 0, protocolError("invalid boolean")
+		}
+		v.Bool = line[0] == 't'
+	case Double:
+		if v.Float, err = strconv.ParseFloat(string(line), 64); err != nil {
+			return Value{}, 0, protocolError("invalid double")
+		}
+	case BulkString, BulkError, VerbatimString:
+		n, err := parseInt(line)
+		if err != nil || n < -1 || n > int64(r.maxBulkLength()) || (n == -1 && v.Type != BulkString) {
+			return Value{}, 0, protocolError("invalid bulk length")
+		}
+		if n == -1 {
+			v.IsNull = true
+			return v, end, nil
+		}
+		if len(b) < end+int(n)+2 {
+			return Value{}, end + int(n) + 2, shleverror.ErrIncompletePacket
+		}
+		if b[end+int(n)] != '\r' || b[end+int(n)+1] != '\n' {
+			return Value{}, 0, protocolError("bulk string is not terminated by CRLF")
+		}
+		v.Str = b[end : end+int(n)]
+		end += int(n) + 2
+	case Array, Set, Push, Map, Attribute:
+		n, err := parseInt(line)
+		if err != nil || n < -1 || n > int64(r.maxElements()) || (n == -1 && v.Type != Array) {
+			return Value{}, 0, protocolError("invalid multibulk length")
+		}
+		if n == -1 {
+			v.IsNull = true
+			return v, end, nil
+		}
+		if v.Type == Map || v.Type == Attribute {
+			n *= 2
+		}
+		v.Elems = make([]Value, 0, minInt(int(n), 1024))
+		for i := 0; i < int(n); i++ {
+			var elem Value
+			if elem, end, err = r.readValue(b, end, depth+1); err != nil {
+				return Value{}, end, err
+			}
+			v.Elems = append(v.Elems, elem)
+		}
+	default:
+		return Value{}, 0, protocolError("invalid type byte '%c'", b[pos])
+	}
+	return v, end, nil
+}
+
+// ReadCommand 从b的开头解析一个命令，请求可以是bulk string组成的数组，也可以是内联命令。
+// 返回的参数指向b，空行和空数组返回长度为0的参数
+func (r *Reader) ReadCommand(b []byte) ([][]byte, int, error) {
+	if len(b) == 0 {
+		return nil, 1, shleverror.ErrIncompletePacket
+	}
+	if b[0] != byte(Array) {
+		return readInline(b)
+	}
+	line, end, err := readLine(b, 1)
+	if err != nil {
+		return nil, end, err
+	}
+	n, err := parseInt(line)
+	if err != nil || n > int64(r.maxElements()) {
+		return nil, 0, protocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, end, nil
+	}
+	args := make([][]byte, 0, minInt(int(n), 1024))
+	for i := 0; i < int(n); i++ {
+		if end >= len(b) {
+			return nil, end + 1, shleverror.ErrIncompletePacket
+		}
+		if b[end] != byte(BulkString) {
+			return nil, 0, protocolError("expected '$', got '%c'", b[end])
+		}
+		if line, end, err = readLine(b, end+1); err != nil {
+			return nil, end, err
+		}
+		size, err := parseInt(line)
+		if err != nil || size < 0 || size > int64(r.maxBulkLength()) {
+			return nil, 0, protocolError("invalid bulk length")
+		}
+		if len(b) < end+int(size)+2 {
+			return nil, end + int(size) + 2, shleverror.ErrIncompletePacket
+		}
+		if b[end+int(size)] != '\r' || b[end+int(size)+1] != '\n' {
+			return nil, 0, protocolError("bulk string is not terminated by CRLF")
+		}
+		args = append(args, b[end:end+int(size)])
+		end += int(size) + 2
+	}
+	return args, end, nil
+}
+
+// 解析内联命令，参数用空白分隔，支持单引号和双引号
+func readInline(b []byte) ([][]byte, int, error) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		if len(b) > maxInlineLength {
+			return nil, 0, protocolError("too big inline request")
+		}
+		return nil, len(b) + 1, shleverror.ErrIncompletePacket
+	}
+	if i > maxInlineLength {
+		return nil, 0, protocolError("too big inline request")
+	}
+	args, err := splitArgs(bytes.TrimSuffix(b[:i], []byte{'\r'}))
+	if err != nil {
+		return nil, 0, err
+	}
+	return args, i + 1, nil
+}
+
+func splitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	for {
+		line = bytes.TrimLeft(line, " \t")
+		if len(line) == 0 {
+			return args, nil
+		}
+		if q := line[0]; q != '"' && q != '\'' {
+			i := bytes.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+			args = append(args, line[:i])
+			line = line[i:]
+			continue
+		}
+		// 引号中的反斜杠只转义引号和反斜杠本身，结束引号之后必须是空白
+		q := line[0]
+		var arg []byte
+		i := 1
+		for ; i < len(line) && line[i] != q; i++ {
+			if line[i] == '\\' && i+1 < len(line) && (line[i+1] == q || line[i+1] == '\\') {
+				i++
+			}
+			arg = append(arg, line[i])
+		}
+		if i == len(line) || (i+1 < len(line) && line[i+1] != ' ' && line[i+1] != '\t') {
+			return nil, protocolError("unbalanced quotes in request")
+		}
+		args = append(args, arg)
+		line = line[i+1:]
+	}
+}
+
+// 读取从pos开始以CRLF结尾的一行，返回不包含CRLF的内容和下一行的位置
+func readLine(b []byte, pos int) ([]byte, int, error) {
+	i := bytes.IndexByte(b[pos:], '\n')
+	if i < 0 {
+		if len(b)-pos > maxInlineLength {
+			return nil, 0, protocolError("line is too long")
+		}
+		return nil, len(b) + 1, shleverror.ErrIncompletePacket
+	}
+	if i == 0 || b[pos+i-1] != '\r' {
+		return nil, 0, protocolError("line is not terminated by CRLF")
+	}
+	return b[pos : pos+i-1], pos + i + 1, nil
+}
+
+// 解析十进制整数，不分配内存
+func parseInt(b []byte) (int64, error) {
+	if len(b) == 0 {
+		return 0, strconv.ErrSyntax
+	}
+	neg := b[0] == '-'
+	if neg || b[0] == '+' {
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > 19 {
+		return 0, strconv.ErrSyntax
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, strconv.ErrSyntax
+		}
+		n = n*10 + uint64(c-'0')
+		if n > math.MaxInt64 {
+			return 0, strconv.ErrRange
+		}
+	}
+	if neg {
+		return -int64(n), nil
+	}
+	return int64(n), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// AppendValue 把v按RESP编码追加到b，不做RESP2和RESP3之间的转换
+func AppendValue(b []byte, v Value) []byte {
+	b = append(b, byte(v.Type))
+	switch v.Type {
+	case SimpleString, Error, BigNumber:
+		b = append(b, v.Str...)
+	case Integer:
+		b = strconv.AppendInt(b, v.Int, 10)
+	case Null:
+	case Boolean:
+		if v.Bool {
+			b = append(b, 't')
+		} else {
+			b = append(b, 'f')
+		}
+	case Double:
+		b = appendFloat(b, v.Float)
+	case BulkString, BulkError, VerbatimString:
+		if v.IsNull {
+			return append(b, "-1\r\n"...)
+		}
+		b = strconv.AppendInt(b, int64(len(v.Str)), 10)
+		b = append(b, '\r', '\n')
+		b = append(b, v.Str...)
+	case Array, Set, Push, Map, Attribute:
+		if v.IsNull {
+			return append(b, "-1\r\n"...)
+		}
+		n := len(v.Elems)
+		if v.Type == Map || v.Type == Attribute {
+			n /= 2
+		}
+		b = strconv.AppendInt(b, int64(n), 10)
+		b = append(b, '\r', '\n')
+		for _, elem := range v.Elems {
+			b = AppendValue(b, elem)
+		}
+		return b
+	}
+	return append(b, '\r', '\n')
+}
+
+// RESP3中的无穷大和NaN写成inf、-inf、nan
+func appendFloat(b []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(b, "inf"...)
+	case math.IsInf(f, -1):
+		return append(b, "-inf"...)
+	case math.IsNaN(f):
+		return append(b, "nan"...)
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, 64)
+}
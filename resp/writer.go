@@ -0,0 +1,126 @@
+package resp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 错误信息中的换行替换成空格
+var errorReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Writer 按连接协商的协议版本编码回复，RESP3特有的类型在RESP2下转换成兼容的类型。
+// 回复先缓存起来，处理完接收缓冲区中所有的命令之后一起写给连接
+type Writer struct {
+	buf   []byte
+	proto int
+}
+
+// Protocol 连接使用的协议版本，2或者3
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+func (w *Writer) appendHeader(t Type, n int) {
+	w.buf = append(w.buf, byte(t))
+	w.buf = strconv.AppendInt(w.buf, int64(n), 10)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// WriteSimpleString 写入简单字符串，s中不能有CR和LF
+func (w *Writer) WriteSimpleString(s string) {
+	w.buf = append(w.buf, byte(SimpleString))
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// WriteOK 写入+OK
+func (w *Writer) WriteOK() {
+	w.WriteSimpleString("OK")
+}
+
+// WriteError 写入错误，msg的第一个单词是错误码，比如"ERR syntax error"，其中的换行会替换成空格
+func (w *Writer) WriteError(msg string) {
+	w.buf = append(w.buf, byte(Error))
+	w.buf = append(w.buf, errorReplacer.Replace(msg)...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// WriteInt 写入整数
+func (w *Writer) WriteInt(n int64) {
+	w.buf = append(w.buf, byte(Integer))
+	w.buf = strconv.AppendInt(w.buf, n, 10)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// WriteBulk 写入bulk string
+func (w *Writer) WriteBulk(b []byte) {
+	w.appendHeader(BulkString, len(b))
+	w.buf = append(w.buf, b...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// WriteBulkString 写入bulk string
+func (w *Writer) WriteBulkString(s string) {
+	w.appendHeader(BulkString, len(s))
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// WriteNull 写入空值，RESP2中写成长度为-1的bulk string
+func (w *Writer) WriteNull() {
+	if w.proto >= 3 {
+		w.buf = append(w.buf, "_\r\n"...)
+		return
+	}
+	w.buf = append(w.buf, "$-1\r\n"...)
+}
+
+// WriteArray 写入数组的头部，之后要写入n个元素
+func (w *Writer) WriteArray(n int) {
+	w.appendHeader(Array, n)
+}
+
+// WriteMap 写入map的头部，之后要按键、值的顺序写入2n个元素，RESP2中写成长度为2n的数组
+func (w *Writer) WriteMap(n int) {
+	if w.proto >= 3 {
+		w.appendHeader(Map, n)
+		return
+	}
+	w.appendHeader(Array, 2*n)
+}
+
+// WriteSet 写入集合的头部，之后要写入n个元素，RESP2中写成数组
+func (w *Writer) WriteSet(n int) {
+	if w.proto >= 3 {
+		w.appendHeader(Set, n)
+		return
+	}
+	w.appendHeader(Array, n)
+}
+
+// WriteBool 写入布尔值，RESP2中写成整数1或0
+func (w *Writer) WriteBool(b bool) {
+	if w.proto >= 3 {
+		w.buf = AppendValue(w.buf, Value{Type: Boolean, Bool: b})
+		return
+	}
+	if b {
+		w.WriteInt(1)
+	} else {
+		w.WriteInt(0)
+	}
+}
+
+// WriteDouble 写入浮点数，RESP2中写成bulk string
+func (w *Writer) WriteDouble(f float64) {
+	if w.proto >= 3 {
+		w.buf = AppendValue(w.buf, Value{Type: Double, Float: f})
+		return
+	}
+	w.WriteBulk(appendFloat(nil, f))
+}
+
+// WriteValue 按原样写入一个值，不做协议版本的转换，用于转发其他服务器的回复
+func (w *Writer) WriteValue(v Value) {
+	w.buf = AppendValue(w.buf, v)
+}
@@ -43,59 +43,104 @@ type EventHandler interface {
 	OnTraffic(*Conn) HandleResult
 }
 
+// TickHandler 可选实现，开启WithTicker后服务器会在事件循环中周期性地调用OnTick
+type TickHandler interface {
+	// OnTick 返回距离下一次调用的时间和要执行的动作，返回Shutdown会关闭服务器
+	OnTick() (delay time.Duration, action HandleResult)
+}
+
+// DrainHandler 可选实现，Server.Shutdown停止接收新连接之后对每个连接调用OnDrain，
+// 可以在这里给对端发送GOAWAY之类的消息，或者调用Conn.Close在数据发送完之后关闭连接
+type DrainHandler interface {
+	OnDrain(*Conn)
+}
+
+// ConnectHandler 可选实现，Client.Dial、Server.Dial发起的连接有结果时在事件循环中调用OnConnect。
+// 连接成功时err为nil，之后和接收的连接一样调用OnOpen；连接失败、超时或者在建立之前被关闭时err不为nil，
+// 连接不会再调用OnOpen和OnConnectionClose
+type ConnectHandler interface {
+	OnConnect(c *Conn, err error)
+}
+
 var allServers sync.Map
 
+// Run 在addr上开启服务器，阻塞直到服务器关闭
 func Run(eventHandler EventHandler, addr string, opts ...OptionFunc) error {
+	return RunMulti(eventHandler, []string{addr}, opts...)
+}
+
+// RunMulti 在多个地址上开启同一个服务器，所有监听器共用事件循环，阻塞直到服务器关闭，
+// 可以用Conn.LocalAddr区分连接来自哪个监听器，Stop传入其中任意一个地址都可以关闭服务器
+func RunMulti(eventHandler EventHandler, addrs []string, opts ...OptionFunc) error {
+	s, err := StartMulti(eventHandler, addrs, opts...)
+	if err != nil {
+		return err
+	}
+	s.Wait()
+	return nil
+}
+
+// Start 在addr上开启服务器并立即返回，通过返回的Server获取监听地址和关闭服务器
+func Start(eventHandler EventHandler, addr string, opts ...OptionFunc) (*Server, error) {
+	return StartMulti(eventHandler, []string{addr}, opts...)
+}
+
+// StartMulti 在多个地址上开启同一个服务器并立即返回
+func StartMulti(eventHandler EventHandler, addrs []string, opts ...OptionFunc) (*Server, error) {
 	// 整理选项参数
 	options := loadOptions(opts...)
 
 	if options.LockOSThread && options.NumEventLoop > 10000 {
 		logger.Error(fmt.Sprintf("too many event-loops under LockOSThread mode, should be less than 10,000 "+
 			"while you are trying to set up %d\n", options.NumEventLoop))
-		return shleverror.ErrTooManyEventLoopThreads
+		return nil, shleverror.ErrTooManyEventLoopThreads
+	}
+	if len(addrs) == 0 {
+		return nil, shleverror.ErrEmptyListenAddr
 	}
 
 	// 目前写死，能跑了之后在加功能，64K
 	options.ReadBufferCap = MaxTcpBufferCap
 	options.WriteBufferCap = MaxTcpBufferCap
 
-	var l *Listener
-	var err error
-	if l, err = NewTCP4Listener(addr, options); err != nil {
-		logger.Error("Run err:", err)
-		return err
+	lns := make([]*Listener, 0, len(addrs))
+	closeListeners := func() {
+		for _, l := range lns {
+			l.Close()
+		}
+	}
+	for i, addr := range addrs {
+		l, err := NewListener(addr, options)
+		if err != nil {
+			logger.Error("Start err:", err)
+			closeListeners()
+			return nil, err
+		}
+		l.index = i
+		lns = append(lns, l)
 	}
-	defer l.Close()
 
-	return serve(eventHandler, l, options, addr)
+	s, err := serve(eventHandler, lns, options, addrs)
+	if err != nil {
+		closeListeners()
+		return nil, err
+	}
+	if options.InheritedListeners {
+		notifyHandoffReady()
+	}
+	return s, nil
 }
 
-// Stop 优雅关闭服务器且不中断任何活跃的事件循环，直到连接和事件循环都关闭，最后关闭服务器
+// Stop 按地址找到服务器并优雅关闭，ctx到期时强制关闭剩余的连接，参看Server.Shutdown
 func Stop(ctx context.Context, addr string) error {
-	var eng *Server
-	if s, ok := allServers.Load(addr); ok {
-		eng = s.(*Server)
-		eng.signalShutdown()
-		defer allServers.Delete(addr)
-	} else {
+	v, ok := allServers.Load(addr)
+	if !ok {
 		return shleverror.ErrServerInShutdown
 	}
-
+	eng := v.(*Server)
 	if eng.isInShutdown() {
 		return shleverror.ErrServerInShutdown
 	}
-
-	// 每一秒tick一次
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	for {
-		if eng.isInShutdown() {
-			return nil
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-		}
-	}
+	_, err := eng.Shutdown(ctx)
+	return err
 }
@@ -1,14 +1,62 @@
 package shlev
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
 	"golang.org/x/sys/unix"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// 测试的日志文件，需要检查日志的测试临时改写到其他地方之后再改回来
+var testLog *os.File
+
+// 日志写到临时目录，运行测试不会在包目录下留下shlev_net.log
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "shlev-log")
+	if err != nil {
+		panic(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "shlev_net.log"))
+	if err != nil {
+		panic(err)
+	}
+	testLog = f
+	logger.SetOutput(f)
+	code := m.Run()
+	_ = f.Close()
+	if code == 0 {
+		_ = os.RemoveAll(dir)
+	} else {
+		fmt.Println("log:", f.Name())
+	}
+	os.Exit(code)
+}
+
 func TestServer(t *testing.T) {
 	s := &testServer{}
 	fmt.Println("server run")
@@ -41,8 +89,8 @@ func (s *testServer) OnOpen(c *Conn, err error) (b []byte, e HandleResult) {
 }
 
 func (s *testServer) OnConnectionClose(c *Conn, _ error) {
-	if c.recvBuffer.Len() != 0 {
-		b := c.recvBuffer.Bytes()
+	if c.InboundBuffered() != 0 {
+		b, _ := c.Peek(-1)
 		fmt.Println(string(b))
 	}
 	//logger.Debug("OnConnectionClose localAddr:", c.LocalAddr(), "; remoteAddr:", c.RemoteAddr())
@@ -50,11 +98,2125 @@ func (s *testServer) OnConnectionClose(c *Conn, _ error) {
 }
 
 func (s *testServer) OnTraffic(c *Conn) HandleResult {
-	b := make([]byte, 100000)
-	n, err := c.Read(b)
+	b, err := c.Next(-1)
 	if err != nil {
 		return 0
 	}
-	fmt.Println("read data:", string(b[:n]))
+	fmt.Println("read data:", string(b))
+	return None
+}
+
+type tickServer struct {
+	testServer
+	srv     *Server
+	ticks   int
+	timerAt time.Time
+}
+
+func (s *tickServer) OnBoot(srv *Server) error {
+	s.srv = srv
+	return nil
+}
+
+func (s *tickServer) OnTick() (time.Duration, HandleResult) {
+	s.ticks++
+	if s.ticks == 1 {
+		start := time.Now()
+		s.srv.AfterFunc(50*time.Millisecond, func(*Server) HandleResult {
+			s.timerAt = time.Now()
+			logger.Debug("server timer fired after:", s.timerAt.Sub(start))
+			return None
+		})
+	}
+	if s.ticks == 5 {
+		return 0, Shutdown
+	}
+	return 20 * time.Millisecond, None
+}
+
+func TestServerTicker(t *testing.T) {
+	s := &tickServer{}
+	start := time.Now()
+	err := Run(s, "127.0.0.1:10002", WithNumEventLoop(2), WithTicker(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ticks != 5 {
+		t.Fatalf("OnTick called %d times, want 5", s.ticks)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("server stopped after %v, ticks fired too early", elapsed)
+	}
+	if s.timerAt.IsZero() {
+		t.Fatal("Server.AfterFunc callback not fired")
+	}
+}
+
+type asyncServer struct {
+	testServer
+	closedErr chan error
+}
+
+func (s *asyncServer) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = c.AsyncWrite([]byte(fmt.Sprintf("%03d", i)), nil)
+		}
+		_ = c.AsyncWritev([][]byte{[]byte("end"), []byte("\n")}, func(c *Conn, err error) error {
+			if err != nil {
+				s.closedErr <- err
+			}
+			return nil
+		})
+	}()
+	return nil, None
+}
+
+func (s *asyncServer) OnConnectionClose(c *Conn, _ error) {
+	// 连接关闭之后再异步写应该失败
+	go func() {
+		_ = c.AsyncWrite([]byte("late"), func(_ *Conn, err error) error {
+			s.closedErr <- err
+			return nil
+		})
+	}()
+}
+
+func TestConnAsyncWrite(t *testing.T) {
+	s := &asyncServer{closedErr: make(chan error, 2)}
+	addr := "127.0.0.1:10003"
+	go func() {
+		if err := Run(s, addr, WithNumEventLoop(2)); err != nil {
+			t.Log("run:", err)
+		}
+	}()
+	defer Stop(context.Background(), addr)
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want strings.Builder
+	for i := 0; i < 100; i++ {
+		want.WriteString(fmt.Sprintf("%03d", i))
+	}
+	want.WriteString("end\n")
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want.String() {
+		t.Fatalf("async writes out of order: %q", got)
+	}
+
+	_ = conn.Close()
+	select {
+	case err = <-s.closedErr:
+		if err != shleverror.ErrConnectionClosed {
+			t.Fatalf("AsyncWrite on closed connection: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AsyncWrite callback not called on closed connection")
+	}
+}
+
+type frameServer struct {
+	testServer
+}
+
+func (s *frameServer) OnOpen(*Conn, error) ([]byte, HandleResult) {
+	return nil, None
+}
+
+// 2字节长度+内容的简单协议，用Peek/Next处理半包
+func (s *frameServer) OnTraffic(c *Conn) HandleResult {
+	for {
+		header, err := c.Peek(2)
+		if err != nil {
+			return None
+		}
+		size := int(header[0])<<8 | int(header[1])
+		if c.InboundBuffered() < 2+size {
+			return None
+		}
+		_, _ = c.Discard(2)
+		body, _ := c.Next(size)
+		_, _ = c.Writev([][]byte{body, []byte("\n")})
+	}
+}
+
+func TestConnPeekNext(t *testing.T) {
+	addr := "127.0.0.1:10004"
+	go func() {
+		if err := Run(&frameServer{}, addr, WithNumEventLoop(1)); err != nil {
+			t.Log("run:", err)
+		}
+	}()
+	defer Stop(context.Background(), addr)
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var frames []byte
+	want := []string{"hello", strings.Repeat("x", 300), "world"}
+	for _, msg := range want {
+		frames = append(frames, byte(len(msg)>>8), byte(len(msg)))
+		frames = append(frames, msg...)
+	}
+	// 分成很多小段发送，制造半包
+	go func() {
+		for i := 0; i < len(frames); i += 7 {
+			end := i + 7
+			if end > len(frames) {
+				end = len(frames)
+			}
+			_, _ = conn.Write(frames[i:end])
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	rd := bufio.NewReader(conn)
+	for _, msg := range want {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != msg+"\n" {
+			t.Fatalf("got frame %q, want %q", line, msg)
+		}
+	}
+}
+
+// 构造一个上次OnTraffic留下head、本次读到buf的连接
+func newPeekConn(head, buf string) *Conn {
+	c := &Conn{}
+	_, _ = c.inboundBuffer.Write([]byte(head))
+	c.buffer = []byte(buf)
+	return c
+}
+
+func TestConnPeekZero(t *testing.T) {
+	c := newPeekConn("ab", "cd")
+	if b, err := c.Peek(0); err != nil || len(b) != 0 {
+		t.Fatalf("Peek(0) = %q %v", b, err)
+	}
+	if b, err := c.Next(0); err != nil || len(b) != 0 {
+		t.Fatalf("Next(0) = %q %v", b, err)
+	}
+	if n, err := c.Discard(0); err != nil || n != 0 {
+		t.Fatalf("Discard(0) = %d %v", n, err)
+	}
+	if n := c.InboundBuffered(); n != 4 {
+		t.Fatalf("%d bytes left after zero-length calls", n)
+	}
+	if b, _ := c.Peek(-1); string(b) != "abcd" {
+		t.Fatalf("Peek(-1) = %q", b)
+	}
+
+	// 跨越缓冲区拷贝出来的切片在之后的Peek、Next之后仍然有效，包括其他连接
+	other := newPeekConn("xy", "z")
+	a, _ := c.Next(3)
+	b, _ := other.Peek(3)
+	d, _ := c.Next(-1)
+	if string(a) != "abc" || string(b) != "xyz" || string(d) != "d" {
+		t.Fatalf("got %q %q %q", a, b, d)
+	}
+	if n, _ := c.Discard(-1); n != 0 || c.InboundBuffered() != 0 {
+		t.Fatalf("Discard(-1) = %d, %d bytes left", n, c.InboundBuffered())
+	}
+}
+
+func TestConnPeekAt(t *testing.T) {
+	c := newPeekConn("abc", "def")
+	for _, tc := range []struct {
+		off, n int
+		want   string
+	}{{0, 2, "ab"}, {2, 3, "cde"}, {3, -1, "def"}, {1, -1, "bcdef"}, {6, -1, ""}} {
+		if b, err := c.PeekAt(tc.off, tc.n); err != nil || string(b) != tc.want {
+			t.Fatalf("PeekAt(%d, %d) = %q %v, want %q", tc.off, tc.n, b, err, tc.want)
+		}
+	}
+	if _, err := c.PeekAt(4, 3); err != io.ErrShortBuffer {
+		t.Fatalf("PeekAt past the end: %v", err)
+	}
+	if n := c.InboundBuffered(); n != 6 {
+		t.Fatalf("PeekAt moved the read position, %d bytes left", n)
+	}
+}
+
+type udpServer struct {
+	testServer
+}
+
+func (s *udpServer) OnTraffic(c *Conn) HandleResult {
+	b, _ := c.Next(-1)
+	_, _ = c.Write([]byte(fmt.Sprintf("%s from %s", b, c.RemoteAddr())))
+	return None
+}
+
+func TestUDPServer(t *testing.T) {
+	for _, reusePort := range []bool{true, false} {
+		addr := "127.0.0.1:10005"
+		if !reusePort {
+			addr = "127.0.0.1:10006"
+		}
+		go func() {
+			if err := Run(&udpServer{}, "udp://"+addr, WithNumEventLoop(2), WithReusePort(reusePort)); err != nil {
+				t.Log("run:", err)
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		for i := 0; i < 3; i++ {
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _ = conn.Write([]byte("ping"))
+			buf := make([]byte, 128)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "ping from " + conn.LocalAddr().String(); string(buf[:n]) != want {
+				t.Fatalf("got %q, want %q", buf[:n], want)
+			}
+			_ = conn.Close()
+		}
+		_ = Stop(context.Background(), "udp://"+addr)
+	}
+}
+
+type echoServer struct {
+	testServer
+}
+
+func (s *echoServer) OnOpen(*Conn, error) ([]byte, HandleResult) {
+	return nil, None
+}
+
+func (s *echoServer) OnTraffic(c *Conn) HandleResult {
+	b, _ := c.Next(-1)
+	_, _ = c.Write(b)
+	return None
+}
+
+type unixServer struct {
+	echoServer
+}
+
+// 对端地址不是unix地址时直接关闭连接
+func (s *unixServer) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	if _, ok := c.RemoteAddr().(*net.UnixAddr); !ok {
+		return nil, Close
+	}
+	return nil, None
+}
+
+func TestUnixSocketInUse(t *testing.T) {
+	path := t.TempDir() + "/busy.sock"
+	// 一直不accept的监听套接字，把backlog占满，阻塞的connect会一直等下去
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err = unix.Bind(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		cfd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(cfd)
+		if err = unix.Connect(cfd, &unix.SockaddrUnix{Name: path}); err == unix.EAGAIN {
+			break
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		s, err := Start(&unixServer{}, "unix://"+path)
+		if err == nil {
+			_, _ = s.Shutdown(context.Background())
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if !errors.Is(err, unix.EADDRINUSE) {
+			t.Fatalf("got %v, want EADDRINUSE", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("probing the socket file blocked")
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("socket file of a live listener was removed: %v", err)
+	}
+}
+
+func TestUnixServer(t *testing.T) {
+	dir := t.TempDir()
+	for i, reusePort := range []bool{true, false} {
+		path := fmt.Sprintf("%s/shlev-%d.sock", dir, i)
+		// 模拟异常退出遗留的套接字文件
+		stale, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		_ = stale.Close()
+
+		addr := "unix://" + path
+		s := &unixServer{}
+		go func() {
+			if err := Run(s, addr, WithNumEventLoop(2), WithReusePort(reusePort), WithUnixSocketPerm(0600)); err != nil {
+				t.Log("run:", err)
+			}
+		}()
+
+		var conn net.Conn
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("unix", path); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+			t.Fatalf("socket file mode: %v %v", fi.Mode(), err)
+		}
+		_, _ = conn.Write([]byte("hello unix"))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != "hello unix" {
+			t.Fatalf("echo %q, %v", buf[:n], err)
+		}
+		_ = conn.Close()
+		_ = Stop(context.Background(), addr)
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("socket file not removed after stop: %v", err)
+		}
+	}
+
+	// 抽象命名空间
+	addr := fmt.Sprintf("unix://@shlev-test-%d", os.Getpid())
+	go func() {
+		_ = Run(&unixServer{}, addr, WithNumEventLoop(1))
+	}()
+	defer Stop(context.Background(), addr)
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", addr[len("unix://"):]); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("abstract"))
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "abstract" {
+		t.Fatalf("echo %q, %v", buf[:n], err)
+	}
+}
+
+type addrServer struct {
+	testServer
+}
+
+// 连接建立时把对端地址发给客户端
+func (s *addrServer) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	return []byte(c.RemoteAddr().String() + "\n"), None
+}
+
+func (s *addrServer) OnTraffic(*Conn) HandleResult {
+	return None
+}
+
+func TestIPv6Server(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("ipv6 is not available:", err)
+	} else {
+		_ = ln.Close()
+	}
+
+	cases := []struct {
+		addr     string
+		opts     []OptionFunc
+		dialIPv4 bool
+	}{
+		{addr: "tcp://[::]:10007", dialIPv4: true},
+		{addr: "tcp6://[::]:10008"},
+		{addr: "tcp://[::]:10009", opts: []OptionFunc{WithIPv6Only(true)}},
+	}
+	for _, tc := range cases {
+		go func(addr string, opts []OptionFunc) {
+			if err := Run(&addrServer{}, addr, opts...); err != nil {
+				t.Log("run:", err)
+			}
+		}(tc.addr, tc.opts)
+		time.Sleep(50 * time.Millisecond)
+
+		port := tc.addr[strings.LastIndex(tc.addr, ":"):]
+		for _, dial := range []struct{ network, addr string }{{"tcp6", "[::1]" + port}, {"tcp4", "127.0.0.1" + port}} {
+			conn, err := net.DialTimeout(dial.network, dial.addr, time.Second)
+			if dial.network == "tcp4" && !tc.dialIPv4 {
+				if err == nil {
+					_ = conn.Close()
+					t.Fatalf("%s: ipv4 connection accepted by ipv6-only listener", tc.addr)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tc.addr, err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", tc.addr, err)
+			}
+			if want := conn.LocalAddr().String() + "\n"; line != want {
+				t.Fatalf("%s: remote addr %q, want %q", tc.addr, line, want)
+			}
+			_ = conn.Close()
+		}
+		_ = Stop(context.Background(), tc.addr)
+	}
+
+	go func() {
+		if err := Run(&udpServer{}, "udp6://[::1]:10010"); err != nil {
+			t.Log("run:", err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn, err := net.Dial("udp6", "[::1]:10010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 128)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ping from " + conn.LocalAddr().String(); string(buf[:n]) != want {
+		t.Fatalf("got %q, want %q", buf[:n], want)
+	}
+	_ = conn.Close()
+	_ = Stop(context.Background(), "udp6://[::1]:10010")
+}
+
+func TestSourceAddrHash(t *testing.T) {
+	lb := &sourceAddrHashLoadBalancer{}
+	v4 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 80}
+	mapped := &net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 80}
+	if lb.hashAddr(v4) != lb.hashAddr(mapped) {
+		t.Fatal("ipv4 and ipv4-mapped ipv6 address should have the same hash")
+	}
+	a := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+	b := &net.TCPAddr{IP: net.ParseIP("2001:db8:0:0::1"), Port: 80, Zone: "eth0"}
+	if lb.hashAddr(a) != lb.hashAddr(b) {
+		t.Fatal("same ipv6 address should have the same hash")
+	}
+	if lb.hashAddr(a) == lb.hashAddr(&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}) {
+		t.Fatal("different ipv6 addresses should have different hash")
+	}
+}
+
+type multiServer struct {
+	testServer
+}
+
+// 连接建立时把接收连接的监听地址发给客户端
+func (s *multiServer) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	return []byte(c.LocalAddr().String() + "\n"), None
+}
+
+func (s *multiServer) OnTraffic(c *Conn) HandleResult {
+	_, _ = c.Next(-1)
+	_, _ = c.Write([]byte(c.LocalAddr().String() + "\n"))
+	return None
+}
+
+func TestRunMulti(t *testing.T) {
+	dir := t.TempDir()
+	for i, withUDP := range []bool{false, true} {
+		// 有udp监听器时使用端口复用模式，否则使用主从reactor模式
+		tcpAddr := fmt.Sprintf("127.0.0.1:%d", 10011+i*2)
+		udpAddr := fmt.Sprintf("127.0.0.1:%d", 10012+i*2)
+		path := fmt.Sprintf("%s/multi-%d.sock", dir, i)
+		addrs := []string{"tcp://" + tcpAddr, "unix://" + path}
+		if withUDP {
+			addrs = append(addrs, "udp://"+udpAddr)
+		}
+		go func() {
+			err := RunMulti(&multiServer{}, addrs, WithNumEventLoop(2),
+				WithListenerOptions(tcpAddr, ListenerOptions{Backlog: 16}))
+			if err != nil {
+				t.Log("run:", err)
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		dials := []struct{ network, addr, want string }{
+			{"tcp", tcpAddr, tcpAddr},
+			{"unix", path, path},
+		}
+		if withUDP {
+			dials = append(dials, struct{ network, addr, want string }{"udp", udpAddr, udpAddr})
+		}
+		for _, d := range dials {
+			conn, err := net.Dial(d.network, d.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			if d.network == "udp" {
+				_, _ = conn.Write([]byte("ping"))
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s %s: %v", d.network, d.addr, err)
+			}
+			if line != d.want+"\n" {
+				t.Fatalf("%s %s: local addr %q, want %q", d.network, d.addr, line, d.want)
+			}
+			_ = conn.Close()
+		}
+		// 任意一个地址都可以关闭服务器
+		if err := Stop(context.Background(), "unix://"+path); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := allServers.Load("tcp://" + tcpAddr); ok {
+			t.Fatal("server is still registered after stop")
+		}
+	}
+}
+
+func TestStartShutdown(t *testing.T) {
+	// 两个服务器使用相同的地址字符串，端口由内核分配
+	var servers []*Server
+	for _, reusePort := range []bool{true, false} {
+		s, err := Start(&echoServer{}, "tcp://127.0.0.1:0", WithNumEventLoop(2), WithReusePort(reusePort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Addr().(*net.TCPAddr).Port == 0 {
+			t.Fatal("server address should have the bound port")
+		}
+		servers = append(servers, s)
+	}
+	if servers[0].Addr().String() == servers[1].Addr().String() {
+		t.Fatal("servers should listen on different ports")
+	}
+
+	for _, s := range servers {
+		// 端口复用时每个事件循环的监听套接字都要绑定同一个端口
+		for i := 0; i < 4; i++ {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _ = conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("echo %q: %v", buf, err)
+			}
+			_ = conn.Close()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := servers[0].Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-servers[0].Done():
+	default:
+		t.Fatal("done channel should be closed after shutdown")
+	}
+	servers[0].Wait()
+
+	// 关闭一个服务器不影响另一个
+	select {
+	case <-servers[1].Done():
+		t.Fatal("other server should still be running")
+	default:
+	}
+	if _, err := servers[1].Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := Stop(ctx, "tcp://127.0.0.1:0"); err != shleverror.ErrServerInShutdown {
+		t.Fatalf("stop a closed server: %v", err)
+	}
+}
+
+func TestStartListenerFailure(t *testing.T) {
+	options := loadOptions(WithNumEventLoop(4))
+	options.ReadBufferCap = MaxTcpBufferCap
+	// 普通文件不能加入epoll，主响应器绑定第二个监听器时失败，这时从响应器已经启动
+	f, err := os.CreateTemp(t.TempDir(), "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// 从响应器要先收到关闭任务退出，之后才能关闭轮询器，否则会在已经关闭的epoll上出错或者一直阻塞
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(testLog)
+	for i := 0; i < 20; i++ {
+		good, err := NewListener("tcp://127.0.0.1:0", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := unix.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad := &Listener{Fd: fd, Network: "tcp", index: 1}
+		if _, err = serve(&echoServer{}, []*Listener{good, bad}, options, nil); err == nil {
+			t.Fatal("serve should fail on the second listener")
+		}
+		good.Close()
+		bad.Close()
+	}
+
+	buf := make([]byte, 1<<20)
+	deadline := time.Now().Add(time.Second)
+	for {
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		if !strings.Contains(stacks, "startSubReactors") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sub reactors still running after serve failed:\n%s", stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	logger.SetOutput(testLog)
+	if strings.Contains(logs.String(), "epoll_wait") {
+		t.Fatalf("sub reactors polled a closed epoll:\n%s", logs.String())
+	}
+}
+
+type drainServer struct {
+	echoServer
+	closeOnDrain bool
+}
+
+// 排空时通知对端，然后在数据发送完之后关闭连接
+func (s *drainServer) OnDrain(c *Conn) {
+	if s.closeOnDrain {
+		_, _ = c.Write([]byte("goaway\n"))
+		_ = c.Close()
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	for _, closeOnDrain := range []bool{true, false} {
+		s, err := Start(&drainServer{closeOnDrain: closeOnDrain}, "tcp://127.0.0.1:0", WithNumEventLoop(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conns []net.Conn
+		for i := 0; i < 3; i++ {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+		// 等待连接都注册到事件循环
+		for s.activeConns() != 3 {
+			time.Sleep(time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		report, err := s.Shutdown(ctx)
+		cancel()
+		if closeOnDrain {
+			if err != nil || report.Drained != 3 || report.ForceClosed != 0 {
+				t.Fatalf("drain: report=%+v err=%v", report, err)
+			}
+			for _, conn := range conns {
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				r := bufio.NewReader(conn)
+				if line, err := r.ReadString('\n'); err != nil || line != "goaway\n" {
+					t.Fatalf("read goaway: %q %v", line, err)
+				}
+				if _, err = r.ReadByte(); err != io.EOF {
+					t.Fatalf("connection should be closed after goaway: %v", err)
+				}
+			}
+		} else if err != context.DeadlineExceeded || report.Drained != 0 || report.ForceClosed != 3 {
+			t.Fatalf("force close: report=%+v err=%v", report, err)
+		}
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+}
+
+type nameServer struct {
+	testServer
+	name string
+}
+
+// 连接建立时发送服务器名字，收到quit时关闭服务器
+func (s *nameServer) OnOpen(*Conn, error) ([]byte, HandleResult) {
+	return []byte(s.name + "\n"), None
+}
+
+func (s *nameServer) OnTraffic(c *Conn) HandleResult {
+	if b, _ := c.Next(-1); string(b) == "quit" {
+		return Shutdown
+	}
 	return None
 }
+
+// 由TestHandoff启动的子进程
+func TestHandoffChild(t *testing.T) {
+	addrs := os.Getenv("SHLEV_TEST_HANDOFF_ADDRS")
+	if addrs == "" {
+		t.Skip("only run by TestHandoff")
+	}
+	var inherited map[string][]int
+	if err := json.Unmarshal([]byte(os.Getenv(EnvListenerFds)), &inherited); err != nil {
+		t.Fatal(err)
+	}
+	s, err := StartMulti(&nameServer{name: "child"}, strings.Split(addrs, ","), WithInheritedListeners())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 父进程端口复用的每个监听套接字都要继续接收连接，关闭会重置上面排队的连接
+	used := make(map[int]bool)
+	for _, ln := range s.mainLoop.listeners {
+		used[ln.Fd] = true
+	}
+	if n := len(inherited["tcp://127.0.0.1:0"]); n != 2 {
+		t.Fatalf("inherited %d tcp listeners", n)
+	}
+	for key, fds := range inherited {
+		for _, fd := range fds {
+			if !used[fd] {
+				t.Fatalf("inherited listener %s fd:%d is not used", key, fd)
+			}
+		}
+	}
+	s.Wait()
+}
+
+func TestHandoff(t *testing.T) {
+	path := t.TempDir() + "/handoff.sock"
+	addrs := []string{"tcp://127.0.0.1:0", "unix://" + path}
+	s, err := StartMulti(&nameServer{name: "parent"}, addrs, WithNumEventLoop(2), WithReusePort(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr := s.Addr().String()
+	hello := func(network, addr string) (net.Conn, string) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, strings.TrimSpace(line)
+	}
+	old, name := hello("tcp", tcpAddr)
+	if name != "parent" {
+		t.Fatalf("got %q before handoff", name)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffChild$")
+	cmd.Env = append(os.Environ(), "SHLEV_TEST_HANDOFF_ADDRS="+strings.Join(addrs, ","))
+	type result struct {
+		report ShutdownReport
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		report, err := s.Handoff(ctx, cmd)
+		done <- result{report, err}
+	}()
+
+	// 交接之后新连接由子进程处理，unix域套接字文件不能被父进程删除
+	for _, d := range []struct{ network, addr string }{{"tcp", tcpAddr}, {"unix", path}} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, name := hello(d.network, d.addr)
+			_ = conn.Close()
+			if name == "child" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s connection is not handled by child", d.network)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// 父进程等待旧连接关闭
+	select {
+	case <-done:
+		t.Fatal("handoff returned before old connection closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = old.Close()
+	res := <-done
+	if res.err != nil || res.report.Drained != 1 || res.report.ForceClosed != 0 {
+		t.Fatalf("handoff: report=%+v err=%v", res.report, res.err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatal("unix socket file removed after handoff:", err)
+	}
+
+	conn, name := hello("unix", path)
+	if name != "child" {
+		t.Fatalf("got %q after handoff", name)
+	}
+	_, _ = conn.Write([]byte("quit"))
+	if err = cmd.Wait(); err != nil {
+		t.Fatal("child exit:", err)
+	}
+	_ = conn.Close()
+}
+
+// 把所有连接都交给同一个事件循环
+type pinLoadBalancer struct {
+	BaseLoadBalancer
+	pin int
+}
+
+func (lb *pinLoadBalancer) Next(net.Addr) *EventLoop {
+	return lb.EventLoops[lb.pin]
+}
+
+func TestCustomLoadBalancer(t *testing.T) {
+	lb := &pinLoadBalancer{pin: 1}
+	s, err := Start(&echoServer{}, "tcp://127.0.0.1:0", WithNumEventLoop(3), WithCustomLoadBalancer(lb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write([]byte("ping"))
+		if _, err = io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lb.Iterate(func(i int, e *EventLoop) bool {
+		if e.Index() != i {
+			t.Fatalf("event loop %d has index %d", i, e.Index())
+		}
+		var conns int32
+		var in, out uint64
+		if i == lb.pin {
+			conns, in, out = 3, 12, 12
+		}
+		if e.ConnCount() != conns || e.BytesIn() != in || e.BytesOut() != out || e.PendingTasks() != 0 {
+			t.Fatalf("event loop %d: conns=%d in=%d out=%d tasks=%d", i, e.ConnCount(), e.BytesIn(), e.BytesOut(), e.PendingTasks())
+		}
+		return true
+	})
+}
+
+// 创建注册了n个事件循环的负载均衡器
+func newTestLoadBalancer(lb LoadBalancer, n int) LoadBalancer {
+	for i := 0; i < n; i++ {
+		lb.Register(&EventLoop{index: i})
+	}
+	return lb
+}
+
+func TestSourceIPHash(t *testing.T) {
+	for _, lb := range []LoadBalancer{
+		newTestLoadBalancer(newLoadBalancer(SourceIPHash), 4),
+		newTestLoadBalancer(newLoadBalancer(ConsistentHash), 4),
+	} {
+		// 同一个IP不同端口的连接交给同一个事件循环
+		el := lb.Next(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 10000})
+		for port := 10001; port < 10100; port++ {
+			if lb.Next(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: port}) != el {
+				t.Fatalf("%T: same ip with port %d goes to another event loop", lb, port)
+			}
+		}
+		// 不同IP尽量均匀分布
+		counts := make(map[int]int)
+		for i := 0; i < 4000; i++ {
+			counts[lb.Next(&net.TCPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i))}).Index()]++
+		}
+		for i := 0; i < 4; i++ {
+			if counts[i] < 500 {
+				t.Fatalf("%T: unbalanced distribution %v", lb, counts)
+			}
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	// 事件循环从4个变成5个时，大约1/5的IP换到新的事件循环，其他IP不动
+	lb4 := newTestLoadBalancer(newLoadBalancer(ConsistentHash), 4)
+	lb5 := newTestLoadBalancer(newLoadBalancer(ConsistentHash), 5)
+	moved := 0
+	const total = 10000
+	for i := 0; i < total; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(172, 16, byte(i>>8), byte(i))}
+		from, to := lb4.Next(addr).Index(), lb5.Next(addr).Index()
+		if from != to {
+			if to != 4 {
+				t.Fatalf("ip moved between old event loops: %d -> %d", from, to)
+			}
+			moved++
+		}
+	}
+	if moved > total*3/10 {
+		t.Fatalf("too many ips moved: %d/%d", moved, total)
+	}
+
+	// 按自定义key做hash
+	tenant := func(addr net.Addr) []byte { return []byte(addr.(*net.UnixAddr).Name[:7]) }
+	lb := newTestLoadBalancer(NewKeyHashLoadBalancer(tenant), 4)
+	if lb.Next(&net.UnixAddr{Name: "tenant1-a"}) != lb.Next(&net.UnixAddr{Name: "tenant1-b"}) {
+		t.Fatal("same key should go to the same event loop")
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	lb := newTestLoadBalancer(newLoadBalancer(PowerOfTwoChoices), 4).(*p2cLoadBalancer)
+	lb.EventLoops[0].addConn(100)
+	counts := make(map[int]int)
+	for i := 0; i < 3000; i++ {
+		counts[lb.Next(nil).Index()]++
+	}
+	// 连接数最多的事件循环不会被选中
+	if counts[0] != 0 {
+		t.Fatalf("busiest event loop selected %d times", counts[0])
+	}
+	for i := 1; i < 4; i++ {
+		if counts[i] < 700 {
+			t.Fatalf("unbalanced distribution %v", counts)
+		}
+	}
+}
+
+type busyServer struct {
+	echoServer
+}
+
+// 收到busy时模拟耗时的回调
+func (s *busyServer) OnTraffic(c *Conn) HandleResult {
+	b, _ := c.Next(-1)
+	if string(b) == "busy" {
+		time.Sleep(30 * time.Millisecond)
+	}
+	_, _ = c.Write(b)
+	return None
+}
+
+func TestLeastLoad(t *testing.T) {
+	s, err := Start(&busyServer{}, "tcp://127.0.0.1:0", WithNumEventLoop(2), WithLoadBalancing(LeastLoad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+	busy := dial()
+	defer busy.Close()
+	for i := 0; i < 3; i++ {
+		_, _ = busy.Write([]byte("busy"))
+		if _, err = io.ReadFull(busy, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 等待负载均衡器刷新统计数据
+	time.Sleep(2 * loadStatsRefresh)
+
+	// 新连接都交给空闲的事件循环
+	for i := 0; i < 4; i++ {
+		conn := dial()
+		defer conn.Close()
+	}
+	for deadline := time.Now().Add(time.Second); s.activeConns() != 5; {
+		if time.Now().After(deadline) {
+			t.Fatal("connections are not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stats := s.Stats()
+	if stats[0].Conns != 1 || stats[1].Conns != 4 {
+		t.Fatalf("unexpected distribution: %+v", stats)
+	}
+	if stats[0].BusyTime < 90*time.Millisecond || stats[0].BytesIn != 12 || stats[0].BytesOut != 12 || stats[0].Window <= 0 {
+		t.Fatalf("unexpected stats: %+v", stats[0])
+	}
+}
+
+func TestBusyTimeStats(t *testing.T) {
+	// 只有负载感知的负载均衡器或者开启了WithBusyTimeStats时才统计回调耗时
+	for _, busyStats := range []bool{false, true} {
+		opts := []OptionFunc{WithNumEventLoop(1)}
+		if busyStats {
+			opts = append(opts, WithBusyTimeStats())
+		}
+		s, err := Start(&busyServer{}, "tcp://127.0.0.1:0", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write([]byte("busy"))
+		if _, err = io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		busy := s.Stats()[0].BusyTime
+		// 不统计回调耗时的时候不轮转统计窗口，空闲的事件循环没有定时器
+		timers := make(chan int, 1)
+		s.lb.Iterate(func(_ int, e *EventLoop) bool {
+			_ = e.netpoll.AddTask(func(_ interface{}) error {
+				timers <- e.timers.Len()
+				return nil
+			}, nil)
+			return false
+		})
+		if n := <-timers; (n > 0) != busyStats {
+			t.Fatalf("BusyTimeStats %v: %d timers armed", busyStats, n)
+		}
+		_ = conn.Close()
+		_, _ = s.Shutdown(context.Background())
+		if (busy >= 30*time.Millisecond) != busyStats || (!busyStats && busy != 0) {
+			t.Fatalf("BusyTimeStats %v: busy time %v", busyStats, busy)
+		}
+	}
+}
+
+type migrateServer struct {
+	echoServer
+}
+
+// 收到migrate时一边迁移一边从其他goroutine异步写，收到where时返回当前的事件循环和迁移的目标
+func (s *migrateServer) OnTraffic(c *Conn) HandleResult {
+	b, _ := c.Next(-1)
+	switch string(b) {
+	case "migrate":
+		target := (c.loop.Index() + 1) % 2
+		c.SetContext(target)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 200; i++ {
+				_ = c.AsyncWrite([]byte(fmt.Sprintf("%03d\n", i)), nil)
+			}
+		}()
+		if err := c.MigrateTo(target); err != nil {
+			_, _ = c.Write([]byte(err.Error() + "\n"))
+		}
+		<-done
+	case "where":
+		_, _ = c.Write([]byte(fmt.Sprintf("%d %v\n", c.loop.Index(), c.Context())))
+	}
+	return None
+}
+
+func TestMigrateTo(t *testing.T) {
+	s, err := Start(&migrateServer{}, "tcp://127.0.0.1:0", WithNumEventLoop(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+
+	_, _ = conn.Write([]byte("migrate"))
+	// 迁移前后的异步写保持调用顺序
+	for i := 0; i < 200; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%03d\n", i); line != want {
+			t.Fatalf("got %q, want %q", line, want)
+		}
+	}
+	_, _ = conn.Write([]byte("where"))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cur, target int
+	if _, err = fmt.Sscanf(line, "%d %d", &cur, &target); err != nil || cur != target {
+		t.Fatalf("connection is not migrated: %q", line)
+	}
+	stats := s.Stats()
+	if stats[target].Conns != 1 || stats[1-target].Conns != 0 {
+		t.Fatalf("unexpected distribution: %+v", stats)
+	}
+}
+
+type migrateExitServer struct {
+	echoServer
+	opened chan *Conn
+	closed chan *Conn
+}
+
+func (s *migrateExitServer) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	s.opened <- c
+	return nil, None
+}
+
+func (s *migrateExitServer) OnConnectionClose(c *Conn, _ error) {
+	s.closed <- c
+}
+
+func TestMigrateToExitedLoop(t *testing.T) {
+	h := &migrateExitServer{opened: make(chan *Conn, 1), closed: make(chan *Conn, 1)}
+	s, err := Start(h, "tcp://127.0.0.1:0", WithNumEventLoop(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := <-h.opened
+	src := c.currentLoop()
+	dst := s.eventLoop(1 - src.Index())
+
+	// 目标事件循环阻塞在一个紧急任务中，迁移过去的连接排在它后面，它返回之后目标事件循环退出，不会执行接管任务
+	started, release := make(chan struct{}), make(chan struct{})
+	_ = dst.netpoll.AddUrgentTask(func(interface{}) error {
+		close(started)
+		<-release
+		return shleverror.ErrServerShutdown
+	}, nil)
+	<-started
+	_ = src.netpoll.AddTask(func(interface{}) error {
+		if err := c.MigrateTo(dst.Index()); err != nil {
+			t.Error(err)
+		}
+		return nil
+	}, nil)
+	for deadline := time.Now().Add(time.Second); c.currentLoop() != dst; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection is not handed over")
+		}
+	}
+	close(release)
+
+	// 目标事件循环退出时关闭还没有接管的连接
+	select {
+	case closed := <-h.closed:
+		if closed != c {
+			t.Fatal("another connection is closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection handed over to the exited event loop is not closed")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadAll(conn); err != nil {
+		t.Fatalf("connection should be closed, got %v", err)
+	}
+	if report, _ := s.Shutdown(context.Background()); report.ForceClosed != 1 || dst.ConnCount() != 0 {
+		t.Fatalf("unexpected report %+v, conns %d", report, dst.ConnCount())
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	lb := &pinLoadBalancer{pin: 0}
+	s, err := Start(&echoServer{}, "tcp://127.0.0.1:0", WithNumEventLoop(2), WithCustomLoadBalancer(lb),
+		WithRebalance(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	conns := make([]net.Conn, 6)
+	for i := range conns {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		stats := s.Stats()
+		if stats[0].Conns == 3 && stats[1].Conns == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connections are not rebalanced: %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// 迁移之后的连接仍然可以正常收发
+	for _, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write([]byte("ping"))
+		if _, err = io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type proxyServer struct {
+	echoServer
+	opens, closes int32
+}
+
+func (s *proxyServer) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	atomic.AddInt32(&s.opens, 1)
+	alpn, _ := c.ProxyTLV(ProxyTLVALPN)
+	return []byte(fmt.Sprintf("%v %v %s\n", c.RemoteAddr(), c.LocalAddr(), alpn)), None
+}
+
+func (s *proxyServer) OnConnectionClose(*Conn, error) {
+	atomic.AddInt32(&s.closes, 1)
+}
+
+// 构造PROXY协议v2头部，TCP over IPv4，带一个ALPN和CRC32C的TLV
+func proxyV2Header(cmd byte) []byte {
+	b := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	b = append(b, 0x20|cmd, 0x11, 0, 0)
+	b = append(b, 10, 0, 0, 1, 10, 0, 0, 2, 0x1f, 0x90, 0x00, 0x50)
+	b = append(b, ProxyTLVALPN, 0, 2, 'h', '2')
+	b = append(b, ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+	crc := crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(b[len(b)-4:], crc)
+	return b
+}
+
+func TestProxyProtocol(t *testing.T) {
+	h := &proxyServer{}
+	s, err := Start(h, "tcp://127.0.0.1:0", WithNumEventLoop(2), WithProxyProtocol(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 在关闭所有连接之后执行
+	t.Cleanup(func() { _, _ = s.Shutdown(context.Background()) })
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	expect := func(r *bufio.Reader, want string) {
+		t.Helper()
+		line, err := r.ReadString('\n')
+		if err != nil || line != want {
+			t.Fatalf("got %q %v, want %q", line, err, want)
+		}
+	}
+
+	// v1头部和数据一起到达
+	conn, r := dial()
+	_, _ = conn.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nping\n"))
+	expect(r, "192.168.0.1:56324 192.168.0.11:443 \n")
+	expect(r, "ping\n")
+
+	// v2头部分两次到达
+	conn, r = dial()
+	header := proxyV2Header(0x1)
+	_, _ = conn.Write(header[:20])
+	time.Sleep(10 * time.Millisecond)
+	_, _ = conn.Write(append(header[20:], "pong\n"...))
+	expect(r, "10.0.0.1:8080 10.0.0.2:80 h2\n")
+	expect(r, "pong\n")
+
+	// LOCAL命令保留真实的地址
+	conn, r = dial()
+	_, _ = conn.Write(proxyV2Header(0x0))
+	expect(r, fmt.Sprintf("%v %v h2\n", conn.LocalAddr(), s.Addr()))
+
+	opens := atomic.LoadInt32(&h.opens)
+	// 校验和错误、不是PROXY协议和超时的连接都直接关闭，不调用OnOpen和OnConnectionClose
+	bad := proxyV2Header(0x1)
+	bad[len(bad)-1]++
+	for _, data := range []string{string(bad), "GET / HTTP/1.1\r\n\r\n", "PROXY TCP4 1.2.3.4\r\n", ""} {
+		conn, r = dial()
+		_, _ = conn.Write([]byte(data))
+		if _, err = r.ReadByte(); err != io.EOF {
+			t.Fatalf("%q: connection should be closed, got %v", data, err)
+		}
+	}
+	if n := atomic.LoadInt32(&h.opens); n != opens {
+		t.Fatalf("OnOpen is called for %d invalid connections", n-opens)
+	}
+	if n := atomic.LoadInt32(&h.closes); n != 0 {
+		t.Fatalf("OnConnectionClose is called %d times", n)
+	}
+}
+
+// 按PROXY协议头中的租户TLV选择事件循环
+const proxyTLVTenant = 0xe0
+
+type tenantServer struct {
+	echoServer
+}
+
+func (s *tenantServer) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	tenant, _ := c.ProxyTLV(proxyTLVTenant)
+	return []byte(fmt.Sprintf("%s %d\n", tenant, c.EventLoop().Index())), None
+}
+
+func tenantKey(c *Conn) []byte {
+	if tenant, ok := c.ProxyTLV(proxyTLVTenant); ok {
+		return tenant
+	}
+	return ipKey(c.RemoteAddr())
+}
+
+func TestProxyTLVKeyHash(t *testing.T) {
+	lb := NewConnKeyHashLoadBalancer(tenantKey)
+	s, err := Start(&tenantServer{}, "tcp://127.0.0.1:0", WithNumEventLoop(4),
+		WithCustomLoadBalancer(lb), WithProxyProtocol(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = s.Shutdown(context.Background()) })
+
+	header := func(tenant string) []byte {
+		b := []byte("\r\n\r\n\x00\r\nQUIT\n")
+		b = append(b, 0x21, 0x11, 0, 0)
+		b = append(b, 10, 0, 0, 1, 10, 0, 0, 2, 0x1f, 0x90, 0x00, 0x50)
+		b = append(b, proxyTLVTenant, 0, byte(len(tenant)))
+		b = append(b, tenant...)
+		binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+		return b
+	}
+	loops := make(map[int]bool)
+	for _, tenant := range []string{"alpha", "beta", "gamma", "delta", "epsilon"} {
+		want := lb.(ConnLoadBalancer).NextConn(&Conn{proxyTLVs: []ProxyTLV{{Type: proxyTLVTenant, Value: []byte(tenant)}}}).Index()
+		loops[want] = true
+		// 接收连接时轮流分配，同一个租户的连接解析完头部之后都要交给同一个事件循环，头部之后的数据不能丢
+		for i := 0; i < 4; i++ {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, _ = conn.Write(append(header(tenant), "ping\n"...))
+			r := bufio.NewReader(conn)
+			for _, expect := range []string{fmt.Sprintf("%s %d\n", tenant, want), "ping\n"} {
+				if line, err := r.ReadString('\n'); err != nil || line != expect {
+					t.Fatalf("got %q %v, want %q", line, err, expect)
+				}
+			}
+		}
+	}
+	if len(loops) < 2 {
+		t.Fatal("all tenants hash to the same event loop")
+	}
+}
+
+type tlsServer struct {
+	echoServer
+	opens, closes int32
+}
+
+// 握手之后把SNI、ALPN、是否复用会话和客户端证书发给客户端
+func (s *tlsServer) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	atomic.AddInt32(&s.opens, 1)
+	state := c.TLSState()
+	var client string
+	if len(state.PeerCertificates) > 0 {
+		client = state.PeerCertificates[0].Subject.CommonName
+	}
+	return []byte(fmt.Sprintf("%s %s %v %s\n", state.ServerName, state.NegotiatedProtocol, state.DidResume, client)), None
+}
+
+func (s *tlsServer) OnConnectionClose(*Conn, error) {
+	atomic.AddInt32(&s.closes, 1)
+}
+
+// 生成自签名证书
+func newTestCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLS(t *testing.T) {
+	certs := map[string]tls.Certificate{
+		"a.example.com": newTestCertificate(t, "a.example.com"),
+		"b.example.com": newTestCertificate(t, "b.example.com"),
+	}
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, ok := certs[hello.ServerName]
+			if !ok {
+				return nil, fmt.Errorf("unknown server name %q", hello.ServerName)
+			}
+			return &cert, nil
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+		ClientAuth: tls.RequestClientCert,
+	}
+	h := &tlsServer{}
+	s, err := Start(h, "tcp://127.0.0.1:0", WithNumEventLoop(2), WithTLS(config), WithTLSHandshakeTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 在关闭所有连接之后执行
+	t.Cleanup(func() { _, _ = s.Shutdown(context.Background()) })
+
+	clientCert := newTestCertificate(t, "client-1")
+	sessions := tls.NewLRUClientSessionCache(4)
+	dial := func(serverName string, protos ...string) (*tls.Conn, *bufio.Reader) {
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         protos,
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+			ClientSessionCache: sessions,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	expect := func(r *bufio.Reader, want string) {
+		t.Helper()
+		line, err := r.ReadString('\n')
+		if err != nil || line != want {
+			t.Fatalf("got %q %v, want %q", line, err, want)
+		}
+	}
+
+	conn, r := dial("a.example.com", "http/1.1")
+	expect(r, "a.example.com http/1.1 false client-1\n")
+	if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "a.example.com" {
+		t.Fatalf("got certificate for %q", cn)
+	}
+	// 大于一个TLS记录的数据
+	large := make([]byte, 1<<20)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	go func() { _, _ = conn.Write(large) }()
+	got := make([]byte, len(large))
+	if _, err = io.ReadFull(r, got); err != nil || string(got) != string(large) {
+		t.Fatalf("echo mismatch: %v", err)
+	}
+
+	// 读到数据之后客户端已经收到了会话票据，第二个连接复用会话
+	conn, r = dial("b.example.com", "h2")
+	expect(r, "b.example.com h2 false client-1\n")
+	_, _ = conn.Write([]byte("ping\n"))
+	expect(r, "ping\n")
+	_, r = dial("b.example.com", "h2")
+	expect(r, "b.example.com h2 true client-1\n")
+
+	// 握手完成之后连接由事件循环读写，握手goroutine交回连接之后就退出
+	buf := make([]byte, 1<<20)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		if !strings.Contains(stacks, "runHandshake") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("handshake goroutines are still running:\n%s", stacks)
+		}
+	}
+
+	// 明文请求、未知的SNI和握手超时的连接都直接关闭，不调用OnOpen和OnConnectionClose
+	opens := atomic.LoadInt32(&h.opens)
+	for _, data := range []string{"GET / HTTP/1.1\r\n\r\n", ""} {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _ = conn.Write([]byte(data))
+		if _, err = io.ReadAll(conn); err != nil {
+			t.Fatalf("%q: connection should be closed, got %v", data, err)
+		}
+	}
+	if _, err = tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "c.example.com", InsecureSkipVerify: true}); err == nil {
+		t.Fatal("handshake with unknown server name should fail")
+	}
+	if n := atomic.LoadInt32(&h.opens); n != opens {
+		t.Fatalf("OnOpen is called for %d failed handshakes", n-opens)
+	}
+	if n := atomic.LoadInt32(&h.closes); n != 0 {
+		t.Fatalf("OnConnectionClose is called %d times", n)
+	}
+}
+
+func TestMaxTLSHandshakes(t *testing.T) {
+	cert := newTestCertificate(t, "a.example.com")
+	h := &tlsServer{}
+	s, err := Start(h, "tcp://127.0.0.1:0", WithNumEventLoop(1), WithMaxTLSHandshakes(1),
+		WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = s.Shutdown(context.Background()) })
+
+	// 第一个连接不发送数据，一直占用握手数量，第二个连接在握手超时之前就被关闭
+	idle, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = idle.Close() })
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.ReadAll(conn); err != nil {
+		t.Fatalf("connection over the handshake limit should be closed, got %v", err)
+	}
+
+	// 第一个连接关闭之后握手goroutine退出，新连接可以正常握手
+	_ = idle.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		tc, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true})
+		if err == nil {
+			_ = tc.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("handshake after the idle connection closed: %v", err)
+		}
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	cert := newTestCertificate(t, "a.example.com")
+	h := &tlsServer{}
+	s, err := Start(h, "tcp://127.0.0.1:0", WithNumEventLoop(2), WithProxyProtocol(time.Second),
+		WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = s.Shutdown(context.Background()) })
+
+	// PROXY协议头和ClientHello在同一个TCP段中，头部之后的密文在解析完头部之后继续握手，TLS 1.2和1.3都支持
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		raw, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = raw.Close() })
+		_ = raw.SetDeadline(time.Now().Add(3 * time.Second))
+		conn := tls.Client(&prefixConn{Conn: raw, prefix: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1234 443\r\n")},
+			&tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true, MaxVersion: version})
+		r := bufio.NewReader(conn)
+		if line, err := r.ReadString('\n'); err != nil || line != "a.example.com  false \n" {
+			t.Fatalf("got %q %v", line, err)
+		}
+		if v := conn.ConnectionState().Version; v != version {
+			t.Fatalf("negotiated version %x, want %x", v, version)
+		}
+		_, _ = conn.Write([]byte("ping\n"))
+		if line, err := r.ReadString('\n'); err != nil || line != "ping\n" {
+			t.Fatalf("got %q %v", line, err)
+		}
+	}
+}
+
+// 第一次写入之前带上前缀
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Write(p []byte) (int, error) {
+	if c.prefix != nil {
+		_, err := c.Conn.Write(append(c.prefix, p...))
+		c.prefix = nil
+		return len(p), err
+	}
+	return c.Conn.Write(p)
+}
+
+type dialHandler struct {
+	testServer
+	connects chan error
+	data     chan string
+	opens    int32
+}
+
+func (h *dialHandler) OnConnect(_ *Conn, err error) {
+	h.connects <- err
+}
+
+// 连接建立之后带上Context打招呼
+func (h *dialHandler) OnOpen(c *Conn, _ error) ([]byte, HandleResult) {
+	atomic.AddInt32(&h.opens, 1)
+	return []byte(fmt.Sprintf("hello %v %T\n", c.Context(), c.LocalAddr())), None
+}
+
+func (h *dialHandler) OnTraffic(c *Conn) HandleResult {
+	b, _ := c.Next(-1)
+	h.data <- string(b)
+	return None
+}
+
+func (h *dialHandler) waitConnect(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-h.connects:
+		return err
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnConnect is not called")
+		return nil
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv, err := Start(&echoServer{}, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &dialHandler{connects: make(chan error, 4), data: make(chan string, 16)}
+	cli, err := NewClient(h, WithNumEventLoop(2), WithConnectTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 先关闭客户端，服务器的连接随之关闭
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _ = cli.Shutdown(ctx)
+		_, _ = srv.Shutdown(ctx)
+	})
+
+	c, err := cli.DialContext("tcp", srv.Addr().String(), "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 连接建立之前写入的数据排在OnOpen返回的数据前面
+	_ = c.AsyncWrite([]byte("early\n"), nil)
+	if err = h.waitConnect(t); err != nil {
+		t.Fatal(err)
+	}
+	want := "early\nhello upstream *net.TCPAddr\n"
+	var got string
+	for len(got) < len(want) {
+		select {
+		case s := <-h.data:
+			got += s
+		case <-time.After(3 * time.Second):
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	_ = c.Close()
+
+	// 端口没有监听，连接被拒绝
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := ln.Addr().String()
+	_ = ln.Close()
+	if _, err = cli.Dial("tcp", refused); err == nil {
+		err = h.waitConnect(t)
+	}
+	if !errors.Is(err, unix.ECONNREFUSED) {
+		t.Fatalf("expected connection refused, got %v", err)
+	}
+
+	// 连接队列已满的监听套接字丢弃SYN，连接超时
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err = unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := unix.Getsockname(fd)
+	full := fmt.Sprintf("127.0.0.1:%d", sa.(*unix.SockaddrInet4).Port)
+	for i := 0; i < 8; i++ {
+		conn, err := net.DialTimeout("tcp", full, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		defer conn.Close()
+	}
+	if _, err = cli.Dial("tcp", full); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.waitConnect(t); err != shleverror.ErrConnectTimeout {
+		t.Fatalf("expected connect timeout, got %v", err)
+	}
+
+	if _, err = cli.Dial("udp", full); err != shleverror.ErrUnsupportedProtocol {
+		t.Fatalf("expected unsupported protocol, got %v", err)
+	}
+	if n := atomic.LoadInt32(&h.opens); n != 1 {
+		t.Fatalf("OnOpen is called %d times", n)
+	}
+}
+
+type connectCounter struct {
+	testServer
+	connects int32
+}
+
+func (h *connectCounter) OnConnect(_ *Conn, err error) {
+	if err == nil {
+		atomic.AddInt32(&h.connects, 1)
+	}
+}
+
+func (h *connectCounter) OnOpen(*Conn, error) ([]byte, HandleResult) {
+	return nil, None
+}
+
+func (h *connectCounter) OnTraffic(*Conn) HandleResult {
+	return None
+}
+
+func TestClientConcurrentDial(t *testing.T) {
+	srv, err := Start(&echoServer{}, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不排空，直接关闭剩下的连接
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer srv.Shutdown(closed)
+
+	// 多个goroutine同时Dial，负载均衡器的Next不能同时被调用，用-race运行时可以发现数据竞争
+	for _, lb := range []LoadBalancing{RoundRobin, PowerOfTwoChoices, LeastLoad} {
+		h := &connectCounter{}
+		cli, err := NewClient(h, WithNumEventLoop(4), WithLoadBalancing(lb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		const dialers, dials = 8, 16
+		var wg sync.WaitGroup
+		for i := 0; i < dialers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < dials; j++ {
+					if _, err := cli.Dial("tcp", srv.Addr().String()); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		deadline := time.Now().Add(3 * time.Second)
+		for atomic.LoadInt32(&h.connects) < dialers*dials && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := atomic.LoadInt32(&h.connects); n != dialers*dials {
+			t.Fatalf("balancer %d: %d connects, want %d", lb, n, dialers*dials)
+		}
+		_, _ = cli.Shutdown(closed)
+	}
+}
+
+type countServer struct {
+	echoServer
+	opens, closes int32
+}
+
+func (s *countServer) OnOpen(*Conn, error) ([]byte, HandleResult) {
+	atomic.AddInt32(&s.opens, 1)
+	return nil, None
+}
+
+func (s *countServer) OnConnectionClose(*Conn, error) {
+	atomic.AddInt32(&s.closes, 1)
+}
+
+// 把客户端的请求通过连接池转发给上游
+type gatewayServer struct {
+	testServer
+	upstream string
+	config   PoolConfig
+	pool     *ConnPool
+}
+
+func (g *gatewayServer) OnBoot(s *Server) error {
+	g.pool = NewConnPool(s, "tcp", g.config)
+	return nil
+}
+
+func (g *gatewayServer) OnOpen(*Conn, error) ([]byte, HandleResult) {
+	return nil, None
+}
+
+func (g *gatewayServer) OnTraffic(c *Conn) HandleResult {
+	b, _ := c.Next(-1)
+	if c.pooled != nil {
+		// 没有对应的客户端时是健康检查的回复
+		if client, ok := c.Context().(*Conn); ok {
+			c.SetContext(nil)
+			_, _ = client.Write(b)
+			g.pool.Put(c)
+		}
+		return None
+	}
+	up, err := g.pool.Get(g.upstream, c.EventLoop())
+	if err != nil {
+		_, _ = c.Write([]byte(err.Error() + "\n"))
+		return None
+	}
+	if up.EventLoop() != c.EventLoop() {
+		_, _ = c.Write([]byte("upstream is on another event loop\n"))
+		return None
+	}
+	up.SetContext(c)
+	_, _ = up.Write(b)
+	return None
+}
+
+func TestConnPool(t *testing.T) {
+	up := &countServer{}
+	upSrv, err := Start(up, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pings int32
+	g := &gatewayServer{upstream: upSrv.Addr().String(), config: PoolConfig{
+		MinIdle:             1,
+		MaxIdle:             2,
+		MaxLifetime:         300 * time.Millisecond,
+		HealthCheckInterval: 50 * time.Millisecond,
+		Ping: func(c *Conn) error {
+			atomic.AddInt32(&pings, 1)
+			_, err := c.Write([]byte("ping\n"))
+			return err
+		},
+	}}
+	gw, err := Start(g, "tcp://127.0.0.1:0", WithNumEventLoop(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 上游、网关连接池里的连接都在客户端连接关闭之后关闭
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := gw.Shutdown(ctx); err != nil {
+			t.Errorf("gateway shutdown: %v", err)
+		}
+		if _, err := upSrv.Shutdown(ctx); err != nil {
+			t.Errorf("upstream shutdown: %v", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", gw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	r := bufio.NewReader(conn)
+	for i := 0; i < 5; i++ {
+		req := fmt.Sprintf("req %d\n", i)
+		_, _ = conn.Write([]byte(req))
+		if line, err := r.ReadString('\n'); err != nil || line != req {
+			t.Fatalf("got %q %v, want %q", line, err, req)
+		}
+	}
+	// 借出的一个连接加上保持的一个空闲连接，之后的请求复用
+	if n := atomic.LoadInt32(&up.opens); n > 2 {
+		t.Fatalf("upstream opened %d connections", n)
+	}
+
+	// 健康检查发送ping，到期的连接被关闭并重新建立
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&up.closes) == 0 || atomic.LoadInt32(&pings) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pings:%d closes:%d", atomic.LoadInt32(&pings), atomic.LoadInt32(&up.closes))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, _ = conn.Write([]byte("again\n"))
+	if line, err := r.ReadString('\n'); err != nil || line != "again\n" {
+		t.Fatalf("got %q %v", line, err)
+	}
+
+	// 上游连不上时退避，退避期间不再发起连接
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := &gatewayServer{upstream: ln.Addr().String(), config: PoolConfig{BackoffBase: time.Second}}
+	_ = ln.Close()
+	downSrv, err := Start(down, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _ = downSrv.Shutdown(ctx)
+	}()
+	dc, err := net.Dial("tcp", downSrv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	_ = dc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _ = dc.Write([]byte("lost\n"))
+	time.Sleep(100 * time.Millisecond)
+	_, _ = dc.Write([]byte("retry\n"))
+	if line, err := bufio.NewReader(dc).ReadString('\n'); err != nil || line != shleverror.ErrUpstreamUnavailable.Error()+"\n" {
+		t.Fatalf("got %q %v", line, err)
+	}
+}
+
+// 收到quit时让事件循环出错退出
+type quitGatewayServer struct {
+	gatewayServer
+}
+
+func (g *quitGatewayServer) OnTraffic(c *Conn) HandleResult {
+	if b, _ := c.Peek(-1); c.pooled == nil && string(b) == "quit\n" {
+		return Shutdown
+	}
+	return g.gatewayServer.OnTraffic(c)
+}
+
+func TestConnPoolLoopExit(t *testing.T) {
+	up := &countServer{}
+	upSrv, err := Start(up, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _ = upSrv.Shutdown(ctx)
+	}()
+	g := &quitGatewayServer{gatewayServer{upstream: upSrv.Addr().String(), config: PoolConfig{MinIdle: 2}}}
+	gw, err := Start(g, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", gw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _ = conn.Write([]byte("req\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "req\n" {
+		t.Fatalf("got %q %v", line, err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&up.opens) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream opened %d connections", atomic.LoadInt32(&up.opens))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 事件循环退出时关闭的池中连接不能触发补充
+	_, _ = conn.Write([]byte("quit\n"))
+	select {
+	case <-gw.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("gateway did not exit")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&up.opens); n != 3 {
+		t.Fatalf("upstream opened %d connections after the event loop exited", n)
+	}
+}
@@ -1,55 +1,191 @@
 package shlev
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"github.com/Senhnn/shlev/internal/netpoll"
 	"github.com/Senhnn/shlev/internal/socket"
 	"github.com/Senhnn/shlev/tools/logger"
 	"github.com/Senhnn/shlev/tools/shleverror"
 	"golang.org/x/sys/unix"
+	"net"
 	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	ln           *Listener      // 监听器，监听端口建立连接
-	lb           loadBalancer   // 负载均衡算法
+	lns          []*Listener    // 监听器，监听端口建立连接，所有监听器共用事件循环
+	addrs        []string       // 启动时传入的监听地址
+	lb           LoadBalancer   // 负载均衡算法
+	lbMu         sync.Mutex     // 接收连接和Dial可能同时选择事件循环，保证LoadBalancer.Next同一时间只有一个goroutine调用
 	wg           sync.WaitGroup // 表示有多少eventLoop开启，关闭server需要等开启的eventLoop关闭
 	once         sync.Once      // 确保signalShutdown只关闭一次
-	cond         *sync.Cond     // 处理服务器关闭的信号
+	shutdown     chan struct{}  // 关闭时通知server开始关闭
+	done         chan struct{}  // server完全关闭之后关闭
 	mainLoop     *EventLoop     // 主事件循环，接收连接
-	inShutdown   int32          // 1：正在关闭server
 	opts         *Options       // 可设置选项
 	eventHandler EventHandler   // 事件处理handler
+
+	timerLoopIndex uint32 // Server.AfterFunc下一次使用的事件循环
+	tlsHandshakes  int32  // 正在进行的TLS握手数量
+
+	drainCtx    context.Context // Shutdown传入的ctx，为nil时不排空直接关闭
+	drained     int32           // 排空期间自己关闭的连接数
+	forceClosed int32           // 被强制关闭的连接数
+	report      ShutdownReport  // 关闭结果，done关闭之后有效
+}
+
+// ShutdownReport 优雅关闭服务器的结果
+type ShutdownReport struct {
+	Drained     int // 排空期间自己关闭的连接数
+	ForceClosed int // 排空结束时还没关闭，被强制关闭的连接数
 }
 
-// server是否正在关闭中
+// 排空连接时检查连接数的间隔
+const drainPollInterval = 10 * time.Millisecond
+
+// Addr 第一个监听器实际绑定的地址，监听端口为0时可以用它获取内核分配的端口，Client内部的服务器没有监听器，返回nil
+func (s *Server) Addr() net.Addr {
+	if len(s.lns) == 0 {
+		return nil
+	}
+	return s.lns[0].Addr
+}
+
+// Addrs 所有监听器实际绑定的地址，顺序和启动时传入的地址一致
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.lns))
+	for i, ln := range s.lns {
+		addrs[i] = ln.Addr
+	}
+	return addrs
+}
+
+// Shutdown 优雅关闭服务器：停止接收新连接，对每个连接调用DrainHandler.OnDrain，等待连接自己关闭，
+// ctx到期时强制关闭剩余的连接并返回ctx.Err()，返回时服务器已经关闭。
+// 多次调用时以第一次的ctx为准，服务器因为Shutdown结果等原因自己关闭时不排空
+func (s *Server) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	s.signalShutdownCtx(ctx)
+	<-s.done
+	if s.report.ForceClosed > 0 && ctx.Err() != nil {
+		return s.report, ctx.Err()
+	}
+	return s.report, nil
+}
+
+// Wait 阻塞直到服务器关闭
+func (s *Server) Wait() {
+	<-s.done
+}
+
+// Done 服务器完全关闭之后channel会被关闭
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// server是否已经关闭
 func (s *Server) isInShutdown() bool {
-	return atomic.LoadInt32(&s.inShutdown) == 1
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // 等待信号关闭server
 func (s *Server) waitForShutdown() {
-	s.cond.L.Lock()
-	s.cond.Wait()
-	s.cond.L.Unlock()
+	<-s.shutdown
 }
 
-// 发送信号让server关闭
+// 发送信号让server关闭，可以在任何goroutine中多次调用
 func (s *Server) signalShutdown() {
+	s.signalShutdownCtx(nil)
+}
+
+// 发送信号让server关闭，ctx不为nil时先排空连接
+func (s *Server) signalShutdownCtx(ctx context.Context) {
 	s.once.Do(func() {
-		s.cond.L.Lock()
-		s.cond.Signal()
-		s.cond.L.Unlock()
+		s.drainCtx = ctx
+		close(s.shutdown)
 	})
 }
 
+// 当前的连接数
+func (s *Server) activeConns() (n int32) {
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
+		n += e.loadConn()
+		return true
+	})
+	return
+}
+
+// 排空连接，直到所有连接都关闭或者ctx到期
+func (s *Server) drain(ctx context.Context) {
+	// 先让主响应器停止接收连接，已经接收的连接的注册任务会排在从响应器的排空任务之前
+	if s.mainLoop != nil {
+		done := make(chan struct{})
+		err := s.mainLoop.netpoll.AddUrgentTask(func(_ interface{}) error {
+			defer close(done)
+			return s.mainLoop.drain(nil)
+		}, nil)
+		if err != nil {
+			logger.Error("failed to call AddUrgentTask on main event-loop when draining:", err)
+		} else {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
+		if err := e.netpoll.AddUrgentTask(e.drain, nil); err != nil {
+			logger.Error("failed to call AddUrgentTask on sub event-loop when draining:", err)
+		}
+		return true
+	})
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for s.activeConns() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 创建并初始化轮询器
+func (s *Server) newNetpoller() (netpoll.Netpoller, error) {
+	var p netpoll.Netpoller = netpoll.NewEpoller()
+	if err := p.Init(); err != nil {
+		return nil, err
+	}
+	p.SetBusyPoll(s.opts.BusyPoll)
+	return p, nil
+}
+
+// 设置事件循环的索引并注册到负载均衡器
+func (s *Server) registerLoop(el *EventLoop) {
+	el.index = s.lb.Len()
+	s.lb.Register(el)
+}
+
+// 由负载均衡器为新连接选择事件循环，主响应器接收连接和任意goroutine中的Dial都通过这里调用Next
+func (s *Server) nextLoop(addr net.Addr) *EventLoop {
+	s.lbMu.Lock()
+	defer s.lbMu.Unlock()
+	return s.lb.Next(addr)
+}
+
 // 开始事件循环
 func (s *Server) startEventLoops() {
-	s.lb.iterate(func(i int, e *EventLoop) bool {
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
 		s.wg.Add(1)
 		go func() {
 			// 锁线程，获取更高效的性能
@@ -62,41 +198,81 @@ func (s *Server) startEventLoops() {
 
 // 关闭事件循环
 func (s *Server) closeEventLoops() {
-	s.lb.iterate(func(i int, e *EventLoop) bool {
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
 		e.netpoll.Close()
 		return true
 	})
 }
 
+// 启动失败时关闭已经创建的事件循环。主从响应器模式下从响应器可能已经在运行，
+// 先让它们退出，等goroutine结束之后再关闭轮询器，不能在epoll_wait还在使用时关闭fd
+func (s *Server) abortStart() {
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
+		err := e.netpoll.AddUrgentTask(func(_ interface{}) error { return shleverror.ErrServerShutdown }, nil)
+		if err != nil {
+			logger.Error("failed to call AddUrgentTask on event-loop when aborting start:", err)
+		}
+		return true
+	})
+	s.wg.Wait()
+	s.closeEventLoops()
+	// 没有启动的事件循环不会自己关闭端口复用的监听套接字
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
+		for _, ln := range e.listeners {
+			ln.Close()
+		}
+		return true
+	})
+}
+
 // 激活事件循环
 func (s *Server) activateEventLoops(numEventLoop int) (err error) {
-	address := s.ln.Address
-	ln := s.ln
-	s.ln = nil
 	// 创建EventLoop并且绑定Listener
+	loops := make([]*EventLoop, 0, numEventLoop)
 	for i := 0; i < numEventLoop; i++ {
-		if i > 0 {
-			if ln, err = NewTCP4Listener(address, s.opts); err != nil {
+		var p netpoll.Netpoller
+		if p, err = s.newNetpoller(); err != nil {
+			return
+		}
+		el := new(EventLoop)
+		el.listeners = make(map[int]*Listener, len(s.lns))
+		el.server = s
+		el.netpoll = p
+		el.buffer = make([]byte, s.opts.ReadBufferCap)
+		el.tcpConnectionMap = make(map[int]*Conn)
+		el.eventHandler = s.eventHandler
+		el.initTimers()
+		el.initStats()
+		el.initRebalance()
+		// 先注册，绑定监听器失败时由abortStart关闭轮询器和端口复用的监听套接字
+		s.registerLoop(el)
+		loops = append(loops, el)
+		for _, ln := range s.lns {
+			// 端口复用时每个事件循环有自己的监听套接字，否则所有事件循环共用一个，unix域套接字不能端口复用
+			if i > 0 && s.opts.ReusePort && ln.Network != "unix" {
+				if ln, err = ln.reuse(s.opts); err != nil {
+					return
+				}
+			}
+			el.listeners[ln.Fd] = ln
+			if err = el.netpoll.AddRead(ln.Fd); err != nil {
 				return
 			}
 		}
+	}
 
-		var p netpoll.Netpoller = netpoll.NewEpoller()
-		if err = p.Init(); err == nil {
-			el := new(EventLoop)
-			el.ln = ln
-			el.server = s
-			el.netpoll = p
-			el.buffer = make([]byte, s.opts.ReadBufferCap)
-			el.tcpConnectionMap = make(map[int]*Conn)
-			el.eventHandler = s.eventHandler
-			el.ln.SetAcceptCallback(el.accept)
-			if err = el.netpoll.AddRead(el.ln.Fd); err != nil {
+	// 父进程端口复用的监听套接字比事件循环多，或者当前没有端口复用，剩下的也轮流分给事件循环接收连接
+	for _, ln := range s.lns {
+		var rest []*Listener
+		if rest, err = ln.restInherited(); err != nil {
+			return
+		}
+		for j, nl := range rest {
+			el := loops[j%len(loops)]
+			el.listeners[nl.Fd] = nl
+			if err = el.netpoll.AddRead(nl.Fd); err != nil {
 				return
 			}
-			s.lb.register(el)
-		} else {
-			return
 		}
 	}
 
@@ -109,19 +285,19 @@ func (s *Server) activateEventLoops(numEventLoop int) (err error) {
 // 激活响应器
 func (s *Server) activateReactors(numEventLoop int) error {
 	for i := 0; i < numEventLoop; i++ {
-		var p netpoll.Netpoller = netpoll.NewEpoller()
-		if err := p.Init(); err == nil {
+		if p, err := s.newNetpoller(); err == nil {
 			el := &EventLoop{
-				ln:               s.ln,
 				index:            0,
-				cache:            bytes.Buffer{},
 				server:           s,
 				buffer:           make([]byte, s.opts.ReadBufferCap),
 				tcpConnectionMap: make(map[int]*Conn),
 				netpoll:          p,
 				eventHandler:     s.eventHandler,
 			}
-			s.lb.register(el)
+			el.initTimers()
+			el.initStats()
+			el.initRebalance()
+			s.registerLoop(el)
 		} else {
 			return err
 		}
@@ -131,17 +307,31 @@ func (s *Server) activateReactors(numEventLoop int) error {
 	s.startSubReactors()
 
 	// 建立主响应器，主响应器只负责监听端口建立连接
-	var p netpoll.Netpoller = netpoll.NewEpoller()
-	if err := p.Init(); err == nil {
+	if p, err := s.newNetpoller(); err == nil {
 		e := &EventLoop{
-			ln:           s.ln,
+			listeners:    make(map[int]*Listener, len(s.lns)),
 			index:        -1,
 			server:       s,
 			netpoll:      p,
 			eventHandler: s.eventHandler,
 		}
-		if err = e.netpoll.AddRead(e.ln.Fd); err != nil {
-			return err
+		e.initTimers()
+		e.initStats()
+		e.initRebalance()
+		for _, ln := range s.lns {
+			// 父进程端口复用时交接的其他监听套接字也由主响应器接收连接
+			rest, err := ln.restInherited()
+			if err != nil {
+				_ = e.netpoll.Close()
+				return err
+			}
+			for _, l := range append([]*Listener{ln}, rest...) {
+				e.listeners[l.Fd] = l
+				if err = e.netpoll.AddRead(l.Fd); err != nil {
+					_ = e.netpoll.Close()
+					return err
+				}
+			}
 		}
 		// 设置主响应器指针
 		s.mainLoop = e
@@ -158,7 +348,7 @@ func (s *Server) activateReactors(numEventLoop int) error {
 }
 
 func (s *Server) startSubReactors() {
-	s.lb.iterate(func(i int, el *EventLoop) bool {
+	s.lb.Iterate(func(i int, el *EventLoop) bool {
 		s.wg.Add(1)
 		go func() {
 			el.activateSubReactor(s.opts.LockOSThread)
@@ -168,21 +358,43 @@ func (s *Server) startSubReactors() {
 	})
 }
 
+// 是否有udp监听器，udp没有accept，只能在每个事件循环中直接读取
+func (s *Server) hasUDPListener() bool {
+	for _, ln := range s.lns {
+		if ln.Network == "udp" {
+			return true
+		}
+	}
+	return false
+}
+
 // 开启事件循环
-func (s *Server) start(numEventLoop int) error {
-	if s.opts.ReusePort {
-		// 类nginx
+func (s *Server) start(numEventLoop int) (err error) {
+	if s.opts.ReusePort || s.hasUDPListener() || len(s.lns) == 0 {
+		// 类nginx，Client没有监听器，不需要主响应器
 		// 使用端口复用模式开启事件循环，多个线程监听同一个端口，每个线程都负责accpet，read，write
-		return s.activateEventLoops(numEventLoop)
+		err = s.activateEventLoops(numEventLoop)
+	} else {
+		// 类redis
+		// 开启一主多从reactor模式，主负责accept，从负责read，write
+		err = s.activateReactors(numEventLoop)
+	}
+	if err != nil {
+		return err
 	}
 
-	// 类redis
-	// 开启一主多从reactor模式，主负责accept，从负责read，write
-	return s.activateReactors(numEventLoop)
+	// 在第一个事件循环中执行OnTick
+	if s.opts.Ticker {
+		s.lb.Iterate(func(i int, e *EventLoop) bool {
+			e.ticker()
+			return false
+		})
+	}
+	return nil
 }
 
-// 开启服务器
-func serve(eventHandler EventHandler, listener *Listener, options *Options, addr string) error {
+// 开启服务器，成功之后服务器在后台运行，关闭时会关闭所有监听器
+func serve(eventHandler EventHandler, listeners []*Listener, options *Options, addrs []string) (*Server, error) {
 	// 计算EventLoop数量
 	numEventLoop := 1
 	if options.Multicore {
@@ -193,43 +405,44 @@ func serve(eventHandler EventHandler, listener *Listener, options *Options, addr
 	}
 
 	s := &Server{
-		ln:           listener,
+		lns:          listeners,
+		addrs:        addrs,
+		shutdown:     make(chan struct{}),
+		done:         make(chan struct{}),
 		opts:         options,
 		eventHandler: eventHandler,
 	}
 
-	// 根据负载均衡枚举值设置负载均衡器
-	switch options.LB {
-	case RoundRobin:
-		s.lb = &roundRobinLoadBalancer{}
-	case LeastConnections:
-		s.lb = &leastConnectionsLoadBalancer{}
-	case SourceAddrHash:
-		s.lb = &sourceAddrHashLoadBalancer{}
+	// 优先使用自定义的负载均衡器，否则根据负载均衡枚举值创建
+	if options.CustomLB != nil {
+		s.lb = options.CustomLB
+	} else {
+		s.lb = newLoadBalancer(options.LB)
 	}
 
-	s.cond = sync.NewCond(&sync.Mutex{})
 	// 执行启动钩子函数
 	err := s.eventHandler.OnBoot(s)
 	if err != nil {
 		logger.Error("server OnBoot error:", err)
-		return err
+		return nil, err
 	}
 
 	if err = s.start(numEventLoop); err != nil {
-		s.closeEventLoops()
+		s.abortStart()
 		logger.Error("server start error:", err)
-		return err
+		return nil, err
 	}
-	defer s.stop()
 
-	allServers.Store(addr, s)
-	return nil
+	for _, addr := range addrs {
+		allServers.Store(addr, s)
+	}
+	go s.stop()
+	return s, nil
 }
 
 // 在主从响应器模式中使用，并且只会由主响应器调用
-func (s *Server) accept(fd int, _ uint32) error {
-	nfd, sa, err := unix.Accept(fd)
+func (s *Server) accept(ln *Listener) error {
+	nfd, sa, err := unix.Accept(ln.Fd)
 	if err != nil {
 		if err == unix.EAGAIN {
 			return nil
@@ -241,14 +454,15 @@ func (s *Server) accept(fd int, _ uint32) error {
 		return err
 	}
 
-	remoteAddr := socket.SockaddrToTCPAddr(sa)
-	if s.opts.TCPKeepAlive > 0 {
-		err = socket.SetKeepAlivePeriod(nfd, int(s.opts.TCPKeepAlive.Seconds()))
-		logger.Error("set keep-alive error:", err)
+	remoteAddr := ln.sockaddrToAddr(sa)
+	if s.opts.TCPKeepAlive > 0 && ln.Network == "tcp" {
+		if err = socket.SetKeepAlivePeriod(nfd, int(s.opts.TCPKeepAlive.Seconds())); err != nil {
+			logger.Error("set keep-alive error:", err)
+		}
 	}
 
-	el := s.lb.next(remoteAddr)
-	c := newTCPConn(nfd, el, sa, el.ln.Addr, remoteAddr)
+	el := s.nextLoop(remoteAddr)
+	c := newTCPConn(nfd, el, ln, sa, remoteAddr)
 
 	err = el.netpoll.AddUrgentTask(el.register, c)
 	if err != nil {
@@ -263,11 +477,16 @@ func (s *Server) stop() {
 	// 等待信号进行关闭
 	s.waitForShutdown()
 
+	// 优雅关闭时先排空连接
+	if s.drainCtx != nil {
+		s.drain(s.drainCtx)
+	}
+
 	// 执行关闭服务器时的钩子函数
 	s.eventHandler.OnShutdown(s)
 
 	// 通知所有的loop关闭所有listener
-	s.lb.iterate(func(i int, e *EventLoop) bool {
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
 		err := e.netpoll.AddUrgentTask(func(_ interface{}) error { return shleverror.ErrServerShutdown }, nil)
 		if err != nil {
 			logger.Error("failed to call AddUrgentTask on sub event-loop when stopping engine:", err)
@@ -277,7 +496,9 @@ func (s *Server) stop() {
 
 	// 主从reactor模式下，只需要关闭主reactor
 	if s.mainLoop != nil {
-		s.ln.Close()
+		for _, ln := range s.mainLoop.listeners {
+			ln.Close()
+		}
 		err := s.mainLoop.netpoll.AddUrgentTask(func(_ interface{}) error { return shleverror.ErrServerShutdown }, nil)
 		if err != nil {
 			logger.Error("failed to call AddUrgentTask on main event-loop when stopping engine:", err)
@@ -296,5 +517,17 @@ func (s *Server) stop() {
 		}
 	}
 
-	atomic.StoreInt32(&s.inShutdown, 1)
+	for _, ln := range s.lns {
+		ln.Close()
+	}
+	s.report.ForceClosed = int(atomic.LoadInt32(&s.forceClosed))
+	s.report.Drained = int(atomic.LoadInt32(&s.drained))
+
+	// 同一个地址可能已经被新的服务器使用，只删除自己
+	for _, addr := range s.addrs {
+		if v, ok := allServers.Load(addr); ok && v == s {
+			allServers.Delete(addr)
+		}
+	}
+	close(s.done)
 }
@@ -0,0 +1,131 @@
+package shlev
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 负载统计的滑动窗口，每个槽1秒，一共10个槽
+const (
+	loadWindowSlot  = time.Second
+	loadWindowSlots = 10
+)
+
+// LoopStats 事件循环的负载统计，BusyTime、BytesIn、BytesOut是最近一个统计窗口（大约10秒）内的值。
+// 没有使用LeastLoad负载均衡也没有开启BusyTimeStats时窗口不轮转，BytesIn、BytesOut是启动以来的累计值，Window是启动以来的时间
+type LoopStats struct {
+	Index        int           // 事件循环的索引
+	Conns        int32         // 当前连接数
+	PendingTasks int           // 任务队列中还没有执行的任务数
+	BusyTime     time.Duration // 窗口内执行回调花费的时间，只在使用LeastLoad负载均衡或者开启了BusyTimeStats时统计，否则为0
+	BytesIn      uint64        // 窗口内读到的字节数
+	BytesOut     uint64        // 窗口内写出的字节数
+	Window       time.Duration // 窗口的实际长度，刚启动时比较短
+}
+
+// 累计值或者一个槽内的增量
+type loadSample struct {
+	busy, in, out uint64
+}
+
+func (a loadSample) add(b loadSample) loadSample {
+	return loadSample{busy: a.busy + b.busy, in: a.in + b.in, out: a.out + b.out}
+}
+
+func (a loadSample) sub(b loadSample) loadSample {
+	return loadSample{busy: a.busy - b.busy, in: a.in - b.in, out: a.out - b.out}
+}
+
+// 滑动窗口，由事件循环的定时器轮转，Stats可以在其他goroutine中读取
+type loadWindow struct {
+	mu         sync.Mutex
+	slots      [loadWindowSlots]loadSample
+	next       int        // 下一次轮转写入的槽
+	filled     int        // 已经写入的槽数
+	last       loadSample // 上一次轮转时的累计值
+	lastRotate time.Time
+}
+
+// 回调开始的时间，不统计回调耗时的时候返回零值，省掉两次time.Now
+func (e *EventLoop) busyStart() time.Time {
+	if !e.trackBusy {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// 统计回调执行的时间，start是busyStart的返回值
+func (e *EventLoop) addBusy(start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	atomic.AddUint64(&e.busyNanos, uint64(time.Since(start)))
+}
+
+// 当前的累计值
+func (e *EventLoop) cumulative() loadSample {
+	return loadSample{busy: atomic.LoadUint64(&e.busyNanos), in: e.BytesIn(), out: e.BytesOut()}
+}
+
+// 开始统计负载，在事件循环启动之前调用。负载感知的负载均衡器要用回调耗时，其他情况下按选项决定是否统计
+func (e *EventLoop) initStats() {
+	_, loadAware := e.server.lb.(*loadAwareLoadBalancer)
+	e.trackBusy = loadAware || e.server.opts.BusyTimeStats
+	e.window.lastRotate = time.Now()
+	// 只有统计回调耗时的时候才轮转窗口，否则空闲的事件循环每秒都要被定时器唤醒一次
+	if e.trackBusy {
+		e.timers.AfterFunc(loadWindowSlot, e.rotateStats)
+	}
+}
+
+// 把上一个周期的增量写入窗口，只在事件循环中执行
+func (e *EventLoop) rotateStats() error {
+	cur := e.cumulative()
+	w := &e.window
+	w.mu.Lock()
+	w.slots[w.next] = cur.sub(w.last)
+	w.next = (w.next + 1) % loadWindowSlots
+	if w.filled < loadWindowSlots {
+		w.filled++
+	}
+	w.last = cur
+	w.lastRotate = time.Now()
+	w.mu.Unlock()
+	e.timers.AfterFunc(loadWindowSlot, e.rotateStats)
+	return nil
+}
+
+// Stats 事件循环的负载统计，可以在其他goroutine中调用
+func (e *EventLoop) Stats() LoopStats {
+	cur := e.cumulative()
+	w := &e.window
+	w.mu.Lock()
+	// 当前周期还没有轮转的部分也算进去
+	sum := cur.sub(w.last)
+	for i := 0; i < w.filled; i++ {
+		sum = sum.add(w.slots[i])
+	}
+	window := time.Duration(w.filled)*loadWindowSlot + time.Since(w.lastRotate)
+	w.mu.Unlock()
+
+	return LoopStats{
+		Index:        e.index,
+		Conns:        e.ConnCount(),
+		PendingTasks: e.PendingTasks(),
+		BusyTime:     time.Duration(sum.busy),
+		BytesIn:      sum.in,
+		BytesOut:     sum.out,
+		Window:       window,
+	}
+}
+
+// Stats 所有事件循环的负载统计，按索引排列，可以用来检查负载均衡的效果
+func (s *Server) Stats() []LoopStats {
+	stats := make([]LoopStats, 0, s.lb.Len())
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
+		stats = append(stats, e.Stats())
+		return true
+	})
+	return stats
+}
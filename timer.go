@@ -0,0 +1,112 @@
+package shlev
+
+import (
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"github.com/Senhnn/shlev/tools/timewheel"
+	"sync/atomic"
+	"time"
+)
+
+// 时间轮每层的槽数量，精度为1ms时第一层为64ms，第二层为4s，第三层为4分多钟
+const timerWheelSize = 64
+
+// Timer 事件循环中的定时任务，回调在所属事件循环的goroutine中执行
+type Timer struct {
+	loop    *EventLoop
+	timer   *timewheel.Timer // 只在事件循环中访问
+	stopped int32            // 1：已取消或者已执行
+}
+
+// Stop 取消定时任务，可以在任意goroutine中调用，返回false表示已经执行或者已经取消
+func (t *Timer) Stop() bool {
+	if !atomic.CompareAndSwapInt32(&t.stopped, 0, 1) {
+		return false
+	}
+	// 从时间轮中删除，释放内存
+	err := t.loop.netpoll.AddTask(func(_ interface{}) error {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		logger.Warn("Timer.Stop AddTask error:", err)
+	}
+	return true
+}
+
+// 初始化定时器，轮询器根据定时器决定epoll_wait的阻塞时间
+func (e *EventLoop) initTimers() {
+	e.timers = timewheel.New(time.Millisecond, timerWheelSize)
+	e.netpoll.SetTimer(e.timers)
+}
+
+// 添加定时任务，可以在任意goroutine中调用，回调在事件循环中执行
+func (e *EventLoop) afterFunc(d time.Duration, fn func() error) *Timer {
+	t := &Timer{loop: e}
+	err := e.netpoll.AddTask(func(_ interface{}) error {
+		if atomic.LoadInt32(&t.stopped) == 1 {
+			return nil
+		}
+		t.timer = e.timers.AfterFunc(d, func() error {
+			if !atomic.CompareAndSwapInt32(&t.stopped, 0, 1) {
+				return nil
+			}
+			return fn()
+		})
+		return nil
+	}, nil)
+	if err != nil {
+		logger.Warn("afterFunc AddTask error:", err)
+	}
+	return t
+}
+
+// 周期性执行OnTick，直到OnTick返回Shutdown
+func (e *EventLoop) ticker() {
+	h, ok := e.eventHandler.(TickHandler)
+	if !ok {
+		return
+	}
+
+	var tick func() error
+	tick = func() error {
+		delay, action := h.OnTick()
+		if action == Shutdown {
+			return shleverror.ErrServerShutdown
+		}
+		e.timers.AfterFunc(delay, tick)
+		return nil
+	}
+	e.afterFunc(0, tick)
+}
+
+// AfterFunc d时间之后在连接所属的事件循环中执行fn，连接已经关闭时不再执行，连接迁移之后在新的事件循环中执行，
+// fn的返回值和OnTraffic一样处理
+func (c *Conn) AfterFunc(d time.Duration, fn func(*Conn) HandleResult) *Timer {
+	e := c.currentLoop()
+	return e.afterFunc(d, func() error {
+		return c.runTimer(e, fn)
+	})
+}
+
+// AfterFunc d时间之后在某个事件循环中执行fn，多次调用时轮流使用各个事件循环，fn返回Shutdown会关闭服务器。
+// 事件循环在OnBoot之后才创建，在此之前调用返回nil
+func (s *Server) AfterFunc(d time.Duration, fn func(*Server) HandleResult) *Timer {
+	if s.lb.Len() == 0 {
+		return nil
+	}
+	idx := int(atomic.AddUint32(&s.timerLoopIndex, 1)-1) % s.lb.Len()
+	var el *EventLoop
+	s.lb.Iterate(func(i int, e *EventLoop) bool {
+		el = e
+		return i < idx
+	})
+	return el.afterFunc(d, func() error {
+		if fn(s) == Shutdown {
+			return shleverror.ErrServerShutdown
+		}
+		return nil
+	})
+}
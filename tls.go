@@ -0,0 +1,278 @@
+package shlev
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/Senhnn/shlev/tools/logger"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TLS连接的处理方式：
+// tls.Conn运行在内存中的传输层上，事件循环从套接字读到密文之后交给传输层。握手完成之后解密和加密都在事件循环中进行：
+// 收到密文就调用tls.Conn.Read，传输层没有数据时返回临时错误，tls.Conn会保留不完整的记录，下一次收到密文之后继续解密，
+// 解密出的明文直接交给OnTraffic；发送时在事件循环中加密，密文写入套接字或者发送缓冲区。
+// crypto/tls的握手过程不能暂停和恢复，只能阻塞地读写，所以握手不在事件循环中进行，握手期间每个连接有一个goroutine，
+// 握手完成、失败或者超时之后退出。同时进行的握手数量有上限，超过上限的新连接直接关闭，握手goroutine的数量不会无限增长。
+
+const (
+	defaultTLSHandshakeTimeout = 10 * time.Second // 默认的TLS握手超时时间
+	defaultMaxTLSHandshakes    = 1024             // 默认的同时进行的TLS握手数量上限
+)
+
+// 传输层中没有密文时返回的错误，Temporary为true，tls.Conn不会因此把连接标记为出错
+type tlsWouldBlock struct{}
+
+func (tlsWouldBlock) Error() string   { return "tls: waiting for more data" }
+func (tlsWouldBlock) Timeout() bool   { return true }
+func (tlsWouldBlock) Temporary() bool { return true }
+
+var errTLSWouldBlock net.Error = tlsWouldBlock{}
+
+// 内存中的传输层，实现了net.Conn，给tls.Conn使用
+type tlsTransport struct {
+	conn      *Conn
+	tc        *tls.Conn
+	mu        sync.Mutex
+	cond      *sync.Cond
+	in        bytes.Buffer // 收到但还没有解密的密文
+	out       []byte       // 加密之后还没有写给套接字的密文
+	flushing  bool         // 已经提交了发送密文的任务
+	closed    bool
+	loopOwned bool                 // 握手完成，之后只在事件循环中读写，不再阻塞
+	handshake bool                 // 握手已经完成，只在事件循环中访问
+	state     *tls.ConnectionState // 握手完成之后的状态
+}
+
+// Read 握手期间在握手goroutine中调用，没有密文时阻塞；握手完成之后在事件循环中调用，没有密文时返回errTLSWouldBlock
+func (t *tlsTransport) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.in.Len() == 0 && !t.closed && !t.loopOwned {
+		t.cond.Wait()
+	}
+	if t.in.Len() == 0 {
+		if t.closed {
+			return 0, io.EOF
+		}
+		return 0, errTLSWouldBlock
+	}
+	return t.in.Read(p)
+}
+
+// Write 缓存密文。握手goroutine中调用时提交任务，由事件循环发送；事件循环中调用时由调用者随后flush
+func (t *tlsTransport) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	t.out = append(t.out, p...)
+	submit := !t.flushing && !t.loopOwned
+	if submit {
+		t.flushing = true
+	}
+	t.mu.Unlock()
+	if submit {
+		_ = t.conn.dispatch(func(_ interface{}) error {
+			return t.flush()
+		}, nil)
+	}
+	return len(p), nil
+}
+
+func (t *tlsTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.cond.Broadcast()
+	return nil
+}
+
+func (t *tlsTransport) LocalAddr() net.Addr                { return t.conn.localAddr }
+func (t *tlsTransport) RemoteAddr() net.Addr               { return t.conn.remoteAddr }
+func (t *tlsTransport) SetDeadline(_ time.Time) error      { return nil }
+func (t *tlsTransport) SetReadDeadline(_ time.Time) error  { return nil }
+func (t *tlsTransport) SetWriteDeadline(_ time.Time) error { return nil }
+
+// 把从套接字读到的密文交给传输层，握手期间唤醒握手goroutine，只在事件循环中调用
+func (t *tlsTransport) feed(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	t.mu.Lock()
+	_, _ = t.in.Write(data)
+	t.mu.Unlock()
+	t.cond.Signal()
+}
+
+// 把缓存的密文写给套接字，只在事件循环中调用
+func (t *tlsTransport) flush() error {
+	t.mu.Lock()
+	out := t.out
+	t.out = nil
+	t.flushing = false
+	t.mu.Unlock()
+	if len(out) == 0 || !t.conn.loop.ownsConn(t.conn) {
+		return nil
+	}
+	_, err := t.conn.write(out)
+	return err
+}
+
+// 加密明文并发送，只在事件循环中握手完成之后调用
+func (t *tlsTransport) write(data []byte) (int, error) {
+	n, err := t.tc.Write(data)
+	if err != nil {
+		return n, err
+	}
+	return n, t.flush()
+}
+
+// 握手goroutine：握手完成之后把连接交回事件循环，然后退出，退出时释放握手数量
+func (t *tlsTransport) runHandshake(s *Server, remote net.Addr) {
+	defer atomic.AddInt32(&s.tlsHandshakes, -1)
+	c := t.conn
+	if err := t.tc.Handshake(); err != nil {
+		t.mu.Lock()
+		closed := t.closed
+		t.mu.Unlock()
+		// 连接已经关闭时握手失败是正常的
+		if !closed {
+			logger.Warn(fmt.Sprintf("tls handshake error, remote:%v error:%v", remote, err))
+			_ = c.Close()
+		}
+		return
+	}
+	state := t.tc.ConnectionState()
+	_ = c.dispatch(func(_ interface{}) error {
+		return c.loop.tlsHandshakeDone(c, &state)
+	}, nil)
+}
+
+// 发送close_notify，握手还没有完成时让握手goroutine退出，在关闭连接时调用
+func (t *tlsTransport) close() {
+	if t.handshake {
+		_ = t.tc.CloseWrite()
+		t.mu.Lock()
+		if len(t.out) > 0 {
+			t.conn.outboundBuffer.PushBack(t.out)
+			t.out = nil
+		}
+		t.mu.Unlock()
+	}
+	_ = t.Close()
+}
+
+// TLSState TLS连接握手之后的状态，包括SNI、ALPN协商的协议、是否复用了会话和客户端证书，不是TLS连接时返回nil
+func (c *Conn) TLSState() *tls.ConnectionState {
+	if c.tls == nil {
+		return nil
+	}
+	return c.tls.state
+}
+
+// 监听器接收的连接使用的TLS配置，没有开启TLS时返回nil
+func (e *EventLoop) tlsConfig(ln *Listener) *tls.Config {
+	if ln.Network == "udp" {
+		return nil
+	}
+	if ln.lnOpts.TLSConfig != nil {
+		return ln.lnOpts.TLSConfig
+	}
+	return e.server.opts.TLSConfig
+}
+
+// 连接建立之后，需要TLS握手时先握手，握手完成之后再调用OnOpen
+func (e *EventLoop) establish(c *Conn) error {
+	if c.tls == nil {
+		return e.notifyOpen(c)
+	}
+	t := c.tls
+	// 同时进行的握手太多时不再开始新的握手，避免不发送数据的连接占用大量goroutine
+	max := e.server.opts.MaxTLSHandshakes
+	if max <= 0 {
+		max = defaultMaxTLSHandshakes
+	}
+	if atomic.AddInt32(&e.server.tlsHandshakes, 1) > int32(max) {
+		atomic.AddInt32(&e.server.tlsHandshakes, -1)
+		logger.Warn(fmt.Sprintf("too many tls handshakes, fd:%d remote:%v", c.fd, c.remoteAddr))
+		return e.closeConnection(c)
+	}
+	// PROXY协议头之后已经收到的数据是握手消息
+	if c.InboundBuffered() > 0 {
+		data, _ := c.Next(-1)
+		t.feed(data)
+	}
+	timeout := e.server.opts.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+	c.AfterFunc(timeout, func(c *Conn) HandleResult {
+		if c.tls.handshake {
+			return None
+		}
+		logger.Warn(fmt.Sprintf("tls handshake timeout, fd:%d remote:%v", c.fd, c.remoteAddr))
+		return Close
+	})
+	go t.runHandshake(e.server, c.remoteAddr)
+	return nil
+}
+
+// 握手完成，调用OnOpen，然后解密握手期间已经收到的数据
+func (e *EventLoop) tlsHandshakeDone(c *Conn, state *tls.ConnectionState) error {
+	if !e.ownsConn(c) {
+		return nil
+	}
+	t := c.tls
+	t.mu.Lock()
+	t.loopOwned = true
+	t.mu.Unlock()
+	t.handshake = true
+	t.state = state
+	if err := e.notifyOpen(c); err != nil || !e.ownsConn(c) {
+		return err
+	}
+	return e.tlsRead(c)
+}
+
+// 解密传输层中的密文，每解密出一段明文调用一次OnTraffic，密文不够一个完整的记录时等下一次可读，只在事件循环中调用
+func (e *EventLoop) tlsRead(c *Conn) error {
+	t := c.tls
+	for {
+		n, err := t.tc.Read(e.buffer)
+		if n > 0 {
+			c.buffer = e.buffer[:n]
+			start := e.busyStart()
+			result := e.eventHandler.OnTraffic(c)
+			e.addBusy(start)
+			c.saveInbound()
+			if result != None || !e.ownsConn(c) {
+				return e.handleResult(c, result)
+			}
+		}
+		if err == errTLSWouldBlock {
+			// 解密时可能要回复KeyUpdate等消息
+			return t.flush()
+		}
+		if err != nil {
+			// 对端发送了close_notify，或者收到了错误的记录
+			if err != io.EOF {
+				logger.Warn(fmt.Sprintf("tls read error, fd:%d remote:%v error:%v", c.fd, c.remoteAddr, err))
+			}
+			return e.closeConnection(c)
+		}
+	}
+}
+
+// 创建连接的TLS传输层
+func newTLSTransport(c *Conn, config *tls.Config) *tlsTransport {
+	t := &tlsTransport{conn: c}
+	t.cond = sync.NewCond(&t.mu)
+	t.tc = tls.Server(t, config)
+	return t
+}
@@ -0,0 +1,111 @@
+package linkedbuffer
+
+// 新建节点时的最小容量，小块数据可以追加到尾节点中，减少节点数量和writev的iovec数量
+const minNodeSize = 1024
+
+type node struct {
+	buf  []byte
+	next *node
+}
+
+// LinkedListBuffer 由字节切片组成的链表，用于发送缓冲区，可以直接取出多个切片交给writev
+type LinkedListBuffer struct {
+	head  *node
+	tail  *node
+	size  int // 节点数量
+	bytes int // 数据总长度
+}
+
+// PushBack 把p拷贝到链表尾部
+func (l *LinkedListBuffer) PushBack(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	l.bytes += len(p)
+	// 尾节点还有空间时直接追加
+	if l.tail != nil && cap(l.tail.buf)-len(l.tail.buf) >= len(p) {
+		l.tail.buf = append(l.tail.buf, p...)
+		return
+	}
+
+	size := len(p)
+	if size < minNodeSize {
+		size = minNodeSize
+	}
+	n := &node{buf: append(make([]byte, 0, size), p...)}
+	if l.tail == nil {
+		l.head = n
+	} else {
+		l.tail.next = n
+	}
+	l.tail = n
+	l.size++
+}
+
+// Peek 返回从头部开始最多maxCount个切片，切片指向链表内部，Discard之前有效
+func (l *LinkedListBuffer) Peek(maxCount int) [][]byte {
+	if l.head == nil {
+		return nil
+	}
+	count := l.size
+	if maxCount > 0 && maxCount < count {
+		count = maxCount
+	}
+	bs := make([][]byte, 0, count)
+	for n := l.head; n != nil && len(bs) < count; n = n.next {
+		bs = append(bs, n.buf)
+	}
+	return bs
+}
+
+// Discard 丢弃头部n个字节，返回实际丢弃的字节数
+func (l *LinkedListBuffer) Discard(n int) int {
+	discarded := 0
+	for n > 0 && l.head != nil {
+		if len(l.head.buf) > n {
+			l.head.buf = l.head.buf[n:]
+			discarded += n
+			break
+		}
+		m := len(l.head.buf)
+		n -= m
+		discarded += m
+		l.pop()
+	}
+	l.bytes -= discarded
+	return discarded
+}
+
+// 删除头节点
+func (l *LinkedListBuffer) pop() {
+	n := l.head
+	l.head = n.next
+	if l.head == nil {
+		l.tail = nil
+	}
+	n.next, n.buf = nil, nil
+	l.size--
+}
+
+// Buffered 数据总长度
+func (l *LinkedListBuffer) Buffered() int {
+	return l.bytes
+}
+
+// Len 节点数量
+func (l *LinkedListBuffer) Len() int {
+	return l.size
+}
+
+// IsEmpty 是否没有数据
+func (l *LinkedListBuffer) IsEmpty() bool {
+	return l.bytes == 0
+}
+
+// Reset 清空链表
+func (l *LinkedListBuffer) Reset() {
+	for l.head != nil {
+		l.pop()
+	}
+	l.bytes = 0
+}
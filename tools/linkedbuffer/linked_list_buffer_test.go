@@ -0,0 +1,45 @@
+package linkedbuffer_test
+
+import (
+	"bytes"
+	"github.com/Senhnn/shlev/tools/linkedbuffer"
+	"testing"
+)
+
+func TestLinkedListBuffer(t *testing.T) {
+	var l linkedbuffer.LinkedListBuffer
+	if !l.IsEmpty() || l.Peek(0) != nil {
+		t.Fatal("zero value buffer should be empty")
+	}
+
+	// 小块数据合并到同一个节点
+	l.PushBack([]byte("hello "))
+	l.PushBack([]byte("world"))
+	if l.Len() != 1 || l.Buffered() != 11 {
+		t.Fatalf("len=%d buffered=%d", l.Len(), l.Buffered())
+	}
+	big := bytes.Repeat([]byte("x"), 4096)
+	l.PushBack(big)
+	l.PushBack([]byte("!"))
+	if l.Len() != 3 {
+		t.Fatalf("len=%d, want 3", l.Len())
+	}
+	if bs := l.Peek(1); len(bs) != 1 || string(bs[0]) != "hello world" {
+		t.Fatalf("peek one slice: %q", bs)
+	}
+
+	// 丢弃跨越节点
+	if n := l.Discard(13); n != 13 {
+		t.Fatalf("discarded %d", n)
+	}
+	var got []byte
+	for _, b := range l.Peek(0) {
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, append(bytes.Repeat([]byte("x"), 4094), '!')) {
+		t.Fatalf("unexpected data after discard, len=%d", len(got))
+	}
+	if n := l.Discard(10000); n != 4095 || !l.IsEmpty() || l.Len() != 0 {
+		t.Fatalf("discard all: n=%d len=%d", n, l.Len())
+	}
+}
@@ -2,30 +2,48 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 )
 
 var logger *log.Logger
 
-func init() {
-	path, err := os.Getwd()
-	if err != nil {
-		panic(err)
-	}
+// 日志文件，第一次写日志时才在当前目录下创建，在这之前调用SetOutput就不会创建
+type lazyFile struct {
+	once sync.Once
+	f    *os.File
+}
 
-	f, err := os.OpenFile(path+"/shlev_net.log", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		panic(err)
-	}
+func (l *lazyFile) Write(p []byte) (int, error) {
+	l.once.Do(func() {
+		path, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		f, err := os.OpenFile(path+"/shlev_net.log", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			panic(err)
+		}
+		l.f = f
+	})
+	return l.f.Write(p)
+}
 
-	logger = log.New(f, "", 0)
-	Init("logger init success!")
+func init() {
+	logger = log.New(&lazyFile{}, "", 0)
 	fmt.Println("logger init success!")
 }
 
+// SetOutput 日志改为写到w，测试中用来把日志写到临时目录
+func SetOutput(w io.Writer) {
+	logger.SetOutput(w)
+}
+
 func setPrefix(level string) {
 	_, file, line, ok := runtime.Caller(2)
 	total := ""
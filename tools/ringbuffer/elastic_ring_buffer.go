@@ -0,0 +1,98 @@
+package ringbuffer
+
+import (
+	"io"
+	"sync"
+)
+
+// 超过这个容量的缓冲区不放回内存池，避免偶尔的大包让内存一直得不到释放
+const maxPooledBufferSize = 64 * 1024 // 64KB
+
+var ringBufferPool = sync.Pool{New: func() interface{} { return New(defaultBufferSize) }}
+
+// Get 从内存池中获取环形缓冲区
+func Get() *RingBuffer {
+	return ringBufferPool.Get().(*RingBuffer)
+}
+
+// Put 清空环形缓冲区并放回内存池
+func Put(rb *RingBuffer) {
+	if rb.Cap() > maxPooledBufferSize {
+		return
+	}
+	rb.Reset()
+	ringBufferPool.Put(rb)
+}
+
+// ElasticRingBuffer 弹性环形缓冲区，写入数据时才从内存池中申请RingBuffer，
+// 数据读完之后调用Release归还，空闲连接不占用缓冲区内存
+type ElasticRingBuffer struct {
+	rb *RingBuffer
+}
+
+// Peek 参看RingBuffer.Peek
+func (b *ElasticRingBuffer) Peek(n int) (head []byte, tail []byte) {
+	if b.rb == nil {
+		return
+	}
+	return b.rb.Peek(n)
+}
+
+// Discard 参看RingBuffer.Discard
+func (b *ElasticRingBuffer) Discard(n int) (int, error) {
+	if b.rb == nil {
+		if n > 0 {
+			return 0, ErrNotEnoughData
+		}
+		return 0, nil
+	}
+	return b.rb.Discard(n)
+}
+
+// Read 参看RingBuffer.Read
+func (b *ElasticRingBuffer) Read(p []byte) (int, error) {
+	if b.rb == nil {
+		return 0, io.EOF
+	}
+	return b.rb.Read(p)
+}
+
+// Write 写入数据，第一次写入时从内存池申请缓冲区
+func (b *ElasticRingBuffer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.rb == nil {
+		b.rb = Get()
+	}
+	return b.rb.Write(p)
+}
+
+// Buffered 缓冲区中的数据长度
+func (b *ElasticRingBuffer) Buffered() int {
+	if b.rb == nil {
+		return 0
+	}
+	return b.rb.Buffered()
+}
+
+// IsEmpty 缓冲区是否为空
+func (b *ElasticRingBuffer) IsEmpty() bool {
+	return b.rb == nil || b.rb.IsEmpty()
+}
+
+// Release 缓冲区为空时归还到内存池，Peek返回的切片在归还之后不能再使用
+func (b *ElasticRingBuffer) Release() {
+	if b.rb != nil && b.rb.IsEmpty() {
+		Put(b.rb)
+		b.rb = nil
+	}
+}
+
+// Done 不管是否为空都归还缓冲区，用于关闭连接
+func (b *ElasticRingBuffer) Done() {
+	if b.rb != nil {
+		Put(b.rb)
+		b.rb = nil
+	}
+}
@@ -0,0 +1,172 @@
+package ringbuffer
+
+import (
+	"errors"
+	"io"
+)
+
+// 默认缓冲区大小
+const defaultBufferSize = 4 * 1024 // 4KB
+
+// ErrNotEnoughData 缓冲区中的数据不足
+var ErrNotEnoughData = errors.New("not enough data in ring buffer")
+
+// RingBuffer 环形缓冲区，写入时空间不足会自动扩容，容量总是2的幂
+type RingBuffer struct {
+	buf     []byte
+	size    int  // 容量
+	mask    int  // size-1，用于取模
+	r       int  // 下一次读的位置
+	w       int  // 下一次写的位置
+	isEmpty bool // r == w时用来区分空和满
+}
+
+// New 创建容量至少为size的环形缓冲区
+func New(size int) *RingBuffer {
+	if size <= 0 {
+		return &RingBuffer{isEmpty: true}
+	}
+	size = ceilToPowerOfTwo(size)
+	return &RingBuffer{
+		buf:     make([]byte, size),
+		size:    size,
+		mask:    size - 1,
+		isEmpty: true,
+	}
+}
+
+// Peek 返回前n个字节但不移动读位置，n<=0表示全部数据。数据跨越缓冲区末尾时分成head和tail两段返回，
+// 返回的切片指向缓冲区内部，下一次写入之前有效
+func (rb *RingBuffer) Peek(n int) (head []byte, tail []byte) {
+	if rb.isEmpty {
+		return
+	}
+	buffered := rb.Buffered()
+	if n <= 0 || n > buffered {
+		n = buffered
+	}
+
+	if rb.w > rb.r {
+		head = rb.buf[rb.r : rb.r+n]
+		return
+	}
+	if m := rb.size - rb.r; m >= n {
+		head = rb.buf[rb.r : rb.r+n]
+	} else {
+		head = rb.buf[rb.r:]
+		tail = rb.buf[:n-m]
+	}
+	return
+}
+
+// Discard 丢弃前n个字节，返回实际丢弃的字节数
+func (rb *RingBuffer) Discard(n int) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	buffered := rb.Buffered()
+	if n >= buffered {
+		rb.Reset()
+		if n > buffered {
+			return buffered, ErrNotEnoughData
+		}
+		return buffered, nil
+	}
+	rb.r = (rb.r + n) & rb.mask
+	return n, nil
+}
+
+// Read 读取数据到p中
+func (rb *RingBuffer) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if rb.isEmpty {
+		return 0, io.EOF
+	}
+	head, tail := rb.Peek(len(p))
+	n = copy(p, head)
+	n += copy(p[n:], tail)
+	_, _ = rb.Discard(n)
+	return n, nil
+}
+
+// Write 写入数据，空间不足时扩容
+func (rb *RingBuffer) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if n == 0 {
+		return 0, nil
+	}
+	if free := rb.Available(); n > free {
+		rb.grow(rb.size + n - free)
+	}
+
+	if rb.w >= rb.r {
+		m := copy(rb.buf[rb.w:], p)
+		copy(rb.buf, p[m:])
+	} else {
+		copy(rb.buf[rb.w:], p)
+	}
+	rb.w = (rb.w + n) & rb.mask
+	rb.isEmpty = false
+	return n, nil
+}
+
+// Buffered 缓冲区中的数据长度
+func (rb *RingBuffer) Buffered() int {
+	if rb.isEmpty {
+		return 0
+	}
+	if rb.w > rb.r {
+		return rb.w - rb.r
+	}
+	return rb.size - rb.r + rb.w
+}
+
+// Available 不扩容时还能写入的字节数
+func (rb *RingBuffer) Available() int {
+	return rb.size - rb.Buffered()
+}
+
+// Cap 容量
+func (rb *RingBuffer) Cap() int {
+	return rb.size
+}
+
+// IsEmpty 缓冲区是否为空
+func (rb *RingBuffer) IsEmpty() bool {
+	return rb.isEmpty
+}
+
+// Reset 清空缓冲区，不释放内存
+func (rb *RingBuffer) Reset() {
+	rb.r, rb.w = 0, 0
+	rb.isEmpty = true
+}
+
+// 扩容到至少newCap，并把数据整理到缓冲区开头
+func (rb *RingBuffer) grow(newCap int) {
+	if newCap < defaultBufferSize {
+		newCap = defaultBufferSize
+	}
+	newCap = ceilToPowerOfTwo(newCap)
+	newBuf := make([]byte, newCap)
+	head, tail := rb.Peek(0)
+	n := copy(newBuf, head)
+	n += copy(newBuf[n:], tail)
+
+	rb.buf = newBuf
+	rb.size = newCap
+	rb.mask = newCap - 1
+	rb.r = 0
+	rb.w = n & rb.mask
+}
+
+// 向上取整到2的幂
+func ceilToPowerOfTwo(n int) int {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	return size
+}
@@ -0,0 +1,76 @@
+package ringbuffer_test
+
+import (
+	"bytes"
+	"github.com/Senhnn/shlev/tools/ringbuffer"
+	"io"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	rb := ringbuffer.New(8)
+	if rb.Cap() != 8 || !rb.IsEmpty() {
+		t.Fatalf("new ring buffer: cap=%d empty=%v", rb.Cap(), rb.IsEmpty())
+	}
+
+	_, _ = rb.Write([]byte("abcdef"))
+	if n, _ := rb.Discard(4); n != 4 {
+		t.Fatalf("discard %d bytes, want 4", n)
+	}
+	// 写入的数据跨越缓冲区末尾
+	_, _ = rb.Write([]byte("ghijk"))
+	head, tail := rb.Peek(0)
+	if string(head) != "efgh" || string(tail) != "ijk" {
+		t.Fatalf("peek head=%q tail=%q", head, tail)
+	}
+	if rb.Buffered() != 7 || rb.Available() != 1 {
+		t.Fatalf("buffered=%d available=%d", rb.Buffered(), rb.Available())
+	}
+
+	// 空间不足时扩容，数据保持顺序
+	_, _ = rb.Write([]byte("lmnopq"))
+	if rb.Cap() < 13 {
+		t.Fatalf("ring buffer not grown, cap=%d", rb.Cap())
+	}
+	head, tail = rb.Peek(0)
+	if string(head) != "efghijklmnopq" || len(tail) != 0 {
+		t.Fatalf("peek after grow head=%q tail=%q", head, tail)
+	}
+
+	p := make([]byte, 5)
+	if n, _ := rb.Read(p); n != 5 || string(p) != "efghi" {
+		t.Fatalf("read %q", p[:n])
+	}
+	if n, err := rb.Discard(100); n != 8 || err != ringbuffer.ErrNotEnoughData {
+		t.Fatalf("discard all: n=%d err=%v", n, err)
+	}
+	if _, err := rb.Read(p); err != io.EOF {
+		t.Fatalf("read empty ring buffer: %v", err)
+	}
+}
+
+func TestElasticRingBuffer(t *testing.T) {
+	var b ringbuffer.ElasticRingBuffer
+	if !b.IsEmpty() || b.Buffered() != 0 {
+		t.Fatal("zero value elastic ring buffer should be empty")
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	for i := 0; i < len(data); i += 100 {
+		_, _ = b.Write(data[i : i+100])
+	}
+	var got bytes.Buffer
+	for !b.IsEmpty() {
+		head, tail := b.Peek(333)
+		got.Write(head)
+		got.Write(tail)
+		_, _ = b.Discard(len(head) + len(tail))
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatal("data corrupted in elastic ring buffer")
+	}
+	b.Release()
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read released buffer: %v", err)
+	}
+}
@@ -11,4 +11,48 @@ var (
 	ErrAcceptSocket = errors.New("accept a new connection error")
 	//ErrTooManyEventLoopThreads 所需的线程数过多
 	ErrTooManyEventLoopThreads = errors.New("too many event-loops under LockOSThread mode")
+	// ErrUnsupportedProtocol 不支持的协议
+	ErrUnsupportedProtocol = errors.New("only tcp, udp and unix are supported")
+	// ErrEmptyListenAddr 没有指定监听地址
+	ErrEmptyListenAddr = errors.New("no listen address is specified")
+	// ErrHandoffFailed 子进程没有成功接收监听套接字
+	ErrHandoffFailed = errors.New("handoff to the new process failed")
+	// ErrConnectionClosed 连接已经关闭
+	ErrConnectionClosed = errors.New("connection is closed")
+	// ErrInvalidEventLoop 事件循环的索引不存在
+	ErrInvalidEventLoop = errors.New("invalid event loop index")
+	// ErrConnectionMigrating 连接正在迁移到其他事件循环
+	ErrConnectionMigrating = errors.New("connection is migrating")
+	// ErrMigrateDatagram UDP连接只代表一个数据报的对端，不能迁移
+	ErrMigrateDatagram = errors.New("datagram connection can not be migrated")
+	// ErrIncompletePacket 接收到的数据还不够一个完整的帧
+	ErrIncompletePacket = errors.New("incomplete packet")
+	// ErrFrameTooLarge 帧的长度超过了限制
+	ErrFrameTooLarge = errors.New("frame is too large")
+	// ErrInvalidFrameLength 长度字段的值不合法
+	ErrInvalidFrameLength = errors.New("invalid frame length")
+	// ErrUnsupportedLengthField 长度字段只支持1、2、4、8个字节
+	ErrUnsupportedLengthField = errors.New("length field must be 1, 2, 4 or 8 bytes")
+	// ErrUnsupportedEncode 编解码器的配置不支持编码
+	ErrUnsupportedEncode = errors.New("codec can not encode frames with this layout")
+	// ErrEmptyDelimiter 没有设置分隔符
+	ErrEmptyDelimiter = errors.New("delimiter is empty")
+	// ErrWSProtocol 对端发送的WebSocket帧不符合协议
+	ErrWSProtocol = errors.New("websocket protocol error")
+	// ErrWSInvalidOpCode 不能用WriteMessage发送的帧类型
+	ErrWSInvalidOpCode = errors.New("invalid websocket opcode")
+	// ErrWSCloseSent 已经发送了关闭帧，不能再发送消息
+	ErrWSCloseSent = errors.New("websocket close frame has been sent")
+	// ErrRESPProtocol 对端发送的数据不符合RESP协议
+	ErrRESPProtocol = errors.New("resp protocol error")
+	// ErrInvalidProxyHeader 连接开头不是合法的PROXY协议头部
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+	// ErrConnectTimeout 主动发起的连接在超时时间内没有建立
+	ErrConnectTimeout = errors.New("connect timeout")
+	// ErrMigratePooled 连接池中的连接固定在一个事件循环上，不能迁移
+	ErrMigratePooled = errors.New("pooled connection can not be migrated")
+	// ErrPoolClosed 连接池已经关闭
+	ErrPoolClosed = errors.New("connection pool is closed")
+	// ErrUpstreamUnavailable 连接上游失败，正在退避等待重连
+	ErrUpstreamUnavailable = errors.New("upstream is unavailable, waiting to reconnect")
 )
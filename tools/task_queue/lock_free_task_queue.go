@@ -89,6 +89,11 @@ func (q *lockFreeTaskQueue) IsEmpty() bool {
 	return atomic.LoadInt32(&(q.length)) == 0
 }
 
+// Len 队列中的任务数量
+func (q *lockFreeTaskQueue) Len() int {
+	return int(atomic.LoadInt32(&q.length))
+}
+
 // 加载节点
 func loadNode(n **node) *node {
 	return (*node)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(n))))
@@ -1,7 +1,7 @@
 package task_queue_test
 
 import (
-	taskqueue2 "shlev/tools/task_queue"
+	taskqueue2 "github.com/Senhnn/shlev/tools/task_queue"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -32,11 +32,13 @@ func TestLockFreeTaskQueue(t *testing.T) {
 	var counter int32
 	go func() {
 		for {
+			// 先确认生产者都已经结束，再取到nil时队列才一定是空的
+			done := atomic.LoadInt32(&f) == 2
 			task := q.Dequeue()
 			if task != nil {
 				atomic.AddInt32(&counter, 1)
 			}
-			if task == nil && atomic.LoadInt32(&f) == 2 {
+			if task == nil && done {
 				break
 			}
 		}
@@ -44,16 +46,24 @@ func TestLockFreeTaskQueue(t *testing.T) {
 	}()
 	go func() {
 		for {
+			// 先确认生产者都已经结束，再取到nil时队列才一定是空的
+			done := atomic.LoadInt32(&f) == 2
 			task := q.Dequeue()
 			if task != nil {
 				atomic.AddInt32(&counter, 1)
 			}
-			if task == nil && atomic.LoadInt32(&f) == 2 {
+			if task == nil && done {
 				break
 			}
 		}
 		wg.Done()
 	}()
 	wg.Wait()
+	if counter != 20000 {
+		t.Fatalf("received %d tasks, want 20000", counter)
+	}
+	if q.Len() != 0 || !q.IsEmpty() {
+		t.Fatalf("queue should be empty, len=%d", q.Len())
+	}
 	t.Logf("sent and received all %d tasks", counter)
 }
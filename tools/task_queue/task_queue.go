@@ -29,4 +29,5 @@ type AsyncTaskQueue interface {
 	Enqueue(*Task)
 	Dequeue() *Task
 	IsEmpty() bool
+	Len() int
 }
@@ -0,0 +1,314 @@
+package timewheel
+
+import (
+	"container/heap"
+	"time"
+)
+
+// 分层时间轮，参考kafka的实现：
+// 第一层每个槽代表tick时间，一圈为tick*wheelSize，超出一圈的定时任务放到上一层时间轮中，上一层的tick为下一层的一圈，
+// 到期的槽放在最小堆中，堆顶就是最近要到期的槽，用来计算epoll_wait的超时时间。
+// 槽的到期时间是槽的起始时间，槽中的任务可能还差不到一个tick才到期，这些任务放到soon中，按精确的到期时间执行，
+// 定时任务不会在到期之前执行。
+// 时间轮不是并发安全的，只能在所属的事件循环中使用。
+
+// TimingWheel 分层时间轮
+type TimingWheel struct {
+	*wheel
+	start   time.Time    // 创建时间，所有到期时间都是相对于创建时间的纳秒数
+	queue   *bucketQueue // 所有层共用的槽最小堆
+	pending *bucket      // 添加时就已经到期的任务，下一次Expire时执行
+	soon    *bucket      // 不到一个tick就到期的任务，槽的到期时间是其中最早的到期时间
+	count   int          // 定时任务数量
+}
+
+// Timer 定时任务
+type Timer struct {
+	expiration int64        // 到期时间
+	fn         func() error // 到期回调
+	tw         *TimingWheel // 所属的时间轮
+	b          *bucket      // 所在的槽，为nil表示已经执行或者已经取消
+	prev, next *Timer
+}
+
+// 单层时间轮
+type wheel struct {
+	tick        int64     // 每个槽的时间跨度
+	wheelSize   int64     // 槽数量
+	interval    int64     // 一圈的时间跨度
+	currentTime int64     // 当前时间，tick的整数倍
+	buckets     []*bucket // 槽
+	overflow    *wheel    // 上一层时间轮
+	queue       *bucketQueue
+}
+
+// New 创建时间轮，tick为精度，wheelSize为每层的槽数量
+func New(tick time.Duration, wheelSize int) *TimingWheel {
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+	if wheelSize <= 0 {
+		wheelSize = 64
+	}
+	q := &bucketQueue{}
+	return &TimingWheel{
+		wheel:   newWheel(int64(tick), int64(wheelSize), 0, q),
+		start:   time.Now(),
+		queue:   q,
+		pending: newBucket(),
+		soon:    newBucket(),
+	}
+}
+
+func newWheel(tick, wheelSize, startTime int64, q *bucketQueue) *wheel {
+	buckets := make([]*bucket, wheelSize)
+	for i := range buckets {
+		buckets[i] = newBucket()
+	}
+	return &wheel{
+		tick:        tick,
+		wheelSize:   wheelSize,
+		interval:    tick * wheelSize,
+		currentTime: startTime - startTime%tick,
+		buckets:     buckets,
+		queue:       q,
+	}
+}
+
+// 把定时任务放入对应的槽中，返回false表示已经到期
+func (w *wheel) add(t *Timer) bool {
+	if t.expiration < w.currentTime+w.tick {
+		return false
+	}
+	if t.expiration < w.currentTime+w.interval {
+		virtualID := t.expiration / w.tick
+		b := w.buckets[virtualID%w.wheelSize]
+		b.add(t)
+		// 槽的到期时间发生变化说明槽是新启用的，需要放入堆中
+		if b.setExpiration(virtualID * w.tick) {
+			heap.Push(w.queue, b)
+		}
+		return true
+	}
+	if w.overflow == nil {
+		w.overflow = newWheel(w.interval, w.wheelSize, w.currentTime, w.queue)
+	}
+	return w.overflow.add(t)
+}
+
+// 推进时间
+func (w *wheel) advanceClock(now int64) {
+	if now >= w.currentTime+w.tick {
+		w.currentTime = now - now%w.tick
+		if w.overflow != nil {
+			w.overflow.advanceClock(w.currentTime)
+		}
+	}
+}
+
+func (tw *TimingWheel) now() int64 {
+	return int64(time.Since(tw.start))
+}
+
+// AfterFunc 添加定时任务，d时间之后执行fn
+func (tw *TimingWheel) AfterFunc(d time.Duration, fn func() error) *Timer {
+	now := tw.now()
+	t := &Timer{expiration: now + int64(d), fn: fn, tw: tw}
+	if !tw.add(t) {
+		if t.expiration <= now {
+			tw.pending.add(t)
+		} else {
+			tw.addSoon(t)
+		}
+	}
+	tw.count++
+	return t
+}
+
+// Next 距离最近一个定时任务到期的时间，小于0表示没有定时任务
+func (tw *TimingWheel) Next() time.Duration {
+	if tw.pending.len > 0 {
+		return 0
+	}
+	if tw.queue.Len() == 0 {
+		return -1
+	}
+	d := (*tw.queue)[0].expiration - tw.now()
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// Expire 执行所有到期的定时任务，返回第一个回调错误
+func (tw *TimingWheel) Expire() (err error) {
+	now := tw.now()
+	for _, t := range tw.pending.flush() {
+		if e := tw.run(t); e != nil && err == nil {
+			err = e
+		}
+	}
+	for tw.queue.Len() > 0 && (*tw.queue)[0].expiration <= now {
+		b := heap.Pop(tw.queue).(*bucket)
+		tw.advanceClock(b.expiration)
+		// 重新插入槽中的任务，低层时间轮放不下的任务不到一个tick就到期，还没有到期的放入soon
+		for _, t := range b.flush() {
+			if tw.add(t) {
+				continue
+			}
+			if t.expiration > now {
+				tw.addSoon(t)
+				continue
+			}
+			if e := tw.run(t); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	tw.advanceClock(now)
+	return err
+}
+
+// 放入soon，soon的到期时间变早时调整它在堆中的位置
+func (tw *TimingWheel) addSoon(t *Timer) {
+	b := tw.soon
+	b.add(t)
+	switch {
+	case b.index < 0:
+		b.expiration = t.expiration
+		heap.Push(tw.queue, b)
+	case t.expiration < b.expiration:
+		b.expiration = t.expiration
+		heap.Fix(tw.queue, b.index)
+	}
+}
+
+// Len 定时任务数量
+func (tw *TimingWheel) Len() int {
+	return tw.count
+}
+
+func (tw *TimingWheel) run(t *Timer) error {
+	tw.count--
+	return t.fn()
+}
+
+// Stop 取消定时任务，返回false表示任务已经执行或者已经取消
+func (t *Timer) Stop() bool {
+	if t.b == nil {
+		return false
+	}
+	b := t.b
+	b.remove(t)
+	t.tw.count--
+	t.tw.unschedule(b)
+	return true
+}
+
+// 槽中的任务被取消之后调整槽在堆中的位置，空槽从堆中删除，避免Next返回没有任务的到期时间
+func (tw *TimingWheel) unschedule(b *bucket) {
+	if b.index < 0 {
+		return
+	}
+	if b.len == 0 {
+		heap.Remove(tw.queue, b.index)
+		b.expiration = -1
+		return
+	}
+	// soon的到期时间是其中最早的到期时间，取消的可能就是最早的任务
+	if b == tw.soon {
+		expiration := b.root.next.expiration
+		for t := b.root.next; t != &b.root; t = t.next {
+			if t.expiration < expiration {
+				expiration = t.expiration
+			}
+		}
+		if expiration != b.expiration {
+			b.expiration = expiration
+			heap.Fix(tw.queue, b.index)
+		}
+	}
+}
+
+// bucket 时间轮的槽，双向链表
+type bucket struct {
+	expiration int64 // 到期时间，-1表示不在堆中
+	root       Timer // 哨兵节点
+	len        int
+	index      int // 在堆中的下标
+}
+
+func newBucket() *bucket {
+	b := &bucket{expiration: -1, index: -1}
+	b.root.prev = &b.root
+	b.root.next = &b.root
+	return b
+}
+
+func (b *bucket) setExpiration(expiration int64) bool {
+	if b.expiration == expiration {
+		return false
+	}
+	b.expiration = expiration
+	return true
+}
+
+func (b *bucket) add(t *Timer) {
+	t.b = b
+	t.prev = b.root.prev
+	t.next = &b.root
+	b.root.prev.next = t
+	b.root.prev = t
+	b.len++
+}
+
+func (b *bucket) remove(t *Timer) {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next, t.b = nil, nil, nil
+	b.len--
+}
+
+// 取出所有任务并重置到期时间
+func (b *bucket) flush() []*Timer {
+	if b.len == 0 {
+		b.expiration = -1
+		return nil
+	}
+	timers := make([]*Timer, 0, b.len)
+	for t := b.root.next; t != &b.root; {
+		next := t.next
+		b.remove(t)
+		timers = append(timers, t)
+		t = next
+	}
+	b.expiration = -1
+	return timers
+}
+
+// bucketQueue 按到期时间排序的槽最小堆
+type bucketQueue []*bucket
+
+func (q bucketQueue) Len() int           { return len(q) }
+func (q bucketQueue) Less(i, j int) bool { return q[i].expiration < q[j].expiration }
+func (q bucketQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *bucketQueue) Push(x interface{}) {
+	b := x.(*bucket)
+	b.index = len(*q)
+	*q = append(*q, b)
+}
+
+func (q *bucketQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	b := old[n-1]
+	old[n-1] = nil
+	b.index = -1
+	*q = old[:n-1]
+	return b
+}
@@ -0,0 +1,118 @@
+package timewheel_test
+
+import (
+	"github.com/Senhnn/shlev/tools/timewheel"
+	"testing"
+	"time"
+)
+
+func TestTimingWheel(t *testing.T) {
+	tw := timewheel.New(time.Millisecond, 8)
+	if d := tw.Next(); d >= 0 {
+		t.Fatalf("empty wheel should have no deadline, got %v", d)
+	}
+
+	var fired []int
+	delays := []time.Duration{30 * time.Millisecond, 2 * time.Millisecond, 0, 15 * time.Millisecond}
+	for i, d := range delays {
+		i := i
+		tw.AfterFunc(d, func() error {
+			fired = append(fired, i)
+			return nil
+		})
+	}
+	stopped := tw.AfterFunc(5*time.Millisecond, func() error {
+		t.Error("stopped timer fired")
+		return nil
+	})
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("Stop should succeed exactly once")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for tw.Len() > 0 && time.Now().Before(deadline) {
+		if d := tw.Next(); d > 0 {
+			time.Sleep(d)
+		}
+		if err := tw.Expire(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []int{2, 1, 3, 0}
+	if len(fired) != len(want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+	for i := range want {
+		if fired[i] != want[i] {
+			t.Fatalf("fired %v, want %v", fired, want)
+		}
+	}
+}
+
+func TestTimingWheelAccuracy(t *testing.T) {
+	tw := timewheel.New(time.Millisecond, 8)
+	start := time.Now()
+	var elapsed time.Duration
+	tw.AfterFunc(100*time.Millisecond, func() error {
+		elapsed = time.Since(start)
+		return nil
+	})
+
+	for tw.Len() > 0 {
+		if d := tw.Next(); d > 0 {
+			time.Sleep(d)
+		}
+		_ = tw.Expire()
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 150*time.Millisecond {
+		t.Fatalf("timer fired after %v", elapsed)
+	}
+	t.Logf("timer fired after %v", elapsed)
+}
+
+func TestTimingWheelNotEarly(t *testing.T) {
+	// tick比定时时间的误差大得多，槽到期时其中的任务可能还没有到期
+	tw := timewheel.New(10*time.Millisecond, 8)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		d := time.Duration(i)*7*time.Millisecond + time.Duration(i)*300*time.Microsecond
+		tw.AfterFunc(d, func() error {
+			if elapsed := time.Since(start); elapsed < d {
+				t.Errorf("timer for %v fired after %v", d, elapsed)
+			}
+			return nil
+		})
+	}
+	for tw.Len() > 0 {
+		if d := tw.Next(); d > 0 {
+			time.Sleep(d)
+		}
+		_ = tw.Expire()
+	}
+}
+
+func TestTimingWheelStopRemovesBucket(t *testing.T) {
+	tw := timewheel.New(time.Millisecond, 8)
+	// 分别落在第一层、上层时间轮和soon中
+	for _, d := range []time.Duration{5 * time.Millisecond, time.Second, 500 * time.Microsecond} {
+		timer := tw.AfterFunc(d, func() error {
+			t.Errorf("stopped timer for %v fired", d)
+			return nil
+		})
+		if !timer.Stop() {
+			t.Fatal("Stop failed")
+		}
+		if next := tw.Next(); next >= 0 {
+			t.Fatalf("stopped timer for %v still sets a deadline %v", d, next)
+		}
+	}
+
+	// 取消较早的任务之后，到期时间是剩下的任务的到期时间
+	early := tw.AfterFunc(5*time.Millisecond, func() error { return nil })
+	tw.AfterFunc(time.Second, func() error { return nil })
+	early.Stop()
+	if next := tw.Next(); next < 100*time.Millisecond {
+		t.Fatalf("Next returned %v after stopping the earlier timer", next)
+	}
+}
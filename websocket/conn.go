@@ -0,0 +1,279 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/tools/shleverror"
+	"io"
+	"net"
+	nethttp "net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// 发送关闭帧之后等待对端回复的时间，超时之后直接关闭连接
+const closeTimeout = 5 * time.Second
+
+// Conn WebSocket连接，WriteMessage和Close可以在任意goroutine中调用，其他方法只能在事件回调中调用
+type Conn struct {
+	conn        *shlev.Conn
+	server      *Server
+	request     *nethttp.Request
+	subprotocol string
+	compress    bool        // 协商了permessage-deflate
+	context     interface{} // 用户定义的上下文
+
+	// 只在事件循环中访问
+	upgraded  bool
+	fragOp    OpCode // 分片消息的类型，0表示没有正在接收的分片消息
+	fragRsv1  bool   // 分片消息是否压缩
+	fragments []byte
+	closed    bool  // 已经通知了OnWSClose
+	closeSent int32 // 1：已经发送了关闭帧，可以在任意goroutine中访问
+}
+
+func (c *Conn) Context() interface{}       { return c.context }
+func (c *Conn) SetContext(ctx interface{}) { c.context = ctx }
+func (c *Conn) LocalAddr() net.Addr        { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr       { return c.conn.RemoteAddr() }
+
+// Request 握手请求
+func (c *Conn) Request() *nethttp.Request { return c.request }
+
+// Subprotocol 协商的子协议，没有协商时为空
+func (c *Conn) Subprotocol() string { return c.subprotocol }
+
+// Compressed 是否协商了permessage-deflate
+func (c *Conn) Compressed() bool { return c.compress }
+
+// NetConn 底层的shlev连接，不要修改它的Context
+func (c *Conn) NetConn() *shlev.Conn { return c.conn }
+
+// WriteMessage 发送一个消息，可以在任意goroutine中调用，按调用顺序发送。
+// 协商了permessage-deflate时文本和二进制消息会压缩，发送了关闭帧之后返回shleverror.ErrWSCloseSent
+func (c *Conn) WriteMessage(op OpCode, payload []byte) error {
+	switch op {
+	case TextMessage, BinaryMessage:
+	case PingMessage, PongMessage:
+		if len(payload) > maxControlPayload {
+			return shleverror.ErrFrameTooLarge
+		}
+	default:
+		return shleverror.ErrWSInvalidOpCode
+	}
+	if atomic.LoadInt32(&c.closeSent) == 1 {
+		return shleverror.ErrWSCloseSent
+	}
+
+	compressed := false
+	if c.compress && !op.isControl() {
+		var err error
+		if payload, err = compress(payload); err != nil {
+			return err
+		}
+		compressed = true
+	}
+	return c.conn.AsyncWrite(appendFrame(nil, op, compressed, payload), nil)
+}
+
+// Close 发送关闭帧，等对端回复关闭帧之后关闭连接，超过5秒没有回复时直接关闭，可以在任意goroutine中调用
+func (c *Conn) Close(code CloseCode, reason string) error {
+	if !atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		return shleverror.ErrWSCloseSent
+	}
+	if err := c.conn.AsyncWrite(closeFrame(code, reason), nil); err != nil {
+		return err
+	}
+	c.conn.AfterFunc(closeTimeout, func(*shlev.Conn) shlev.HandleResult {
+		return shlev.Close
+	})
+	return nil
+}
+
+// 发送关闭帧之后关闭底层连接，异步写完之后才会关闭
+func (c *Conn) fail(code CloseCode) {
+	if atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		_ = c.conn.AsyncWrite(closeFrame(code, ""), nil)
+	}
+	_ = c.conn.Close()
+}
+
+func closeFrame(code CloseCode, reason string) []byte {
+	var payload []byte
+	if code != CloseNoStatusReceived {
+		// 原因太长时截断，不能截在多字节字符的中间，否则对端按无效的UTF-8处理
+		if max := maxControlPayload - 2; len(reason) > max {
+			i := max
+			for i > 0 && !utf8.RuneStart(reason[i]) {
+				i--
+			}
+			reason = reason[:i]
+		}
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	return appendFrame(nil, CloseMessage, false, payload)
+}
+
+// 处理接收缓冲区中所有完整的帧
+func (c *Conn) readFrames() {
+	for !c.closed {
+		f, code, err := readFrame(c.conn, c.server.maxMessageSize())
+		if err == shleverror.ErrIncompletePacket {
+			return
+		}
+		if err != nil {
+			c.protocolError(code)
+			return
+		}
+		if code = c.handleFrame(f); code != 0 {
+			c.protocolError(code)
+			return
+		}
+	}
+}
+
+// 协议错误，通知回调之后发送关闭帧并关闭连接
+func (c *Conn) protocolError(code CloseCode) {
+	c.notifyClose(code, "")
+	c.fail(code)
+	_, _ = c.conn.Discard(-1)
+}
+
+// 处理一个帧，返回非0的关闭码表示协议错误
+func (c *Conn) handleFrame(f *frame) CloseCode {
+	switch f.op {
+	case PingMessage:
+		if atomic.LoadInt32(&c.closeSent) == 0 {
+			_ = c.conn.AsyncWrite(appendFrame(nil, PongMessage, false, f.payload), nil)
+		}
+		c.server.Handler.OnWSMessage(c, PingMessage, f.payload)
+		return 0
+	case PongMessage:
+		c.server.Handler.OnWSMessage(c, PongMessage, f.payload)
+		return 0
+	case CloseMessage:
+		return c.handleClose(f.payload)
+	case TextMessage, BinaryMessage:
+		if c.fragOp != 0 || (f.rsv1 && !c.compress) {
+			return CloseProtocolError
+		}
+		if f.fin {
+			return c.deliver(f.op, f.rsv1, f.payload)
+		}
+		c.fragOp, c.fragRsv1 = f.op, f.rsv1
+		c.fragments = append(c.fragments[:0], f.payload...)
+		return 0
+	case continuationFrame:
+		if c.fragOp == 0 || f.rsv1 {
+			return CloseProtocolError
+		}
+		if len(c.fragments)+len(f.payload) > c.server.maxMessageSize() {
+			return CloseMessageTooBig
+		}
+		c.fragments = append(c.fragments, f.payload...)
+		if !f.fin {
+			return 0
+		}
+		op, rsv1 := c.fragOp, c.fragRsv1
+		c.fragOp, c.fragRsv1 = 0, false
+		code := c.deliver(op, rsv1, c.fragments)
+		c.fragments = c.fragments[:0]
+		return code
+	}
+	return CloseProtocolError
+}
+
+// 把完整的消息交给回调，压缩的消息先解压，文本消息检查UTF-8编码
+func (c *Conn) deliver(op OpCode, compressed bool, payload []byte) CloseCode {
+	if compressed {
+		var err error
+		if payload, err = decompress(payload, c.server.maxMessageSize()); err != nil {
+			if err == shleverror.ErrFrameTooLarge {
+				return CloseMessageTooBig
+			}
+			return CloseInvalidPayload
+		}
+	}
+	if op == TextMessage && !utf8.Valid(payload) {
+		return CloseInvalidPayload
+	}
+	c.server.Handler.OnWSMessage(c, op, payload)
+	return 0
+}
+
+// 收到关闭帧，没有发送过关闭帧时回复同样的关闭码，然后关闭连接
+func (c *Conn) handleClose(payload []byte) CloseCode {
+	code, reason := CloseNoStatusReceived, ""
+	switch {
+	case len(payload) == 1:
+		return CloseProtocolError
+	case len(payload) >= 2:
+		code = CloseCode(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+		if !code.valid() || !utf8.ValidString(reason) {
+			return CloseProtocolError
+		}
+	}
+	c.notifyClose(code, reason)
+	if atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		_ = c.conn.AsyncWrite(closeFrame(code, ""), nil)
+	}
+	_ = c.conn.Close()
+	_, _ = c.conn.Discard(-1)
+	return 0
+}
+
+// 通知回调连接关闭，只通知一次
+func (c *Conn) notifyClose(code CloseCode, reason string) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if h, ok := c.server.Handler.(CloseHandler); ok {
+		h.OnWSClose(c, code, reason)
+	}
+}
+
+// permessage-deflate的每个消息去掉了同步刷新产生的结尾，解压时补上，再加一个空的结束块
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+var flateWriterPool = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+// 压缩一个消息，不保留上下文，每个消息单独压缩
+func compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	// 去掉同步刷新产生的00 00 ff ff
+	return b[:len(b)-4], nil
+}
+
+// 解压一个消息，解压之后超过max时返回shleverror.ErrFrameTooLarge
+func decompress(payload []byte, max int) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader([]byte(deflateTail))))
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > max {
+		return nil, shleverror.ErrFrameTooLarge
+	}
+	return b, nil
+}
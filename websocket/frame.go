@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/tools/shleverror"
+)
+
+// OpCode 帧的类型
+type OpCode byte
+
+const (
+	continuationFrame OpCode = 0
+	// TextMessage 文本消息，负载是UTF-8编码的文本
+	TextMessage OpCode = 1
+	// BinaryMessage 二进制消息
+	BinaryMessage OpCode = 2
+	// CloseMessage 关闭连接，负载是2个字节的关闭码和原因
+	CloseMessage OpCode = 8
+	// PingMessage 心跳请求，服务器收到之后自动回复Pong
+	PingMessage OpCode = 9
+	// PongMessage 心跳回复
+	PongMessage OpCode = 10
+)
+
+func (op OpCode) isControl() bool {
+	return op&0x8 != 0
+}
+
+// CloseCode 关闭码，参看RFC 6455 7.4
+type CloseCode uint16
+
+const (
+	CloseNormalClosure      CloseCode = 1000
+	CloseGoingAway          CloseCode = 1001
+	CloseProtocolError      CloseCode = 1002
+	CloseUnsupportedData    CloseCode = 1003
+	CloseNoStatusReceived   CloseCode = 1005 // 对端的关闭帧没有关闭码，不能发送
+	CloseAbnormalClosure    CloseCode = 1006 // 没有收到关闭帧连接就断开了，不能发送
+	CloseInvalidPayload     CloseCode = 1007
+	ClosePolicyViolation    CloseCode = 1008
+	CloseMessageTooBig      CloseCode = 1009
+	CloseMandatoryExtension CloseCode = 1010
+	CloseInternalServerErr  CloseCode = 1011
+)
+
+// 关闭帧中可以出现的关闭码
+func (code CloseCode) valid() bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40 // permessage-deflate用来标记压缩的消息
+	rsv23   = 0x30
+	maskBit = 0x80
+
+	// 控制帧负载的最大长度
+	maxControlPayload = 125
+)
+
+// 解析出的一个帧
+type frame struct {
+	fin     bool
+	rsv1    bool
+	op      OpCode
+	payload []byte // 已经去掉掩码，只在本次OnTraffic中有效
+}
+
+// 从接收缓冲区中解析一个帧，数据不够时返回shleverror.ErrIncompletePacket，客户端发送的帧必须有掩码
+func readFrame(c *shlev.Conn, maxPayload int) (*frame, CloseCode, error) {
+	head, err := c.Peek(2)
+	if err != nil {
+		return nil, 0, shleverror.ErrIncompletePacket
+	}
+	f := &frame{fin: head[0]&finBit != 0, rsv1: head[0]&rsv1Bit != 0, op: OpCode(head[0] & 0x0f)}
+	if head[0]&rsv23 != 0 {
+		return nil, CloseProtocolError, shleverror.ErrWSProtocol
+	}
+	if head[1]&maskBit == 0 {
+		return nil, CloseProtocolError, shleverror.ErrWSProtocol
+	}
+
+	headerLen := 2 + 4
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		headerLen += 2
+	case 127:
+		headerLen += 8
+	}
+	if f.op.isControl() && (n > maxControlPayload || !f.fin) {
+		return nil, CloseProtocolError, shleverror.ErrWSProtocol
+	}
+	if c.InboundBuffered() < headerLen {
+		return nil, 0, shleverror.ErrIncompletePacket
+	}
+	header, _ := c.Peek(headerLen)
+	switch n {
+	case 126:
+		n = uint64(binary.BigEndian.Uint16(header[2:]))
+	case 127:
+		n = binary.BigEndian.Uint64(header[2:])
+	}
+	if n > uint64(maxPayload) {
+		return nil, CloseMessageTooBig, shleverror.ErrFrameTooLarge
+	}
+	var mask [4]byte
+	copy(mask[:], header[headerLen-4:])
+	if c.InboundBuffered() < headerLen+int(n) {
+		return nil, 0, shleverror.ErrIncompletePacket
+	}
+
+	_, _ = c.Discard(headerLen)
+	payload, _ := c.Next(int(n))
+	// Next返回的切片指向接收缓冲区，去掉掩码之后交给回调
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+	f.payload = payload
+	return f, 0, nil
+}
+
+// 编码服务器发送的帧，服务器发送的帧没有掩码
+func appendFrame(b []byte, op OpCode, compressed bool, payload []byte) []byte {
+	b0 := byte(finBit) | byte(op)
+	if compressed {
+		b0 |= rsv1Bit
+	}
+	b = append(b, b0)
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, byte(n))
+	case n <= 0xffff:
+		b = append(b, 126, byte(n>>8), byte(n))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	return append(b, payload...)
+}
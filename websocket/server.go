@@ -0,0 +1,231 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/Senhnn/shlev"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultMaxMessageSize 默认的消息最大长度，分片消息按合并之后的长度计算，压缩的消息按解压之后的长度计算
+	DefaultMaxMessageSize = 4 << 20 // 4MB
+
+	// 握手请求的最大长度
+	maxHandshakeBytes = 16 * 1024
+
+	// 计算Sec-WebSocket-Accept用的GUID，参看RFC 6455 1.3
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// Handler 处理WebSocket消息，回调在事件循环中执行，不能阻塞
+type Handler interface {
+	// OnWSMessage 收到一个完整的消息，分片消息合并之后调用一次，压缩的消息已经解压。
+	// Ping和Pong也会通知，服务器已经自动回复了Pong。payload只在本次调用中有效
+	OnWSMessage(c *Conn, op OpCode, payload []byte)
+}
+
+// OpenHandler 可选实现，握手完成之后调用
+type OpenHandler interface {
+	OnWSOpen(c *Conn)
+}
+
+// CloseHandler 可选实现，收到关闭帧、协议错误或者连接断开时调用一次，没有收到关闭帧时code为CloseAbnormalClosure
+type CloseHandler interface {
+	OnWSClose(c *Conn, code CloseCode, reason string)
+}
+
+// Server WebSocket服务器，实现了shlev.EventHandler，新连接先完成HTTP升级握手，之后按帧处理数据
+type Server struct {
+	// Handler 处理消息
+	Handler Handler
+
+	// Subprotocols 支持的子协议，按客户端请求的顺序选择第一个支持的
+	Subprotocols []string
+
+	// CheckOrigin 检查握手请求的Origin，返回false时拒绝握手，nil表示不检查
+	CheckOrigin func(r *nethttp.Request) bool
+
+	// EnableCompression 客户端请求时协商permessage-deflate，不保留压缩上下文，每个消息单独压缩
+	EnableCompression bool
+
+	// MaxMessageSize 消息的最大长度，超过时用1009关闭连接，0表示DefaultMaxMessageSize
+	MaxMessageSize int
+}
+
+// NewServer 创建WebSocket服务器
+func NewServer(handler Handler) *Server {
+	return &Server{Handler: handler}
+}
+
+var _ shlev.DrainHandler = (*Server)(nil)
+
+func (s *Server) maxMessageSize() int {
+	if s.MaxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return s.MaxMessageSize
+}
+
+func (s *Server) OnBoot(*shlev.Server) error { return nil }
+
+func (s *Server) OnShutdown(*shlev.Server) {}
+
+func (s *Server) OnOpen(c *shlev.Conn, _ error) ([]byte, shlev.HandleResult) {
+	// 保留主动发起连接时设置的上下文
+	c.SetContext(&Conn{conn: c, server: s, context: c.Context()})
+	return nil, shlev.None
+}
+
+// OnConnectionClose 没有收到关闭帧连接就断开时，用CloseAbnormalClosure通知回调
+func (s *Server) OnConnectionClose(c *shlev.Conn, _ error) {
+	if ws, ok := c.Context().(*Conn); ok && ws.upgraded {
+		ws.notifyClose(CloseAbnormalClosure, "")
+	}
+}
+
+// OnDrain 服务器优雅关闭时用1001通知对端
+func (s *Server) OnDrain(c *shlev.Conn) {
+	ws, ok := c.Context().(*Conn)
+	if !ok {
+		return
+	}
+	if !ws.upgraded {
+		_ = c.Close()
+		return
+	}
+	_ = ws.Close(CloseGoingAway, "server shutdown")
+}
+
+func (s *Server) OnTraffic(c *shlev.Conn) shlev.HandleResult {
+	ws, ok := c.Context().(*Conn)
+	if !ok {
+		return shlev.Close
+	}
+	if !ws.upgraded && !s.handshake(ws) {
+		return shlev.None
+	}
+	ws.readFrames()
+	return shlev.None
+}
+
+// 读取握手请求并回复，请求还不完整时返回false，握手失败时回复错误并关闭连接
+func (s *Server) handshake(ws *Conn) bool {
+	c := ws.conn
+	limit := c.InboundBuffered()
+	if limit > maxHandshakeBytes {
+		limit = maxHandshakeBytes
+	}
+	buf, _ := c.Peek(limit)
+	end := bytes.Index(buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		if limit == maxHandshakeBytes {
+			s.reject(c, nethttp.StatusRequestHeaderFieldsTooLarge, "")
+		}
+		return false
+	}
+	req, err := nethttp.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:end+4])))
+	_, _ = c.Discard(end + 4)
+	if err != nil {
+		s.reject(c, nethttp.StatusBadRequest, "")
+		return false
+	}
+
+	switch {
+	case req.Method != nethttp.MethodGet || !headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Upgrade", "websocket"):
+		s.reject(c, nethttp.StatusBadRequest, "")
+		return false
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		s.reject(c, nethttp.StatusUpgradeRequired, "Sec-WebSocket-Version: 13\r\n")
+		return false
+	case s.CheckOrigin != nil && !s.CheckOrigin(req):
+		s.reject(c, nethttp.StatusForbidden, "")
+		return false
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		s.reject(c, nethttp.StatusBadRequest, "")
+		return false
+	}
+
+	ws.request = req
+	ws.subprotocol = s.selectSubprotocol(req)
+	ws.compress = s.EnableCompression && offersDeflate(req)
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if ws.subprotocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + ws.subprotocol + "\r\n"
+	}
+	if ws.compress {
+		resp += "Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n"
+	}
+	// 握手响应也走异步写，保证在之后的WriteMessage之前发送
+	if err = c.AsyncWrite([]byte(resp+"\r\n"), nil); err != nil {
+		_ = c.Close()
+		return false
+	}
+	ws.upgraded = true
+	if h, ok := s.Handler.(OpenHandler); ok {
+		h.OnWSOpen(ws)
+	}
+	return true
+}
+
+// 拒绝握手，回复错误之后关闭连接
+func (s *Server) reject(c *shlev.Conn, code int, header string) {
+	text := nethttp.StatusText(code)
+	_, _ = c.Write([]byte("HTTP/1.1 " + strconv.Itoa(code) + " " + text + "\r\n" + header +
+		"Connection: close\r\nContent-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(text)) + "\r\n\r\n" + text))
+	_, _ = c.Discard(-1)
+	_ = c.Close()
+}
+
+func (s *Server) selectSubprotocol(req *nethttp.Request) string {
+	for _, v := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			p = strings.TrimSpace(p)
+			for _, supported := range s.Subprotocols {
+				if p == supported {
+					return p
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// 客户端是否请求了permessage-deflate
+func offersDeflate(req *nethttp.Request) bool {
+	for _, v := range req.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name := strings.TrimSpace(strings.SplitN(ext, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 逗号分隔的头部是否包含token，不区分大小写
+func headerContains(h nethttp.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
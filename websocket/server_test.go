@@ -0,0 +1,329 @@
+package websocket_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/Senhnn/shlev"
+	"github.com/Senhnn/shlev/tools/logger"
+	"github.com/Senhnn/shlev/websocket"
+	"io"
+	"net"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type closeEvent struct {
+	code   websocket.CloseCode
+	reason string
+}
+
+type echoHandler struct {
+	conns  chan *websocket.Conn
+	closes chan closeEvent
+}
+
+func newEchoHandler() *echoHandler {
+	return &echoHandler{conns: make(chan *websocket.Conn, 1), closes: make(chan closeEvent, 1)}
+}
+
+func (h *echoHandler) OnWSOpen(c *websocket.Conn) {
+	_ = c.WriteMessage(websocket.TextMessage, []byte("welcome "+c.Subprotocol()))
+	h.conns <- c
+}
+
+func (h *echoHandler) OnWSMessage(c *websocket.Conn, op websocket.OpCode, payload []byte) {
+	if op == websocket.TextMessage || op == websocket.BinaryMessage {
+		_ = c.WriteMessage(op, payload)
+	}
+}
+
+func (h *echoHandler) OnWSClose(_ *websocket.Conn, code websocket.CloseCode, reason string) {
+	h.closes <- closeEvent{code, reason}
+}
+
+func startServer(t *testing.T, s *websocket.Server) string {
+	srv, err := shlev.Start(s, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _ = srv.Shutdown(ctx)
+	})
+	return srv.Addr().String()
+}
+
+// 测试用的客户端，发送的帧都带掩码
+type client struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, addr, header string) (*client, *nethttp.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, _ = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" + header + "\r\n"))
+	c := &client{Conn: conn, r: bufio.NewReader(conn)}
+	resp, err := nethttp.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+func (c *client) writeFrame(b0 byte, payload []byte) {
+	_, _ = c.Write(maskedFrame(b0, payload))
+}
+
+func maskedFrame(b0 byte, payload []byte) []byte {
+	frame := []byte{b0}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func (c *client) readFrame(t *testing.T) (b0 byte, payload []byte) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, head); err != nil {
+		t.Fatal(err)
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		ext := make([]byte, 2)
+		_, _ = io.ReadFull(c.r, ext)
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, _ = io.ReadFull(c.r, ext)
+		n = binary.BigEndian.Uint64(ext)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatal("server frames must not be masked")
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0], payload
+}
+
+func (c *client) expect(t *testing.T, b0 byte, payload string) {
+	got0, got := c.readFrame(t)
+	if got0 != b0 || string(got) != payload {
+		t.Fatalf("got frame %#x %q, want %#x %q", got0, got, b0, payload)
+	}
+}
+
+func closePayload(code websocket.CloseCode, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// 日志写到临时目录，运行测试不会在包目录下留下shlev_net.log
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "shlev-log")
+	if err != nil {
+		panic(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "shlev_net.log"))
+	if err != nil {
+		panic(err)
+	}
+	logger.SetOutput(f)
+	code := m.Run()
+	_ = f.Close()
+	if code == 0 {
+		_ = os.RemoveAll(dir)
+	} else {
+		fmt.Println("log:", f.Name())
+	}
+	os.Exit(code)
+}
+
+func TestEcho(t *testing.T) {
+	h := newEchoHandler()
+	addr := startServer(t, &websocket.Server{Handler: h, Subprotocols: []string{"chat"}})
+	c, resp := dial(t, addr, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: superchat, chat\r\n")
+
+	// RFC 6455中的例子
+	if resp.StatusCode != nethttp.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" ||
+		resp.Header.Get("Sec-WebSocket-Protocol") != "chat" {
+		t.Fatalf("unexpected handshake response: %d %v", resp.StatusCode, resp.Header)
+	}
+	c.expect(t, 0x81, "welcome chat")
+
+	c.writeFrame(0x81, []byte("hello"))
+	c.expect(t, 0x81, "hello")
+
+	// 没有负载的帧后面紧跟着其他帧
+	_, _ = c.Write(append(maskedFrame(0x89, nil), maskedFrame(0x81, []byte("after empty ping"))...))
+	c.expect(t, 0x8a, "")
+	c.expect(t, 0x81, "after empty ping")
+
+	// 分片消息中间插入ping，先收到pong，再收到合并之后的消息
+	c.writeFrame(0x02, []byte("ab"))
+	c.writeFrame(0x89, []byte("ping"))
+	c.writeFrame(0x00, []byte("cd"))
+	c.writeFrame(0x80, []byte("ef"))
+	c.expect(t, 0x8a, "ping")
+	c.expect(t, 0x82, "abcdef")
+
+	large := strings.Repeat("x", 70000)
+	c.writeFrame(0x81, []byte(large))
+	c.expect(t, 0x81, large)
+
+	c.writeFrame(0x88, closePayload(websocket.CloseNormalClosure, "bye"))
+	c.expect(t, 0x88, string(closePayload(websocket.CloseNormalClosure, "")))
+	if ev := <-h.closes; ev.code != websocket.CloseNormalClosure || ev.reason != "bye" {
+		t.Fatalf("unexpected close event: %+v", ev)
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection should be closed, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	addr := startServer(t, &websocket.Server{Handler: newEchoHandler(), EnableCompression: true})
+	c, resp := dial(t, addr, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	if !strings.HasPrefix(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Fatalf("compression is not negotiated: %v", resp.Header)
+	}
+	_, _ = c.readFrame(t)
+
+	msg := strings.Repeat("compress me ", 100)
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	_, _ = w.Write([]byte(msg))
+	_ = w.Flush()
+	c.writeFrame(0xc1, buf.Bytes()[:buf.Len()-4])
+
+	b0, payload := c.readFrame(t)
+	if b0 != 0xc1 || len(payload) >= len(msg) {
+		t.Fatalf("echo is not compressed: %#x %d", b0, len(payload))
+	}
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(payload), strings.NewReader("\x00\x00\xff\xff\x01\x00\x00\xff\xff")))
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != msg {
+		t.Fatalf("decompress echo: %v %q", err, got)
+	}
+}
+
+func TestWriteMessageFromOtherGoroutine(t *testing.T) {
+	h := newEchoHandler()
+	addr := startServer(t, websocket.NewServer(h))
+	c, _ := dial(t, addr, "Sec-WebSocket-Version: 13\r\n")
+	c.expect(t, 0x81, "welcome ")
+
+	ws := <-h.conns
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = ws.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprint(i)))
+		}
+		_ = ws.Close(websocket.CloseGoingAway, "done")
+	}()
+	for i := 0; i < 100; i++ {
+		c.expect(t, 0x82, fmt.Sprint(i))
+	}
+	c.expect(t, 0x88, string(closePayload(websocket.CloseGoingAway, "done")))
+	if err := ws.WriteMessage(websocket.TextMessage, nil); err == nil {
+		t.Fatal("write after close should fail")
+	}
+	c.writeFrame(0x88, closePayload(websocket.CloseGoingAway, ""))
+	if ev := <-h.closes; ev.code != websocket.CloseGoingAway {
+		t.Fatalf("unexpected close event: %+v", ev)
+	}
+}
+
+func TestCloseLongReason(t *testing.T) {
+	h := newEchoHandler()
+	addr := startServer(t, websocket.NewServer(h))
+	c, _ := dial(t, addr, "Sec-WebSocket-Version: 13\r\n")
+	c.expect(t, 0x81, "welcome ")
+
+	// 每个字符两个字节，123字节的上限落在字符中间，截断之后是61个完整的字符
+	ws := <-h.conns
+	_ = ws.Close(websocket.CloseNormalClosure, strings.Repeat("é", 100))
+	b0, payload := c.readFrame(t)
+	want := closePayload(websocket.CloseNormalClosure, strings.Repeat("é", 61))
+	if b0 != 0x88 || !bytes.Equal(payload, want) {
+		t.Fatalf("got frame %#x %q, want %q", b0, payload, want)
+	}
+	// 把收到的关闭帧原样发回去，服务器能正常解析
+	c.writeFrame(0x88, payload)
+	if ev := <-h.closes; ev.code != websocket.CloseNormalClosure || ev.reason != strings.Repeat("é", 61) {
+		t.Fatalf("unexpected close event: %+v", ev)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	h := newEchoHandler()
+	addr := startServer(t, &websocket.Server{Handler: h, MaxMessageSize: 16})
+	cases := []struct {
+		name string
+		send func(c *client)
+		code websocket.CloseCode
+	}{
+		{"unmasked", func(c *client) { _, _ = c.Write([]byte{0x81, 0x01, 'a'}) }, websocket.CloseProtocolError},
+		{"invalid utf8", func(c *client) { c.writeFrame(0x81, []byte{0xff, 0xfe}) }, websocket.CloseInvalidPayload},
+		{"too big", func(c *client) { c.writeFrame(0x82, make([]byte, 17)) }, websocket.CloseMessageTooBig},
+		{"fragmented too big", func(c *client) {
+			c.writeFrame(0x02, make([]byte, 10))
+			c.writeFrame(0x80, make([]byte, 10))
+		}, websocket.CloseMessageTooBig},
+		{"unexpected continuation", func(c *client) { c.writeFrame(0x80, []byte("a")) }, websocket.CloseProtocolError},
+		{"compressed without negotiation", func(c *client) { c.writeFrame(0xc1, []byte("a")) }, websocket.CloseProtocolError},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := dial(t, addr, "Sec-WebSocket-Version: 13\r\n")
+			_, _ = c.readFrame(t)
+			tc.send(c)
+			c.expect(t, 0x88, string(closePayload(tc.code, "")))
+			if ev := <-h.closes; ev.code != tc.code {
+				t.Fatalf("unexpected close event: %+v", ev)
+			}
+			<-h.conns
+		})
+	}
+}
+
+func TestRejectHandshake(t *testing.T) {
+	addr := startServer(t, &websocket.Server{
+		Handler:     newEchoHandler(),
+		CheckOrigin: func(r *nethttp.Request) bool { return r.Header.Get("Origin") != "http://evil" },
+	})
+	if _, resp := dial(t, addr, "Sec-WebSocket-Version: 8\r\n"); resp.StatusCode != nethttp.StatusUpgradeRequired ||
+		resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+	}
+	if _, resp := dial(t, addr, "Sec-WebSocket-Version: 13\r\nOrigin: http://evil\r\n"); resp.StatusCode != nethttp.StatusForbidden {
+		t.Fatalf("unexpected response: %d", resp.StatusCode)
+	}
+}